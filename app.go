@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/haylesnortal/rpt/rpt"
 )
@@ -10,8 +11,9 @@ func main() {
 
 	r, err := rpt.NewRptFromEnvironment()
 	if err != nil {
-		fmt.Printf("error: %s", err)
+		fmt.Printf("error: %s\n", err)
+		os.Exit(1)
 	}
 
-	r.Init()
+	os.Exit(r.Run())
 }
@@ -7,7 +7,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/gddo/httputil/header"
@@ -23,89 +27,409 @@ type APIServer struct {
 	secondary          DBClient
 	Server             *http.Server
 	state              chan *InternalStateChange
+	lifecycle          *StateMachine
 	Logger             *Logger
-
-	currentLog *Log
-	loglvl     string
+	Auth               *APIAuth     // nil allows every request
+	TLS                *APITLS      // nil serves plain HTTP
+	Idempotency        *Idempotency // nil ignores Idempotency-Key
+	RateLimiter        *RateLimiter // nil doesn't limit requests
+	MaxBodyBytes       int64        // largest request body accepted, 0 for no limit
+	GRPC               *GRPCServer  // nil serves HTTP only
+	Workflows          []*Workflow  // listed by GET /workflow
+	DataDir            string       // data files of workflows run through the API are read from here
+
+	log       *Logger
+	router    *Router
+	tracer    *Tracer
+	progress  *Progress
+	mu        sync.Mutex // guards Server, lookupOperationSet, stopped and sends on Operations
+	stopped   bool       // set by Shutdown; no more operation sets are queued
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
+// streamKeepAlive is how often /logs/stream and /operations/stream send a
+// comment to keep idle connections open.
+const streamKeepAlive = 15 * time.Second
+
+// queueFullRetryAfter is the Retry-After sent when the operation queue is
+// full.
+const queueFullRetryAfter = 5 * time.Second
+
+var (
+	errQueueFull    = errors.New("rpt: operation queue is full")
+	errShuttingDown = errors.New("rpt: shutting down")
+)
+
+// POST /query?wait=true waits defaultQueryWait for the result unless a timeout
+// is given, and never longer than maxQueryWait.
+const (
+	defaultQueryWait = 30 * time.Second
+	maxQueryWait     = 5 * time.Minute
+)
+
+// GET /operations lists defaultOperationsLimit sets unless a limit is given,
+// and never more than maxOperationsLimit.
+const (
+	defaultOperationsLimit = 50
+	maxOperationsLimit     = 500
+)
+
 // FUNCTIONS
 
-func (a *APIServer) Init(c chan *DBOperationSet, s chan *InternalStateChange, primary DBClient, secondary DBClient, l *Logger, lvl string) {
+func (a *APIServer) Init(c chan *DBOperationSet, s chan *InternalStateChange, sm *StateMachine, primary DBClient, secondary DBClient, l *Logger, t *Tracer, p *Progress) {
 	a.Operations = c
 	a.state = s
+	a.lifecycle = sm
 	a.primary = primary
 	a.secondary = secondary
 	a.Logger = l
+	a.log = l.With(Fields{FieldComponent: "api"})
+	a.tracer = t
+	a.progress = p
+	a.mu.Lock()
 	a.lookupOperationSet = map[string]*DBOperationSet{}
+	a.closing = make(chan struct{})
+	a.mu.Unlock()
+	if a.findPrometheusOutput() == nil {
+		a.Logger.AddMetricOutput(NewPrometheusOutput())
+	}
+	if a.findPullOutput() == nil {
+		a.Logger.AddLogOutput(NewPullOutput())
+	}
+	a.SetupRoutes()
+	handler := a.Handler()
+	a.mu.Lock()
+	if a.stopped {
+		a.mu.Unlock()
+		a.log.Debugf("API shut down before it started")
+		return
+	}
 	a.Server = &http.Server{
 		Addr:    a.ListenAddr,
-		Handler: nil,
+		Handler: handler,
 	}
-	a.loglvl = lvl
-	a.newLog()
-	pull := NewPullOutput()
-	a.Logger.AddMetricOutput(pull)
-	a.SetupRoutes()
-	if err := a.Server.ListenAndServe(); err != nil {
-		fmt.Println(err)
+	if a.GRPC != nil {
+		a.GRPC.start(a)
+	}
+	a.mu.Unlock()
+	if err := a.listenAndServe(); err != nil && err != http.ErrServerClosed {
+		a.log.Errorf("API server: %s", err)
+		a.requestState(context.Background(), newInternalState(EventStop))
+	}
+}
+
+func (a *APIServer) listenAndServe() error {
+
+	if a.TLS == nil {
+		a.log.Infof("Listening on http://%s%s", a.ListenAddr, a.BasePath)
+		return a.Server.ListenAndServe()
+	}
+
+	if a.TLS.Logger == nil {
+		a.TLS.Logger = a.log
+	}
+	a.Server.TLSConfig = a.TLS.Config()
+
+	a.log.Infof("Listening on https://%s%s", a.ListenAddr, a.BasePath)
+	return a.Server.ListenAndServeTLS("", "")
+}
+
+// ReloadTLS reads the API certificates again. It does nothing if the API is
+// served over plain HTTP.
+func (a *APIServer) ReloadTLS() error {
+	if a.TLS == nil {
+		return nil
 	}
+	return a.TLS.Reload()
 }
 
+// Shutdown stops accepting requests and waits for in-flight requests to
+// finish until ctx expires. Once it has been called no more operation sets
+// are queued, so the queue can be closed even if requests are still being
+// handled, and an API that has not started yet never will.
+func (a *APIServer) Shutdown(ctx context.Context) error {
+	a.mu.Lock()
+	a.stopped = true
+	srv := a.Server
+	closing := a.closing
+	a.mu.Unlock()
+
+	if srv == nil {
+		return nil
+	}
+
+	// Long-lived streams would otherwise hold Shutdown until ctx expires.
+	a.closeOnce.Do(func() {
+		close(closing)
+	})
+
+	if a.GRPC != nil {
+		if err := a.GRPC.Shutdown(ctx); err != nil {
+			a.log.Warnf("gRPC server did not stop cleanly: %s", err)
+		}
+	}
+
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		srv.Close()
+	}
+
+	return err
+}
+
+// requestState passes a state change to the RptClient, waiting for room in
+// the state queue as RptClient.sendState does. It reports false if the client
+// stopped, the API began shutting down or ctx expired first.
+func (a *APIServer) requestState(ctx context.Context, sc *InternalStateChange) bool {
+	a.mu.Lock()
+	closing := a.closing
+	a.mu.Unlock()
+
+	select {
+	case a.state <- sc:
+		return true
+	case <-a.lifecycle.Stopped():
+		return false
+	case <-closing:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// SetupRoutes registers every route on a new Router for this server.
 func (a *APIServer) SetupRoutes() {
-	healthHandler := http.HandlerFunc(a.HandleHealth)
-	seedDataHandler := http.HandlerFunc(a.HandleSeedData)
-	readDataHandler := http.HandlerFunc(a.HandleReadData)
-	writeDataHandler := http.HandlerFunc(a.HandleWriteData)
-	deleteDataHandler := http.HandlerFunc(a.HandleDeleteData)
-	configureClientHandler := http.HandlerFunc(a.HandleConfigureClient)
-	reconnectClientHandler := http.HandlerFunc(a.HandleReconnectClient)
-	connectClientHandler := http.HandlerFunc(a.HandleConnectClient)
-	disconnectClientHandler := http.HandlerFunc(a.HandleDisconnectClient)
-	operationHandler := http.HandlerFunc(a.HandleOperation)
-	workflowHandler := http.HandlerFunc(a.HandleWorkflow)
-	closeHandler := http.HandlerFunc(a.HandleClose)
-	queryHandler := http.HandlerFunc(a.HandleQuery)
-	metricsHandler := http.HandlerFunc(a.HandleMetrics)
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "health"), Middleware(healthHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "data/read"), Middleware(readDataHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "data/write"), Middleware(writeDataHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "data/delete"), Middleware(deleteDataHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "data/seed"), Middleware(seedDataHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "client/configure/primary"), Middleware(configureClientHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "client/configure/secondary"), Middleware(configureClientHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "client/reconnect/primary"), Middleware(reconnectClientHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "client/reconnect/secondary"), Middleware(reconnectClientHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "client/connect/primary"), Middleware(connectClientHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "client/connect/secondary"), Middleware(connectClientHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "client/disconnect/primary"), Middleware(disconnectClientHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "client/disconnect/secondary"), Middleware(disconnectClientHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "operation/"), Middleware(operationHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "workflow"), Middleware(workflowHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "close"), Middleware(closeHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "query"), Middleware(queryHandler))
-	http.Handle(fmt.Sprintf("%s/%s", a.BasePath, "metrics"), Middleware(metricsHandler))
-}
-
-func (a *APIServer) newLog() {
-	if a.currentLog != nil {
-		a.Logger.WriteLog(a.currentLog)
-	}
-
-	a.currentLog = NewLog(a.loglvl, "api_log")
-}
-
-func (a *APIServer) AddOperationSet(dbo *DBOperationSet) {
+	rt := NewRouter()
+	rt.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, ErrCodeNotFound, fmt.Sprintf("No route for %s", r.URL.Path), nil)
+	})
+	rt.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, fmt.Sprintf("%s is not allowed, use %s", r.Method, w.Header().Get("Allow")), nil)
+	})
+
+	for _, route := range a.routes() {
+		a.handle(rt, route)
+	}
+
+	a.mu.Lock()
+	a.router = rt
+	a.mu.Unlock()
+}
+
+// Handler returns the server's routes wrapped in Middleware, setting them up
+// first if needed. It is what Init serves, and can be passed to
+// httptest.NewServer.
+func (a *APIServer) Handler() http.Handler {
+	a.mu.Lock()
+	rt := a.router
+	a.mu.Unlock()
+
+	if rt == nil {
+		a.SetupRoutes()
+		a.mu.Lock()
+		rt = a.router
+		a.mu.Unlock()
+	}
+
+	return Middleware(rt)
+}
+
+// limitBody stops handlers reading more than MaxBodyBytes of a request body.
+func (a *APIServer) limitBody(next http.Handler) http.Handler {
+	if a.MaxBodyBytes <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > a.MaxBodyBytes {
+			writeError(w, http.StatusRequestEntityTooLarge, ErrCodeBodyTooLarge, fmt.Sprintf("Request body too large, the limit is %d bytes", a.MaxBodyBytes), nil)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, a.MaxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientTarget responds 404 unless the {target} path parameter is primary
+// or secondary.
+func clientTarget(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch PathParam(r, "target") {
+		case "primary", "secondary":
+			f(w, r)
+		default:
+			writeError(w, http.StatusNotFound, ErrCodeNotFound, fmt.Sprintf("Unknown client %q, must be primary or secondary", PathParam(r, "target")), nil)
+		}
+	}
+}
+
+// handle registers route under BasePath. Its path names it in metrics, spans
+// and auth.
+func (a *APIServer) handle(rt *Router, route *apiRoute) {
+	var h http.Handler = route.handler
+	if route.request != "" {
+		h = validateBody(route.request, h)
+	}
+	if route.idempotent {
+		h = a.idempotent(route.path, h)
+	}
+	h = a.limitBody(h)
+	h = a.instrument(route.path, h)
+	for _, m := range route.methods {
+		rt.Handle(m, fmt.Sprintf("%s/%s", a.BasePath, route.path), h)
+	}
+}
+
+func (a *APIServer) findPrometheusOutput() *PrometheusOutput {
+	for _, o := range a.Logger.metricOutputs() {
+		if p, ok := o.(*PrometheusOutput); ok {
+			return p
+		}
+	}
+	return nil
+}
+
+func (a *APIServer) findPullOutput() *PullOutput {
+	for _, o := range a.Logger.logOutputs() {
+		if p, ok := o.(*PullOutput); ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// AddOperationSet queues dbo to be run. It returns errQueueFull rather than
+// waiting if the queue has no room, and errShuttingDown once Shutdown has
+// been called. The send happens under a.mu so that it can't race with the
+// queue being closed after Shutdown.
+func (a *APIServer) AddOperationSet(dbo *DBOperationSet) error {
+	l := a.log.With(Fields{FieldOperationSetID: dbo.ID})
+
+	a.mu.Lock()
+	if a.stopped {
+		a.mu.Unlock()
+		l.Warnf("Shutting down, not queueing %d operations", len(dbo.Operations))
+		return errShuttingDown
+	}
+	if a.lookupOperationSet == nil {
+		a.lookupOperationSet = map[string]*DBOperationSet{}
+	}
 	a.lookupOperationSet[dbo.ID] = dbo
-	a.Operations <- dbo
+
+	l.Debugf("Queueing %d operations", len(dbo.Operations))
+	a.progress.Publish(setEvent(ProgressQueued, dbo))
+
+	queued := true
+	select {
+	case a.Operations <- dbo:
+	default:
+		delete(a.lookupOperationSet, dbo.ID)
+		queued = false
+	}
+	a.mu.Unlock()
+
+	if !queued {
+		l.Warnf("Operation queue is full, dropping %d operations", len(dbo.Operations))
+		e := setEvent(ProgressFinished, dbo)
+		e.Failed = true
+		e.Errors = []string{errQueueFull.Error()}
+		a.progress.Publish(e)
+		return errQueueFull
+	}
+
+	a.Idempotency.record(dbo.Context(), dbo.ID)
+	return nil
+}
+
+// client returns the client named by target, primary if it is empty.
+func (a *APIServer) client(target string) (DBClient, error) {
+	switch target {
+	case "primary", "":
+		return a.primary, nil
+	case "secondary":
+		return a.secondary, nil
+	}
+	return nil, fmt.Errorf("Unknown client %q, must be primary or secondary", target)
+}
+
+// buildWorkflow turns w into an operation set carrying ctx, ready to queue.
+// A workflow with a Name but no Steps runs the configured workflow of that
+// name. Otherwise the data files named by its steps must be relative paths
+// under DataDir; failures to read them are logged rather than returned, so
+// callers learn nothing about other files on the server.
+func (a *APIServer) buildWorkflow(ctx context.Context, w *Workflow) (*DBOperationSet, error) {
+	if w.Name == "" {
+		return nil, errors.New("rpt: workflow Name is required")
+	}
+
+	if len(w.Steps) == 0 {
+		configured := a.workflow(w.Name)
+		if configured == nil {
+			return nil, fmt.Errorf("rpt: workflow %s has no steps and is not configured", w.Name)
+		}
+		w = configured
+	} else {
+		resolved := &Workflow{Name: w.Name, Steps: make([]*WorkflowStep, len(w.Steps))}
+		for i, s := range w.Steps {
+			step := *s
+			if step.DataFile != "" {
+				path, err := a.dataFile(step.DataFile)
+				if err != nil {
+					return nil, fmt.Errorf("rpt: workflow %s step %d: %s", w.Name, i, err)
+				}
+				if _, errs := ImportDBDataSet(path); len(errs) > 0 {
+					a.log.Warnf("Unable to read data file %s of workflow %s: %s", path, w.Name, errs[0])
+					return nil, fmt.Errorf("rpt: workflow %s step %d: unable to read data file %q", w.Name, i, s.DataFile)
+				}
+				step.DataFile = path
+			}
+			resolved.Steps[i] = &step
+		}
+		w = resolved
+	}
+
+	ops, err := w.Build(a.primary, a.secondary)
+	if err != nil {
+		return nil, err
+	}
+	ops.ctx = ctx
+	return ops, nil
+}
+
+// workflow returns the configured workflow called name, or nil.
+func (a *APIServer) workflow(name string) *Workflow {
+	for _, w := range a.Workflows {
+		if w.Name == name {
+			return w
+		}
+	}
+	return nil
+}
+
+// dataFile resolves name under DataDir. It must be a relative path that
+// stays inside it.
+func (a *APIServer) dataFile(name string) (string, error) {
+	if a.DataDir == "" {
+		return "", errors.New("data files are not allowed, the API has no data directory")
+	}
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid data file %q, must be a relative path in the data directory", name)
+	}
+	return filepath.Join(a.DataDir, clean), nil
 }
 
 func (a *APIServer) clearLookupOperationSet() {
+	a.mu.Lock()
 	a.lookupOperationSet = make(map[string]*DBOperationSet)
+	a.mu.Unlock()
 }
 
 func (a *APIServer) LookupOperationSet(guid string) *DBOperationSet {
 
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	if val, ok := a.lookupOperationSet[guid]; ok {
 		return val
 	}
@@ -125,318 +449,795 @@ func Middleware(handler http.Handler) http.Handler {
 	})
 }
 
+// instrument times every request to route and writes the request count and
+// duration to the metric outputs.
+func (a *APIServer) instrument(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		ctx := a.tracer.Extract(r.Context(), r.Header)
+		ctx, span := StartSpan(ctx, r.Method+" "+route, SpanKindServer)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.target", r.URL.RequestURI())
+		InjectTraceparent(ctx, w.Header())
+
+		r, ok := a.authorize(sr, r.WithContext(ctx), route)
+		if ok && a.allow(sr, r, route) {
+			handler.ServeHTTP(sr, r)
+		}
+
+		span.SetAttribute("http.status_code", sr.status)
+		if sr.status >= 500 {
+			span.SetError(errors.New(http.StatusText(sr.status)))
+		}
+		span.End()
+
+		labels := map[string]string{
+			"route":  route,
+			"method": r.Method,
+			"status": strconv.Itoa(sr.status),
+		}
+
+		mc, _ := NewMetricCollection()
+		mc.AddMetric(NewCounter("rpt_api_requests_total", labels).Inc())
+		mc.AddMetric(NewHistogram("rpt_api_request_duration_seconds", labels).ObserveDuration(time.Since(start)))
+		a.Logger.WriteMetric(mc)
+	})
+}
+
+// authorize checks the caller of r may use route, responding with 401 or 403
+// if not. The returned request carries the caller's Principal.
+func (a *APIServer) authorize(w http.ResponseWriter, r *http.Request, route string) (*http.Request, bool) {
+
+	// The dashboard page holds no data; its requests carry the token.
+	if a.Auth == nil || route == "health" || route == "dashboard" {
+		return r, true
+	}
+
+	p, err := a.Auth.Authenticate(r)
+	if err != nil || p == nil {
+		// Failed attempts count against the caller's IP address, so that
+		// credentials can't be guessed faster than the rate limit.
+		if !a.allow(w, r, route) {
+			return r, false
+		}
+		a.log.Warnf("Unauthenticated %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="rpt"`)
+		writeError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Authentication is required", nil)
+		return r, false
+	}
+
+	SpanFromContext(r.Context()).SetAttribute("enduser.id", p.Name)
+
+	if required := a.Auth.RequiredRole(route); !p.Role.Allows(required) {
+		a.log.Warnf("%s (%s) is not allowed to %s %s, which needs %s", p.Name, p.Role, r.Method, r.URL.Path, required)
+		writeError(w, http.StatusForbidden, ErrCodeForbidden, fmt.Sprintf("This route needs the %s role", required), nil)
+		return r, false
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p)), true
+}
+
+// allow applies the rate limit to the caller of r, responding with 429 if
+// they are over it.
+func (a *APIServer) allow(w http.ResponseWriter, r *http.Request, route string) bool {
+
+	if a.RateLimiter == nil || route == "health" {
+		return true
+	}
+
+	client := rateLimitClient(r)
+	ok, retryAfter := a.RateLimiter.Allow(client)
+	if !ok {
+		a.log.Warnf("Rate limited %s %s from %s", r.Method, r.URL.Path, client)
+		w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+		writeError(w, http.StatusTooManyRequests, ErrCodeRateLimited, "Too many requests, try again later", nil)
+	}
+
+	return ok
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streaming handlers flush through the recorder.
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // HANDLERS - BASE
 
 func (a *APIServer) HandleHealth(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("handleTest().")
-	switch r.Method {
-	case http.MethodGet:
-		_, err := w.Write([]byte("ok."))
-		if err != nil {
-			fmt.Println(err)
-		}
+	a.log.Debugf("HandleHealth %s %s", r.Method, r.URL.Path)
+	_, err := w.Write([]byte("ok."))
+	if err != nil {
+		a.log.Errorf("Unable to write response: %s", err)
+	}
+}
 
-	case http.MethodOptions:
+func (a *APIServer) HandleClose(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleClose %s %s", r.Method, r.URL.Path)
+	// The RptClient shuts the server down, drains the queue and exits.
+	if !a.requestState(r.Context(), newInternalState(EventProcessThenStop)) {
+		writeError(w, http.StatusServiceUnavailable, ErrCodeShuttingDown, "rpt is already shutting down", nil)
 		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
+	w.WriteHeader(http.StatusAccepted)
 }
 
-func (a *APIServer) HandleClose(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("handleClose().")
-	switch r.Method {
-	case http.MethodGet:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	case http.MethodPost:
-		go func() {
-			time.Sleep(3 * time.Second)
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
-			if err := a.Server.Shutdown(ctx); err != nil {
-				a.Server.Close()
-			}
+func (a *APIServer) HandleState(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleState %s %s", r.Method, r.URL.Path)
+	output := &map[string]interface{}{
+		"State":   a.lifecycle.Current(),
+		"History": a.lifecycle.History(),
+	}
 
-			close(a.Operations)
-			a.state <- newInternalState("process_then_stop")
+	_, err := w.Write(ToJSON(output))
+	if err != nil {
+		a.log.Errorf("Unable to write response: %s", err)
+	}
+}
 
-			time.Sleep(10 * time.Second)
-			a.state <- newInternalState("processing_complete")
-		}()
+// HandleQuery queues the query against the primary, or the client named by
+// ?target, and answers 202 with the operation set ID. With ?wait=true it holds
+// the request until the set finishes and answers 200 with its output, as
+// GET /operation/{id} would. If the set is still running after ?timeout (a
+// duration, 30s by default) the answer is the usual 202, so the result can be
+// fetched later:
+//
+//	POST /query?wait=true&timeout=5s
+func (a *APIServer) HandleQuery(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleQuery %s %s", r.Method, r.URL.Path)
 
+	wait, err := queryWait(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error(), nil)
 		return
-	case http.MethodOptions:
+	}
+
+	client, err := a.client(r.URL.Query().Get("target"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error(), map[string]string{"field": "target"})
 		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
-}
 
-func (a *APIServer) HandleQuery(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("handleQuery().")
-	switch r.Method {
-	case http.MethodGet:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	case http.MethodPost:
-		if !verifyContentType(r, "application/json") {
-			msg := "Content-Type header is not application/json"
-			http.Error(w, msg, http.StatusUnsupportedMediaType)
-			return
-		}
+	q := &DBQueryDataSet{}
+	if !readJSONBody(w, r, q) {
+		return
+	}
+	if strings.TrimSpace(q.Query) == "" {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Query is required", map[string]string{"field": "Query"})
+		return
+	}
 
-		q := &DBQueryDataSet{}
-
-		errString := getRequestBody(r, q)
-		if len(errString) > 0 {
-			switch errString {
-			case "default":
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			case "Request body too large":
-				http.Error(w, errString, http.StatusRequestEntityTooLarge)
-			default:
-				http.Error(w, errString, http.StatusBadRequest)
-			}
-		}
-		op := Query(a.primary, q)
-		ops := newDBOperationSet(nil)
-		ops.AddOperation(op)
-		a.AddOperationSet(ops)
+	op := Query(client, q)
+	ops := newDBOperationSet(r.Context())
+	ops.AddOperation(op)
 
+	if !a.enqueue(w, ops) {
 		return
-	case http.MethodOptions:
+	}
+
+	if wait == 0 || !waitFinished(r.Context(), ops, wait) {
+		a.writeAccepted(w, ops)
 		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
+
+	a.writeResult(w, ops)
 }
 
+// queryWait returns how long a request asks to wait for its result, or 0 if
+// it doesn't.
+func queryWait(r *http.Request) (time.Duration, error) {
+
+	q := r.URL.Query()
+
+	if q.Get("wait") == "" {
+		return 0, nil
+	}
+	wait, err := strconv.ParseBool(q.Get("wait"))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid wait %q, must be true or false", q.Get("wait"))
+	}
+	if !wait {
+		return 0, nil
+	}
+
+	if q.Get("timeout") == "" {
+		return defaultQueryWait, nil
+	}
+	d, err := time.ParseDuration(q.Get("timeout"))
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Invalid timeout %q, must be a positive duration such as 5s", q.Get("timeout"))
+	}
+	if d > maxQueryWait {
+		d = maxQueryWait
+	}
+
+	return d, nil
+}
+
+// waitFinished reports whether ops finishes within timeout. It gives up early
+// if ctx is done.
+func waitFinished(ctx context.Context, ops *DBOperationSet, timeout time.Duration) bool {
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ops.Done():
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// HandleWorkflow lists the configured workflows. Any of them can be sent back
+// to POST /workflow/run to queue it again.
 func (a *APIServer) HandleWorkflow(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("handleTest().")
-	switch r.Method {
-	case http.MethodGet:
-		_, err := w.Write(ToJSON(a))
-		if err != nil {
-			fmt.Println(err)
-		}
+	a.log.Debugf("HandleWorkflow %s %s", r.Method, r.URL.Path)
+
+	workflows := a.Workflows
+	if workflows == nil {
+		workflows = []*Workflow{}
+	}
 
-	case http.MethodOptions:
+	_, err := w.Write(ToJSON(map[string]interface{}{"Workflows": workflows}))
+	if err != nil {
+		a.log.Errorf("Unable to write response: %s", err)
+	}
+}
+
+// HandleRunWorkflow queues the steps of the workflow in the body as one
+// operation set, or the configured workflow named in a body without steps.
+// Data files named by the steps are read from the server's DataDir.
+func (a *APIServer) HandleRunWorkflow(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleRunWorkflow %s %s", r.Method, r.URL.Path)
+
+	wf := &Workflow{}
+	if !readJSONBody(w, r, wf) {
+		return
+	}
+
+	ops, err := a.buildWorkflow(r.Context(), wf)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error(), nil)
 		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
+	if !a.enqueue(w, ops) {
+		return
+	}
+
+	a.writeAccepted(w, ops)
 }
 
 func (a *APIServer) HandleOperation(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("handleOperation().")
+	a.log.Debugf("HandleOperation %s %s", r.Method, r.URL.Path)
 
-	urlPathSegments := strings.Split(r.URL.Path, fmt.Sprintf("%s/", "operation"))
-	if len(urlPathSegments[1:]) > 1 {
-		w.WriteHeader(http.StatusBadRequest)
+	id := PathParam(r, "id")
+	out := a.findOperation(id)
+	if out == nil {
+		writeError(w, http.StatusNotFound, ErrCodeNotFound, fmt.Sprintf("No operation or operation set with ID %s", id), nil)
 		return
 	}
-	opID := urlPathSegments[len(urlPathSegments)-1]
 
-	switch r.Method {
-	case http.MethodGet:
-		_, err := w.Write(a.findOperation(opID))
-		if err != nil {
-			fmt.Println(err)
+	_, err := w.Write(out)
+	if err != nil {
+		a.log.Errorf("Unable to write response: %s", err)
+	}
+}
+
+// HandleOperations lists the operation sets still held for GET
+// /operation/{id}, newest first. ?workflow keeps the sets of one workflow and
+// ?limit caps how many are listed.
+func (a *APIServer) HandleOperations(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleOperations %s %s", r.Method, r.URL.Path)
+
+	limit := defaultOperationsLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("Invalid limit %q, must be a positive number", s), map[string]string{"field": "limit"})
+			return
 		}
+		limit = n
+	}
+	if limit > maxOperationsLimit {
+		limit = maxOperationsLimit
+	}
 
-	case http.MethodOptions:
-		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	workflow := r.URL.Query().Get("workflow")
+
+	a.mu.Lock()
+	sets := make([]*DBOperationSet, 0, len(a.lookupOperationSet))
+	for _, ops := range a.lookupOperationSet {
+		if workflow == "" || ops.Workflow == workflow {
+			sets = append(sets, ops)
+		}
+	}
+	a.mu.Unlock()
+
+	sort.Slice(sets, func(i, j int) bool {
+		return sets[i].Created().After(sets[j].Created())
+	})
+	if len(sets) > limit {
+		sets = sets[:limit]
+	}
+
+	list := make([]*OperationSetInfo, 0, len(sets))
+	for _, ops := range sets {
+		list = append(list, newOperationSetInfo(ops))
+	}
+
+	_, err := w.Write(ToJSON(map[string]interface{}{"OperationSets": list}))
+	if err != nil {
+		a.log.Errorf("Unable to write response: %s", err)
 	}
 }
 
 func (a *APIServer) HandleMetrics(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("handleMetrics().")
+	a.log.Debugf("HandleMetrics %s %s", r.Method, r.URL.Path)
 
-	switch r.Method {
-	case http.MethodGet:
-		for _, o := range a.Logger.MetricOutputs {
-			if o.GetDescription() == "pull_output" {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
 
-				fmt.Println("foundMetricOutput.")
+	p := a.findPrometheusOutput()
+	if p == nil {
+		return
+	}
 
-				_, err := w.Write(ToJSON(o.pullMetrics()))
-				if err != nil {
-					fmt.Println(err)
-				}
-			}
-		}
+	_, err := p.WriteTo(w)
+	if err != nil {
+		a.log.Errorf("Unable to write response: %s", err)
+	}
+}
+
+// HANDLERS - LOGS
 
-	case http.MethodOptions:
+/*
+
+GET /logs returns the cached log events, oldest first. GET /logs/stream sends
+each new log event as a Server-Sent Event until the client disconnects.
+
+Both accept the same filters:
+
+	level=WARN           WARN and above
+	since=<time>         RFC 3339 time, or a duration such as 5m for "5m ago"
+	until=<time>         as since
+	operation_id=<id>    an operation or operation set ID
+
+*/
+
+func (a *APIServer) HandleLogs(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleLogs %s %s", r.Method, r.URL.Path)
+	f, err := parseLogFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error(), nil)
 		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+
+	logs := []*LogEntry{}
+	if p := a.findPullOutput(); p != nil {
+		logs = p.Logs(f)
+	}
+
+	output := &map[string]interface{}{
+		"Logs": logs,
+	}
+
+	_, err = w.Write(ToJSON(output))
+	if err != nil {
+		a.log.Errorf("Unable to write response: %s", err)
 	}
 }
 
-// HANDLERS - DATA
+func (a *APIServer) HandleLogStream(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleLogStream %s %s", r.Method, r.URL.Path)
+	f, err := parseLogFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error(), nil)
+		return
+	}
 
-func (a *APIServer) HandleSeedData(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("HandleSeedData()")
-	switch r.Method {
-	case http.MethodGet:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	case http.MethodPost:
-		if !verifyContentType(r, "application/json") {
-			msg := "Content-Type header is not application/json"
-			http.Error(w, msg, http.StatusUnsupportedMediaType)
-			return
-		}
+	flusher, ok := w.(http.Flusher)
+	p := a.findPullOutput()
+	if !ok || p == nil {
+		writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Streaming is not supported", nil)
+		return
+	}
+
+	events, unsubscribe := p.Subscribe(100)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
 
-		ds := &DBDataSet{}
-		errString := getRequestBody(r, ds)
-		if len(errString) > 0 {
-			switch errString {
-			case "default":
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			case "Request body too large":
-				http.Error(w, errString, http.StatusRequestEntityTooLarge)
-			default:
-				http.Error(w, errString, http.StatusBadRequest)
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-a.closing:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if !f.Match(e.LogEvent) {
+				continue
 			}
+			out, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: log\ndata: %s\n\n", out)
 		}
-		op := SeedData(a.primary, ds)
-		ops := newDBOperationSet(nil)
-		ops.Operations = append(ops.Operations, op)
-		a.Operations <- ops
+		flusher.Flush()
+	}
+}
 
-	case http.MethodOptions:
-		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+func parseLogFilter(r *http.Request) (*LogFilter, error) {
+
+	q := r.URL.Query()
+	f := &LogFilter{
+		Level:       strings.ToUpper(q.Get("level")),
+		OperationID: q.Get("operation_id"),
+	}
+
+	if _, ok := logLevels[f.Level]; f.Level != "" && !ok {
+		return nil, fmt.Errorf("level %q must be one of DEBUG, INFO, WARN, ERROR", f.Level)
+	}
+
+	var err error
+	if f.Since, err = parseLogTime(q.Get("since")); err != nil {
+		return nil, fmt.Errorf("since: %s", err)
 	}
+	if f.Until, err = parseLogTime(q.Get("until")); err != nil {
+		return nil, fmt.Errorf("until: %s", err)
+	}
+
+	return f, nil
 }
 
-func (a *APIServer) HandleWriteData(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("handleTest().")
-	switch r.Method {
-	case http.MethodGet:
-		_, err := w.Write(ToJSON(a))
-		if err != nil {
-			fmt.Println(err)
-		}
-	case http.MethodPost:
-		// do stuff.
+// parseLogTime accepts an RFC 3339 time or a duration before now.
+func parseLogTime(s string) (time.Time, error) {
 
-	case http.MethodOptions:
-		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	if s == "" {
+		return time.Time{}, nil
 	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not an RFC 3339 time or a duration", s)
+	}
+
+	return t, nil
 }
 
-func (a *APIServer) HandleReadData(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("handleTest().")
-	switch r.Method {
-	case http.MethodGet:
-		_, err := w.Write(ToJSON(a))
-		if err != nil {
-			fmt.Println(err)
-		}
-	case http.MethodPost:
-		// do stuff.
+// HANDLERS - PROGRESS
+
+/*
+
+GET /operations/stream sends the progress of every operation set as
+Server-Sent Events named after the event type, until the client disconnects:
+
+	event: step_completed
+	data: {"Type":"step_completed","SetID":"...","Step":1,"Steps":3,...}
+
+Filters:
+
+	id=<id>              an operation or operation set ID
+	workflow=<name>      sets built from the named workflow
 
-	case http.MethodOptions:
+*/
+
+func (a *APIServer) HandleOperationStream(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleOperationStream %s %s", r.Method, r.URL.Path)
+	f := &ProgressFilter{
+		ID:       r.URL.Query().Get("id"),
+		Workflow: r.URL.Query().Get("workflow"),
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok || a.progress == nil {
+		writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Streaming is not supported", nil)
 		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
-}
 
-func (a *APIServer) HandleDeleteData(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("handleTest().")
-	switch r.Method {
-	case http.MethodGet:
-		_, err := w.Write(ToJSON(a))
-		if err != nil {
-			fmt.Println(err)
+	events, unsubscribe := a.progress.Subscribe(100)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-a.closing:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if !f.Match(e) {
+				continue
+			}
+			out, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, out)
 		}
-	case http.MethodPost:
-		// do stuff.
+		flusher.Flush()
+	}
+}
+
+// HANDLERS - DATA
+
+func (a *APIServer) HandleSeedData(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleSeedData %s %s", r.Method, r.URL.Path)
 
-	case http.MethodOptions:
+	ds := &DBDataSet{}
+	if !readJSONBody(w, r, ds) {
+		return
+	}
+	if strings.TrimSpace(ds.Name) == "" {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Name is required", map[string]string{"field": "Name"})
 		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
+
+	op := SeedData(a.primary, ds)
+	ops := newDBOperationSet(r.Context())
+	ops.AddOperation(op)
+	if !a.enqueue(w, ops) {
+		return
+	}
+
+	a.writeAccepted(w, ops)
+}
+
+// The data routes below answer 501 until the clients can read, write and
+// delete data.
+
+func (a *APIServer) HandleWriteData(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleWriteData %s %s", r.Method, r.URL.Path)
+	writeError(w, http.StatusNotImplemented, ErrCodeNotImplemented, "Writing data is not supported yet", nil)
+}
+
+func (a *APIServer) HandleReadData(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleReadData %s %s", r.Method, r.URL.Path)
+	writeError(w, http.StatusNotImplemented, ErrCodeNotImplemented, "Reading data is not supported yet", nil)
+}
+
+func (a *APIServer) HandleDeleteData(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleDeleteData %s %s", r.Method, r.URL.Path)
+	writeError(w, http.StatusNotImplemented, ErrCodeNotImplemented, "Deleting data is not supported yet", nil)
 }
 
 // HANDLERS - CLIENT
 
 func (a *APIServer) HandleConfigureClient(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("handleTest().")
-	switch r.Method {
-	case http.MethodGet:
-		_, err := w.Write(ToJSON(a))
-		if err != nil {
-			fmt.Println(err)
-		}
-	case http.MethodPost:
-		// do stuff.
+	a.log.Debugf("HandleConfigureClient %s %s", r.Method, r.URL.Path)
+	writeError(w, http.StatusNotImplemented, ErrCodeNotImplemented, "Configuring clients is not supported yet", nil)
+}
 
-	case http.MethodOptions:
+func (a *APIServer) HandleConnectClient(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleConnectClient %s %s", r.Method, r.URL.Path)
+	a.queueClientAction(w, r, "connect")
+}
+
+func (a *APIServer) HandleDisconnectClient(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleDisconnectClient %s %s", r.Method, r.URL.Path)
+	a.queueClientAction(w, r, "disconnect")
+}
+
+func (a *APIServer) HandleReconnectClient(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleReconnectClient %s %s", r.Method, r.URL.Path)
+	a.queueClientAction(w, r, "reconnect")
+}
+
+// queueClientAction queues action against the client named by the {target}
+// path parameter, as the gRPC ClientAction call does.
+func (a *APIServer) queueClientAction(w http.ResponseWriter, r *http.Request, action string) {
+	target := PathParam(r, "target")
+	c, err := a.client(target)
+	if err != nil {
+		writeError(w, http.StatusNotFound, ErrCodeNotFound, err.Error(), nil)
 		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
-}
 
-func (a *APIServer) HandleConnectClient(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("handleTest().")
-	switch r.Method {
-	case http.MethodGet:
-		_, err := w.Write(ToJSON(a))
-		if err != nil {
-			fmt.Println(err)
-		}
-	case http.MethodPost:
-		// do stuff.
+	op := clientAction(action, c)
+	op.SetLabel("client", target)
 
-	case http.MethodOptions:
+	ops := newDBOperationSet(r.Context())
+	ops.AddOperation(op)
+	if !a.enqueue(w, ops) {
 		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
+
+	a.writeAccepted(w, ops)
 }
 
-func (a *APIServer) HandleDisconnectClient(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("handleTest().")
-	switch r.Method {
-	case http.MethodGet:
-		_, err := w.Write(ToJSON(a))
-		if err != nil {
-			fmt.Println(err)
+// clientAction returns the operation that carries out action on c, or nil
+// unless action is connect, disconnect or reconnect.
+func clientAction(action string, c DBClient) *DBOperation {
+	switch action {
+	case "connect":
+		return ConnectClient(c)
+	case "disconnect":
+		return DisconnectClient(c)
+	case "reconnect":
+		return ReconnectClient(c)
+	}
+	return nil
+}
+
+// ERRORS
+
+/*
+
+Every error response has the same body:
+
+	{"code": "invalid_request", "message": "Query is required", "details": {"field": "Query"}}
+
+code is one of the ErrCode constants and is stable; message is for people
+and may change. details is only present where there is something to add.
+
+*/
+
+const (
+	ErrCodeInvalidRequest       = "invalid_request"
+	ErrCodeInvalidBody          = "invalid_body"
+	ErrCodeBodyTooLarge         = "body_too_large"
+	ErrCodeUnsupportedMediaType = "unsupported_media_type"
+	ErrCodeUnauthorized         = "unauthorized"
+	ErrCodeForbidden            = "forbidden"
+	ErrCodeNotFound             = "not_found"
+	ErrCodeMethodNotAllowed     = "method_not_allowed"
+	ErrCodeIdempotencyConflict  = "idempotency_conflict"
+	ErrCodeIdempotencyKeyReused = "idempotency_key_reused"
+	ErrCodeRateLimited          = "rate_limited"
+	ErrCodeQueueFull            = "queue_full"
+	ErrCodeShuttingDown         = "shutting_down"
+	ErrCodeNotImplemented       = "not_implemented"
+	ErrCodeInternal             = "internal"
+)
+
+type APIError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string, details interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write(ToJSON(&APIError{Code: code, Message: message, Details: details}))
+}
+
+// OperationSetInfo describes an operation set in GET /operations. The
+// output of the set and its operations is at GET /operation/{id}.
+type OperationSetInfo struct {
+	ID         string
+	Workflow   string
+	Created    time.Time
+	Done       bool // every operation has run
+	Failed     bool
+	Operations []*OperationInfo
+}
+
+type OperationInfo struct {
+	ID       string
+	Name     string
+	Done     bool
+	Failed   bool
+	Duration float64 // seconds, once done
+}
+
+func newOperationSetInfo(ops *DBOperationSet) *OperationSetInfo {
+	s := &OperationSetInfo{
+		ID:         ops.ID,
+		Workflow:   ops.Workflow,
+		Created:    ops.Created(),
+		Done:       true,
+		Operations: make([]*OperationInfo, 0, len(ops.Operations)),
+	}
+	for _, op := range ops.Operations {
+		o := &OperationInfo{
+			ID:     op.ID,
+			Name:   op.Name,
+			Done:   !op.Completed().IsZero(),
+			Failed: op.Failed(),
+		}
+		if o.Done {
+			o.Duration = op.Duration().Seconds()
 		}
-	case http.MethodPost:
-		// do stuff.
+		s.Done = s.Done && o.Done
+		s.Failed = s.Failed || o.Failed
+		s.Operations = append(s.Operations, o)
+	}
+	return s
+}
 
-	case http.MethodOptions:
-		return
+// Accepted is the response to a request that queued an operation set.
+type Accepted struct {
+	ID         string   // of the operation set
+	Operations []string // IDs of the operations in the set, in order
+}
+
+func newAccepted(ops *DBOperationSet) *Accepted {
+	ids := make([]string, 0, len(ops.Operations))
+	for _, op := range ops.Operations {
+		ids = append(ids, op.ID)
+	}
+	return &Accepted{ID: ops.ID, Operations: ids}
+}
+
+// enqueue adds ops to the operation queue, responding 503 and returning false
+// if it is full or rpt is shutting down.
+func (a *APIServer) enqueue(w http.ResponseWriter, ops *DBOperationSet) bool {
+	switch err := a.AddOperationSet(ops); err {
+	case nil:
+		return true
+	case errShuttingDown:
+		writeError(w, http.StatusServiceUnavailable, ErrCodeShuttingDown, "rpt is shutting down", nil)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Header().Set("Retry-After", retryAfterSeconds(queueFullRetryAfter))
+		writeError(w, http.StatusServiceUnavailable, ErrCodeQueueFull, "The operation queue is full, try again later", nil)
 	}
+	return false
 }
 
-func (a *APIServer) HandleReconnectClient(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("handleTest().")
-	switch r.Method {
-	case http.MethodGet:
-		_, err := w.Write(ToJSON(a))
-		if err != nil {
-			fmt.Println(err)
-		}
-	case http.MethodPost:
-		// do stuff.
+// writeAccepted responds 202 with the ID of a queued operation set and a
+// Location header pointing at its status.
+func (a *APIServer) writeAccepted(w http.ResponseWriter, ops *DBOperationSet) {
+	output := newAccepted(ops)
+	w.Header().Set("Location", fmt.Sprintf("%s/operation/%s", a.BasePath, ops.ID))
+	w.WriteHeader(http.StatusAccepted)
+	_, err := w.Write(ToJSON(output))
+	if err != nil {
+		a.log.Errorf("Unable to write response: %s", err)
+	}
+}
 
-	case http.MethodOptions:
-		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+// writeResult responds 200 with the output of a finished operation set, as
+// GET /operation/{id} would.
+func (a *APIServer) writeResult(w http.ResponseWriter, ops *DBOperationSet) {
+	w.Header().Set("Location", fmt.Sprintf("%s/operation/%s", a.BasePath, ops.ID))
+	_, err := w.Write(ops.GetOutputJSON())
+	if err != nil {
+		a.log.Errorf("Unable to write response: %s", err)
 	}
 }
 
@@ -465,11 +1266,44 @@ func interpretHttpError(err error) string {
 	}
 }
 
+// readJSONBody decodes a single JSON object from the body of r into output,
+// writing an error response and returning false if it can't.
+func readJSONBody(w http.ResponseWriter, r *http.Request, output interface{}) bool {
+
+	if !verifyContentType(r, "application/json") {
+		writeError(w, http.StatusUnsupportedMediaType, ErrCodeUnsupportedMediaType, "Content-Type header is not application/json", nil)
+		return false
+	}
+
+	errString := getRequestBody(r, output)
+	switch errString {
+	case "":
+		return true
+	case "default":
+		writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Unable to read the request body", nil)
+	case "Request body too large":
+		writeError(w, http.StatusRequestEntityTooLarge, ErrCodeBodyTooLarge, errString, nil)
+	default:
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidBody, errString, nil)
+	}
+
+	return false
+}
+
+// writeBodyError responds to a failure to read a request body.
+func writeBodyError(w http.ResponseWriter, err error) {
+	if interpretHttpError(err) == "Request body too large" {
+		writeError(w, http.StatusRequestEntityTooLarge, ErrCodeBodyTooLarge, "Request body too large", nil)
+		return
+	}
+	writeError(w, http.StatusBadRequest, ErrCodeInvalidBody, "Unable to read the request body", nil)
+}
+
 func getRequestBody(r *http.Request, output interface{}) string {
 
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
-	err := dec.Decode(&output)
+	err := dec.Decode(output)
 	if err != nil {
 		return interpretHttpError(err)
 	}
@@ -494,6 +1328,9 @@ func verifyContentType(r *http.Request, ct string) bool {
 
 func (a *APIServer) findOperation(ID string) []byte {
 
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	for i, opset := range a.lookupOperationSet {
 		if i == ID {
 			return opset.GetOutputJSON()
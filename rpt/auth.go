@@ -0,0 +1,200 @@
+package rpt
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+/*
+
+APIAuth authenticates every API request except /health, the /dashboard page
+and CORS preflight requests, and checks that the caller's role is allowed to
+use the route.
+
+Roles are ordered, each including the ones before it:
+
+	read     GET endpoints: state, metrics, logs, operations, workflows
+	write    /query, /data/* and running workflows
+	admin    /client/* and /close
+
+The role a route or route group needs can be raised or lowered through
+Roles, e.g. {"query": RoleAdmin} to keep arbitrary SQL to admins.
+
+Callers are identified by the Authenticators in order, the first to
+recognise the request wins. TokenAuthenticator reads a bearer token from the
+Authorization header; CertAuthenticator maps the subject of a verified client
+certificate, which needs the API to be served over TLS with client
+certificate verification.
+
+*/
+
+type Role string
+
+const (
+	RoleRead  Role = "read"
+	RoleWrite Role = "write"
+	RoleAdmin Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	RoleRead:  1,
+	RoleWrite: 2,
+	RoleAdmin: 3,
+}
+
+// Allows reports whether r includes required.
+func (r Role) Allows(required Role) bool {
+	return roleRanks[r] >= roleRanks[required]
+}
+
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// defaultRouteRoles is the role each route or route group needs; anything
+// not listed needs RoleRead.
+var defaultRouteRoles = map[string]Role{
+	"query":        RoleWrite,
+	"data":         RoleWrite,
+	"workflow/run": RoleWrite,
+	"client":       RoleAdmin,
+	"close":        RoleAdmin,
+}
+
+// Principal is an authenticated caller.
+type Principal struct {
+	Name string
+	Role Role
+}
+
+type principalContextKey struct{}
+
+// PrincipalFromContext returns the caller of the request, or nil if the API
+// does not use authentication.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalContextKey{}).(*Principal)
+	return p
+}
+
+// Authenticator identifies the caller of a request. It returns nil if the
+// request carries none of the credentials it understands, and an error if
+// it carries credentials that are not valid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+type APIAuth struct {
+	Authenticators []Authenticator
+	Roles          map[string]Role // route group: required role
+}
+
+func NewAPIAuth(authenticators ...Authenticator) *APIAuth {
+	return &APIAuth{
+		Authenticators: authenticators,
+		Roles:          map[string]Role{},
+	}
+}
+
+// RequiredRole returns the role needed for route, e.g. "data/read". Roles
+// set in Roles win over the defaults, and within each a role for the whole
+// route wins over one for its group.
+func (aa *APIAuth) RequiredRole(route string) Role {
+	group := strings.SplitN(route, "/", 2)[0]
+	for _, roles := range []map[string]Role{aa.Roles, defaultRouteRoles} {
+		if r, ok := roles[route]; ok {
+			return r
+		}
+		if r, ok := roles[group]; ok {
+			return r
+		}
+	}
+	return RoleRead
+}
+
+// Authenticate returns the caller of r, or nil if no Authenticator
+// recognises it.
+func (aa *APIAuth) Authenticate(r *http.Request) (*Principal, error) {
+	for _, a := range aa.Authenticators {
+		p, err := a.Authenticate(r)
+		if err != nil || p != nil {
+			return p, err
+		}
+	}
+	return nil, nil
+}
+
+// TOKENS
+
+type TokenAuthenticator struct {
+	tokens map[[sha256.Size]byte]*Principal
+}
+
+func NewTokenAuthenticator() *TokenAuthenticator {
+	return &TokenAuthenticator{
+		tokens: map[[sha256.Size]byte]*Principal{},
+	}
+}
+
+func (ta *TokenAuthenticator) AddToken(token, name string, role Role) {
+	ta.tokens[sha256.Sum256([]byte(token))] = &Principal{Name: name, Role: role}
+}
+
+func (ta *TokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(h, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return nil, errInvalidCredentials
+	}
+
+	// Tokens are looked up by hash so the comparison does not leak how much
+	// of a token matched.
+	sum := sha256.Sum256([]byte(strings.TrimSpace(parts[1])))
+	for k, p := range ta.tokens {
+		if subtle.ConstantTimeCompare(k[:], sum[:]) == 1 {
+			return p, nil
+		}
+	}
+
+	return nil, errInvalidCredentials
+}
+
+// CLIENT CERTIFICATES
+
+type CertAuthenticator struct {
+	subjects map[string]*Principal
+}
+
+func NewCertAuthenticator() *CertAuthenticator {
+	return &CertAuthenticator{
+		subjects: map[string]*Principal{},
+	}
+}
+
+// AddSubject gives role to client certificates with the common name cn.
+func (ca *CertAuthenticator) AddSubject(cn string, role Role) {
+	ca.subjects[cn] = &Principal{Name: cn, Role: role}
+}
+
+func (ca *CertAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+
+	// Only certificates the TLS server has verified count.
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+
+	// A certificate that is not listed gives no role, but the request may
+	// still carry a token.
+	return ca.subjects[r.TLS.VerifiedChains[0][0].Subject.CommonName], nil
+}
+
+var errInvalidCredentials = errors.New("rpt: invalid credentials")
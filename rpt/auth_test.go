@@ -0,0 +1,127 @@
+package rpt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequiredRole(t *testing.T) {
+
+	aa := NewAPIAuth()
+	aa.Roles["query"] = RoleAdmin
+	aa.Roles["workflow"] = RoleWrite
+
+	tests := []struct {
+		route string
+		want  Role
+	}{
+		{"state", RoleRead},
+		{"operation/{id}", RoleRead},
+		{"query", RoleAdmin},
+		{"data/seed", RoleWrite},
+		{"workflow", RoleWrite},
+		{"workflow/run", RoleWrite},
+		{"client/connect/{target}", RoleAdmin},
+		{"close", RoleAdmin},
+	}
+
+	for _, tt := range tests {
+		if got := aa.RequiredRole(tt.route); got != tt.want {
+			t.Errorf("RequiredRole(%q) = %q, want %q", tt.route, got, tt.want)
+		}
+	}
+
+	for _, r := range []Role{RoleRead, RoleWrite, RoleAdmin} {
+		if !r.Valid() || !r.Allows(r) || !RoleAdmin.Allows(r) || Role("").Allows(r) {
+			t.Errorf("role %q is not ordered between read and admin", r)
+		}
+	}
+	if RoleRead.Allows(RoleWrite) || RoleWrite.Allows(RoleAdmin) || Role("root").Valid() {
+		t.Error("roles allow more than they include")
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+
+	tokens := NewTokenAuthenticator()
+	tokens.AddToken("read-token", "dashboard", RoleRead)
+	tokens.AddToken("write-token", "ci", RoleWrite)
+	tokens.AddToken("admin-token", "ops", RoleAdmin)
+
+	certs := NewCertAuthenticator()
+	certs.AddSubject("replica-checker", RoleAdmin)
+
+	a := &APIServer{BasePath: "/api", Auth: NewAPIAuth(certs, tokens)}
+	h := a.Handler()
+
+	// verified is the TLS state of a request presenting a client certificate
+	// the server verified.
+	verified := func(cn string) *tls.ConnectionState {
+		return &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		auth   string
+		tls    *tls.ConnectionState
+		status int
+		code   string
+	}{
+		{"health needs no credentials", http.MethodGet, "/api/health", "", nil, http.StatusOK, ""},
+		{"no credentials", http.MethodGet, "/api/workflow", "", nil, http.StatusUnauthorized, ErrCodeUnauthorized},
+		{"unknown token", http.MethodGet, "/api/workflow", "Bearer guess", nil, http.StatusUnauthorized, ErrCodeUnauthorized},
+		{"not a bearer token", http.MethodGet, "/api/workflow", "Basic cnB0OnBhc3M=", nil, http.StatusUnauthorized, ErrCodeUnauthorized},
+		{"read", http.MethodGet, "/api/workflow", "Bearer read-token", nil, http.StatusOK, ""},
+		{"scheme is case insensitive", http.MethodGet, "/api/workflow", "bearer  read-token ", nil, http.StatusOK, ""},
+		{"read cannot write", http.MethodPost, "/api/query", "Bearer read-token", nil, http.StatusForbidden, ErrCodeForbidden},
+		{"write", http.MethodPost, "/api/query", "Bearer write-token", nil, http.StatusBadRequest, ErrCodeInvalidBody},
+		{"write cannot administer", http.MethodPost, "/api/client/configure/primary", "Bearer write-token", nil, http.StatusForbidden, ErrCodeForbidden},
+		{"admin", http.MethodPost, "/api/client/configure/primary", "Bearer admin-token", nil, http.StatusNotImplemented, ErrCodeNotImplemented},
+		{"client certificate", http.MethodPost, "/api/client/configure/primary", "", verified("replica-checker"), http.StatusNotImplemented, ErrCodeNotImplemented},
+		{"unlisted certificate", http.MethodGet, "/api/workflow", "", verified("stranger"), http.StatusUnauthorized, ErrCodeUnauthorized},
+		{"unlisted certificate with a token", http.MethodGet, "/api/workflow", "Bearer read-token", verified("stranger"), http.StatusOK, ""},
+		{"unverified certificate", http.MethodGet, "/api/workflow", "", &tls.ConnectionState{}, http.StatusUnauthorized, ErrCodeUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("{}"))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			req.TLS = tt.tls
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			challenge := w.Header().Get("WWW-Authenticate")
+			if (tt.status == http.StatusUnauthorized) != (challenge != "") {
+				t.Errorf("WWW-Authenticate = %q with status %d", challenge, w.Code)
+			}
+			if tt.code != "" {
+				e := &APIError{}
+				if err := json.Unmarshal(w.Body.Bytes(), e); err != nil {
+					t.Fatalf("error response %q is not JSON: %s", w.Body, err)
+				}
+				if e.Code != tt.code {
+					t.Errorf("error code = %q, want %q", e.Code, tt.code)
+				}
+			}
+		})
+	}
+}
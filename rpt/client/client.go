@@ -0,0 +1,256 @@
+// Package client calls the rpt HTTP API.
+//
+//	c := client.New("http://localhost:5000/api")
+//	c.Token = os.Getenv("RPT_API_TOKEN")
+//
+//	acc, err := c.Query(ctx, &rpt.DBQueryDataSet{Name: "count", Query: "SELECT count(*) FROM users"})
+//	...
+//	op, err := c.WaitForOperation(ctx, acc.ID)
+//
+// Requests that queue work return an rpt.Accepted straight away; the work
+// runs in the background and GetOperation or WaitForOperation fetch its
+// output. Wrap the context with WithIdempotencyKey so retries of the same
+// request don't queue it twice. Error responses are returned as *Error.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haylesnortal/rpt/rpt"
+)
+
+const defaultPollInterval = 500 * time.Millisecond
+
+type Client struct {
+	BaseURL      string // including the API base path, e.g. http://localhost:5000/api
+	Token        string // sent as a bearer token if set
+	HTTPClient   *http.Client
+	PollInterval time.Duration // how often WaitForOperation checks, 500ms if not set
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:      strings.TrimRight(baseURL, "/"),
+		HTTPClient:   http.DefaultClient,
+		PollInterval: defaultPollInterval,
+	}
+}
+
+// Error is an error response from the API.
+type Error struct {
+	StatusCode int
+	RetryAfter time.Duration // from the Retry-After header of 429 and 503 responses
+	rpt.APIError
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpt: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// OPERATIONS
+
+// Operation is the status of an operation set or of a single operation, as
+// returned by GET /operation/{id}. Operation sets have an ID and
+// Operations; single operations have the OperationResult fields.
+type Operation struct {
+	ID         string
+	Operations map[string]*OperationResult
+	OperationResult
+}
+
+type OperationResult struct {
+	Started   time.Time
+	Completed time.Time
+	Duration  string
+	Output    OperationOutput
+}
+
+type OperationOutput struct {
+	Result json.RawMessage
+	Errors []json.RawMessage
+}
+
+// Done reports whether the operation, or every operation in the set, has
+// run.
+func (o *Operation) Done() bool {
+	if o.ID == "" {
+		return !o.Completed.IsZero()
+	}
+	for _, r := range o.Operations {
+		if r.Completed.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed reports whether the operation, or any operation in the set, failed.
+func (o *Operation) Failed() bool {
+	if o.ID == "" {
+		return len(o.Output.Errors) > 0
+	}
+	for _, r := range o.Operations {
+		if len(r.Output.Errors) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// METHODS
+
+// Seed queues seeding the primary with ds.
+func (c *Client) Seed(ctx context.Context, ds *rpt.DBDataSet) (*rpt.Accepted, error) {
+	acc := &rpt.Accepted{}
+	return acc, c.do(ctx, http.MethodPost, "data/seed", ds, acc)
+}
+
+// Query queues q against the primary.
+func (c *Client) Query(ctx context.Context, q *rpt.DBQueryDataSet) (*rpt.Accepted, error) {
+	return c.QueryOn(ctx, "", q)
+}
+
+// QueryOn queues q against the client named target, such as "secondary", or
+// the primary if target is empty.
+func (c *Client) QueryOn(ctx context.Context, target string, q *rpt.DBQueryDataSet) (*rpt.Accepted, error) {
+	route := "query"
+	if target != "" {
+		route += "?target=" + url.QueryEscape(target)
+	}
+	acc := &rpt.Accepted{}
+	return acc, c.do(ctx, http.MethodPost, route, q, acc)
+}
+
+// RunWorkflow queues the steps of w as one operation set, or the workflow
+// configured on the rpt server as w.Name if w has no steps. Data files named
+// by the steps are relative to the server's data directory.
+func (c *Client) RunWorkflow(ctx context.Context, w *rpt.Workflow) (*rpt.Accepted, error) {
+	acc := &rpt.Accepted{}
+	return acc, c.do(ctx, http.MethodPost, "workflow/run", w, acc)
+}
+
+// GetOperation returns the status of the operation set or operation id.
+func (c *Client) GetOperation(ctx context.Context, id string) (*Operation, error) {
+	op := &Operation{}
+	return op, c.do(ctx, http.MethodGet, "operation/"+url.PathEscape(id), nil, op)
+}
+
+// WaitForOperation polls the operation set or operation id until it is done
+// or ctx expires.
+func (c *Client) WaitForOperation(ctx context.Context, id string) (*Operation, error) {
+
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		op, err := c.GetOperation(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if op.Done() {
+			return op, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return op, ctx.Err()
+		}
+	}
+}
+
+// Close asks rpt to process the operations already queued and then stop.
+func (c *Client) Close(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "close", nil, nil)
+}
+
+// IDEMPOTENCY
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey returns a context that sends key as the Idempotency-Key
+// of the requests made with it. A retry with the same key gets the original
+// operation set back instead of queueing a new one.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// INTERNAL
+
+// do sends in as the JSON body of a request to route and decodes the response
+// into out, if either is set.
+func (c *Client) do(ctx context.Context, method, route string, in, out interface{}) error {
+
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+"/"+route, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if key, ok := ctx.Value(idempotencyKey{}).(string); ok && key != "" {
+		req.Header.Set(rpt.IdempotencyKeyHeader, key)
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 400 {
+		e := &Error{StatusCode: resp.StatusCode}
+		if json.Unmarshal(b, &e.APIError) != nil || e.Code == "" {
+			e.Code = strings.ToLower(strings.ReplaceAll(http.StatusText(resp.StatusCode), " ", "_"))
+			e.Message = strings.TrimSpace(string(b))
+		}
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			e.RetryAfter = time.Duration(s) * time.Second
+		}
+		return e
+	}
+
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(b, out)
+}
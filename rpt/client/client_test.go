@@ -0,0 +1,300 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haylesnortal/rpt/rpt"
+)
+
+// request is what the stand-in API server saw of a request.
+type request struct {
+	method  string
+	path    string // escaped, with the query
+	auth    string
+	key     string
+	ctype   string
+	body    map[string]interface{}
+	hasBody bool
+}
+
+// apiServer stands in for the rpt HTTP API. reply writes the response to the
+// nth request, counting from 0; without it GETs get an empty operation set
+// and everything else 202 and an Accepted.
+type apiServer struct {
+	*httptest.Server
+	reply func(w http.ResponseWriter, n int)
+
+	mu       sync.Mutex
+	requests []request
+}
+
+func newAPIServer(reply func(w http.ResponseWriter, n int)) *apiServer {
+
+	s := &apiServer{reply: reply}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s
+}
+
+func (s *apiServer) handle(w http.ResponseWriter, r *http.Request) {
+
+	req := request{
+		method: r.Method,
+		path:   r.URL.RequestURI(),
+		auth:   r.Header.Get("Authorization"),
+		key:    r.Header.Get(rpt.IdempotencyKeyHeader),
+		ctype:  r.Header.Get("Content-Type"),
+	}
+	if b, _ := ioutil.ReadAll(r.Body); len(b) > 0 {
+		req.hasBody = true
+		json.Unmarshal(b, &req.body)
+	}
+
+	s.mu.Lock()
+	n := len(s.requests)
+	s.requests = append(s.requests, req)
+	s.mu.Unlock()
+
+	if s.reply != nil {
+		s.reply(w, n)
+		return
+	}
+	if r.Method == http.MethodGet {
+		fmt.Fprint(w, `{"ID":"set-1","Operations":{}}`)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(w, `{"ID":"set-1","Operations":["op-1"]}`)
+}
+
+func (s *apiServer) last() request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+func TestClientRequests(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		call   func(ctx context.Context, c *Client) error
+		method string
+		path   string
+		body   map[string]interface{}
+	}{
+		{
+			name: "seed",
+			call: func(ctx context.Context, c *Client) error {
+				_, err := c.Seed(ctx, &rpt.DBDataSet{Name: "users"})
+				return err
+			},
+			method: http.MethodPost, path: "/api/data/seed",
+			body: map[string]interface{}{"Name": "users"},
+		},
+		{
+			name: "query",
+			call: func(ctx context.Context, c *Client) error {
+				_, err := c.Query(ctx, &rpt.DBQueryDataSet{Name: "count", Query: "SELECT 1"})
+				return err
+			},
+			method: http.MethodPost, path: "/api/query",
+			body: map[string]interface{}{"Name": "count", "Query": "SELECT 1"},
+		},
+		{
+			name: "query on a target",
+			call: func(ctx context.Context, c *Client) error {
+				_, err := c.QueryOn(ctx, "second ary", &rpt.DBQueryDataSet{Query: "SELECT 1"})
+				return err
+			},
+			method: http.MethodPost, path: "/api/query?target=second+ary",
+		},
+		{
+			name: "run workflow",
+			call: func(ctx context.Context, c *Client) error {
+				_, err := c.RunWorkflow(ctx, &rpt.Workflow{Name: "replication_check"})
+				return err
+			},
+			method: http.MethodPost, path: "/api/workflow/run",
+		},
+		{
+			name: "get operation",
+			call: func(ctx context.Context, c *Client) error {
+				_, err := c.GetOperation(ctx, "set-1")
+				return err
+			},
+			method: http.MethodGet, path: "/api/operation/set-1",
+		},
+		{
+			name: "operation id is escaped",
+			call: func(ctx context.Context, c *Client) error {
+				_, err := c.GetOperation(ctx, "../close?x=1")
+				return err
+			},
+			method: http.MethodGet, path: "/api/operation/..%2Fclose%3Fx=1",
+		},
+		{
+			name: "close",
+			call: func(ctx context.Context, c *Client) error {
+				return c.Close(ctx)
+			},
+			method: http.MethodPost, path: "/api/close",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			s := newAPIServer(nil)
+			defer s.Close()
+
+			c := New(s.URL + "/api/")
+			c.Token = "secret"
+			ctx := WithIdempotencyKey(context.Background(), "key-1")
+
+			if err := tt.call(ctx, c); err != nil {
+				t.Fatal(err)
+			}
+
+			req := s.last()
+			if req.method != tt.method || req.path != tt.path {
+				t.Errorf("request = %s %s, want %s %s", req.method, req.path, tt.method, tt.path)
+			}
+			if req.auth != "Bearer secret" {
+				t.Errorf("Authorization = %q, want Bearer secret", req.auth)
+			}
+			if req.key != "key-1" {
+				t.Errorf("%s = %q, want key-1", rpt.IdempotencyKeyHeader, req.key)
+			}
+			if req.hasBody != (tt.method == http.MethodPost && tt.name != "close") {
+				t.Errorf("request has a body: %t", req.hasBody)
+			}
+			if req.hasBody && req.ctype != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", req.ctype)
+			}
+			for k, v := range tt.body {
+				if req.body[k] != v {
+					t.Errorf("body %s = %v, want %v", k, req.body[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		status     int
+		header     map[string]string
+		body       string
+		code       string
+		message    string
+		retryAfter time.Duration
+	}{
+		{
+			name:   "api error",
+			status: http.StatusServiceUnavailable, header: map[string]string{"Retry-After": "5"},
+			body: `{"code":"queue_full","message":"The operation queue is full, try again later"}`,
+			code: "queue_full", message: "The operation queue is full, try again later", retryAfter: 5 * time.Second,
+		},
+		{
+			name:   "rate limited",
+			status: http.StatusTooManyRequests, header: map[string]string{"Retry-After": "12"},
+			body: `{"code":"rate_limited","message":"Too many requests, try again later"}`,
+			code: "rate_limited", message: "Too many requests, try again later", retryAfter: 12 * time.Second,
+		},
+		{
+			name:   "not json",
+			status: http.StatusBadGateway, body: "upstream unavailable\n",
+			code: "bad_gateway", message: "upstream unavailable",
+		},
+		{
+			name:   "json without a code",
+			status: http.StatusNotFound, body: `{"error":"missing"}`,
+			code: "not_found", message: `{"error":"missing"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			s := newAPIServer(func(w http.ResponseWriter, n int) {
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			})
+			defer s.Close()
+
+			_, err := New(s.URL).GetOperation(context.Background(), "set-1")
+
+			var e *Error
+			if !errors.As(err, &e) {
+				t.Fatalf("error = %v, want an *Error", err)
+			}
+			if e.StatusCode != tt.status || e.Code != tt.code || e.Message != tt.message || e.RetryAfter != tt.retryAfter {
+				t.Errorf("error = %+v, want %d %s %q retry after %s", e, tt.status, tt.code, tt.message, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestWaitForOperation(t *testing.T) {
+
+	const running = `{"ID":"set-1","Operations":{"op-1":{"Started":"2020-06-01T12:00:00Z","Completed":"0001-01-01T00:00:00Z"}}}`
+	const done = `{"ID":"set-1","Operations":{"op-1":{"Started":"2020-06-01T12:00:00Z","Completed":"2020-06-01T12:00:01Z","Output":{"Errors":["timeout"]}}}}`
+
+	s := newAPIServer(func(w http.ResponseWriter, n int) {
+		if n < 2 {
+			fmt.Fprint(w, running)
+			return
+		}
+		fmt.Fprint(w, done)
+	})
+	defer s.Close()
+
+	c := New(s.URL)
+	c.PollInterval = time.Millisecond
+
+	op, err := c.WaitForOperation(context.Background(), "set-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !op.Done() || !op.Failed() {
+		t.Errorf("operation done %t, failed %t, want both", op.Done(), op.Failed())
+	}
+	s.mu.Lock()
+	polls := len(s.requests)
+	s.mu.Unlock()
+	if polls != 3 {
+		t.Errorf("polled %d times, want 3", polls)
+	}
+}
+
+func TestWaitForOperationTimeout(t *testing.T) {
+
+	s := newAPIServer(func(w http.ResponseWriter, n int) {
+		fmt.Fprint(w, `{"ID":"set-1","Operations":{"op-1":{}}}`)
+	})
+	defer s.Close()
+
+	c := New(s.URL)
+	c.PollInterval = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.WaitForOperation(ctx, "set-1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -1,41 +1,115 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
 
-	"github.com/urfave/cli"
+	"github.com/haylesnortal/rpt/rpt"
+	"github.com/urfave/cli/v2"
 )
 
 /*
 
-	--config-file
-	--continuous
-	--api
+	rpt [--config-file FILE] [--api] [--continuous=false] [--output text|json] [COMMAND]
+
+	Without a command rpt processes the seed files and workflows from the
+	config. With --continuous=false it exits once they are complete, printing
+	a summary and exiting non-zero if any operation failed.
+
+	serve                                  run the API until /close is called
+	seed FILE                              seed the primary with a data set
+	query [--target primary|secondary] SQL run a query against one client
+	run-workflow FILE                      run a workflow file once
+	lag                                    measure replication lag
+	compare SQL                            run a query on both clients and diff
+
+	Every command reads the same config file and RPT_* environment variables
+	as the server.
 
 */
 
 func main() {
 	app := cli.NewApp()
-	app.Name = "My App Name"
-	app.Usage = "This app does something"
+	app.Name = "rpt"
+	app.Usage = "replication performance testing"
 
-	myFlags := []cli.Flag{
+	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config-file",
+			Aliases: []string{"c"},
+			Usage:   "YAML or JSON config file",
+			EnvVars: []string{"RPT_CONFIG_FILE"},
+		},
+		&cli.BoolFlag{
+			Name:  "api",
+			Usage: "enable the HTTP API (overrides the config file and RPT_API)",
+		},
+		&cli.BoolFlag{
+			Name:    "continuous",
+			Value:   true,
+			Usage:   "keep running after the configured work is complete",
+			EnvVars: []string{"RPT_CONTINUOUS"},
+		},
 		&cli.StringFlag{
-			Name:  "primaryhost",
-			Value: "localhost",
+			Name:    "summary-file",
+			Usage:   "write the one-shot run summary as JSON to this file",
+			EnvVars: []string{"RPT_SUMMARY_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Value:   "text",
+			Usage:   "output format: text or json",
 		},
 	}
 
+	app.Action = run
+
 	app.Commands = []*cli.Command{
 		{
-			Name:  "test",
-			Usage: "runs a test",
-			Flags: myFlags,
-			Action: func(c *cli.Context) error {
-				//do stuff
-				return nil
+			Name:   "serve",
+			Usage:  "runs the API, seed files and workflows from the config",
+			Action: serve,
+		},
+		{
+			Name:      "seed",
+			Usage:     "seeds the primary with a data set",
+			ArgsUsage: "FILE",
+			Action:    seed,
+		},
+		{
+			Name:      "query",
+			Usage:     "runs a query against one client",
+			ArgsUsage: "SQL",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "target",
+					Value: "primary",
+					Usage: "primary or secondary",
+				},
 			},
+			Action: query,
+		},
+		{
+			Name:      "run-workflow",
+			Usage:     "runs a workflow file once",
+			ArgsUsage: "FILE",
+			Action:    runWorkflow,
+		},
+		{
+			Name:   "lag",
+			Usage:  "measures replication lag between the primary and secondary",
+			Action: lag,
+		},
+		{
+			Name:      "compare",
+			Usage:     "runs a query on both clients and compares the results",
+			ArgsUsage: "SQL",
+			Action:    compare,
 		},
 	}
 
@@ -45,3 +119,289 @@ func main() {
 	}
 
 }
+
+// COMMANDS
+
+func run(c *cli.Context) error {
+
+	cfg, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	r, err := rpt.NewRptWithConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	code := r.Run()
+	if code != 0 {
+		return cli.Exit("", code)
+	}
+
+	return nil
+}
+
+func serve(c *cli.Context) error {
+
+	cfg, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	if !c.IsSet("api") {
+		cfg.API.Enabled = true
+	}
+	cfg.Continuous = true
+
+	r, err := rpt.NewRptWithConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	r.Init()
+
+	return nil
+}
+
+func seed(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.Exit("seed: expected a data set FILE", 2)
+	}
+
+	ds, errs := rpt.ImportDBDataSet(c.Args().First())
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	r, err := oneShotClient(c)
+	if err != nil {
+		return err
+	}
+
+	return runOperation(c, r, rpt.SeedData(r.DBPrimary, ds))
+}
+
+func query(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.Exit("query: expected a single SQL argument", 2)
+	}
+
+	target := c.String("target")
+	if target != "primary" && target != "secondary" {
+		return cli.Exit(fmt.Sprintf("query: invalid target %q", target), 2)
+	}
+
+	r, err := oneShotClient(c)
+	if err != nil {
+		return err
+	}
+
+	client := r.DBPrimary
+	if target == "secondary" {
+		client = r.DBSecondary
+	}
+
+	q := &rpt.DBQueryDataSet{
+		Name:  "cli_query",
+		Query: c.Args().First(),
+	}
+
+	return runOperation(c, r, rpt.Query(client, q))
+}
+
+func runWorkflow(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.Exit("run-workflow: expected a workflow FILE", 2)
+	}
+
+	w, errs := rpt.ImportWorkflow(c.Args().First())
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	r, err := oneShotClient(c)
+	if err != nil {
+		return err
+	}
+
+	ops, err := w.Build(r.DBPrimary, r.DBSecondary)
+	if err != nil {
+		r.Close()
+		return err
+	}
+
+	r.Queue(ops)
+	r.RunOnce()
+
+	if c.String("output") == "json" {
+		os.Stdout.Write(ops.GetOutputJSON())
+		fmt.Println()
+	} else {
+		fmt.Printf("workflow %s\n\n", w.Name)
+		for _, op := range ops.Operations {
+			printOperation(op)
+			fmt.Println()
+		}
+	}
+
+	if ops.Failed() {
+		return cli.Exit("", 1)
+	}
+
+	return nil
+}
+
+func lag(c *cli.Context) error {
+
+	r, err := oneShotClient(c)
+	if err != nil {
+		return err
+	}
+
+	return runOperation(c, r, rpt.ReplicationLag(r.DBPrimary, r.DBSecondary))
+}
+
+func compare(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.Exit("compare: expected a single SQL argument", 2)
+	}
+
+	r, err := oneShotClient(c)
+	if err != nil {
+		return err
+	}
+
+	q := &rpt.DBQueryDataSet{
+		Name:  "cli_compare",
+		Query: c.Args().First(),
+	}
+
+	return runOperation(c, r, rpt.Compare(r.DBPrimary, r.DBSecondary, q))
+}
+
+// HELPERS
+
+func loadConfig(c *cli.Context) (*rpt.Config, error) {
+
+	cfg, err := rpt.LoadConfig(c.String("config-file"))
+	if err != nil {
+		return nil, err
+	}
+
+	if c.IsSet("api") {
+		cfg.API.Enabled = c.Bool("api")
+	}
+
+	if c.IsSet("continuous") {
+		cfg.Continuous = c.Bool("continuous")
+	}
+
+	if c.IsSet("summary-file") {
+		cfg.SummaryFile = c.String("summary-file")
+	}
+
+	return cfg, nil
+}
+
+// oneShotClient connects both clients without starting the API or queueing
+// the seed files and workflows from the config.
+func oneShotClient(c *cli.Context) (*rpt.RptClient, error) {
+
+	cfg, err := loadConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.API.Enabled = false
+	cfg.SeedFiles = nil
+	cfg.Workflows = nil
+
+	return rpt.NewRptWithConfig(cfg)
+}
+
+// runOperation runs op through r, as the server would, so that it logs and
+// records metrics to the configured outputs, which are flushed before it
+// returns.
+func runOperation(c *cli.Context, r *rpt.RptClient, op *rpt.DBOperation) error {
+
+	r.Queue(rpt.NewDBOperationSet(op))
+	r.RunOnce()
+
+	if c.String("output") == "json" {
+		os.Stdout.Write(op.GetOutputJSON())
+		fmt.Println()
+	} else {
+		printOperation(op)
+	}
+
+	if op.Failed() {
+		return cli.Exit("", 1)
+	}
+
+	return nil
+}
+
+func printOperation(op *rpt.DBOperation) {
+
+	status := "ok"
+	if op.Failed() {
+		status = "FAILED"
+	}
+
+	fmt.Printf("%s %s (%s)\n", op.Name, status, op.Duration())
+
+	for _, err := range op.Errors() {
+		fmt.Printf("  error: %s\n", err)
+	}
+
+	switch res := op.Result().(type) {
+	case *rpt.SQLOutput:
+		printRows(res)
+	case *rpt.CompareResult:
+		fmt.Printf("  match: %t\n", res.Match)
+		if p, ok := res.Primary.(*rpt.SQLOutput); ok {
+			fmt.Println("  primary:")
+			printRows(p)
+		}
+		if s, ok := res.Secondary.(*rpt.SQLOutput); ok {
+			fmt.Println("  secondary:")
+			printRows(s)
+		}
+	case *rpt.ReplicationLagResult:
+		fmt.Printf("  primary lsn:   %s\n", res.Primary.LSN)
+		fmt.Printf("  secondary lsn: %s\n", res.Secondary.LSN)
+		fmt.Printf("  lag:           %d bytes, %.3fs\n", res.LagBytes, res.LagSeconds)
+	}
+}
+
+func printRows(out *rpt.SQLOutput) {
+
+	if len(out.Result) == 0 {
+		fmt.Println("  (no rows)")
+		return
+	}
+
+	cols := []string{}
+	for col := range out.Result[0] {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "  %s\n", strings.Join(cols, "\t"))
+	for _, row := range out.Result {
+		vals := make([]string, len(cols))
+		for i, col := range cols {
+			vals[i] = fmt.Sprint(row[col])
+		}
+		fmt.Fprintf(tw, "  %s\n", strings.Join(vals, "\t"))
+	}
+	tw.Flush()
+
+	fmt.Printf("  (%d rows)\n", len(out.Result))
+}
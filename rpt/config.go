@@ -0,0 +1,847 @@
+package rpt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+
+Config describes everything needed to build an RptClient. It can be loaded
+from a YAML (.yaml, .yml) or JSON file, and any RPT_* environment variable
+that is set overrides the value from the file.
+
+	primary:
+	  type: postgres
+	  host: localhost
+	  port: 5432
+	  user: postgres
+	  password: mysecretpassword
+	  sslmode: disable
+	secondary:
+	  ...
+	api:
+	  enabled: true
+	  base_path: /api
+	  listen_addr: :5000
+	  auth:
+	    enabled: true
+	    tokens:
+	      - name: ci
+	        token: changeme
+	        role: write
+	    client_certs:
+	      - subject: drill-ui
+	        role: read
+	    roles:
+	      query: admin
+	  tls:
+	    cert_file: /etc/rpt/tls/server.crt
+	    key_file: /etc/rpt/tls/server.key
+	    client_ca_file: /etc/rpt/tls/ca.crt
+	    client_auth: optional
+	  idempotency_window: 24h
+	  max_body_bytes: 1048576
+	  rate_limit: 10
+	  rate_burst: 20
+	  grpc_listen_addr: :5001
+	  data_dir: /etc/rpt/data
+	log_level: DEBUG
+	outputs:
+	  - type: console
+	    queue_size: 1000
+	    queue_policy: drop
+	  - type: file
+	    format: csv
+	    path: /var/log/rpt/rpt.csv
+	    max_size: 10485760
+	    max_age: 24h
+	    max_files: 7
+	  - type: elastic
+	    url: https://localhost:9200
+	    index: rpt-{type}-{2006.01.02}
+	    username: elastic
+	    password: changeme
+	    flush_interval: 5s
+	tracing:
+	  enabled: true
+	  endpoint: http://localhost:4318
+	  service_name: rpt
+	  headers:
+	    x-api-key: changeme
+	seed_files:
+	  - sample_data_01.json
+	workflows:
+	  - replication_check.json
+	continuous: false
+	summary_file: /var/log/rpt/summary.json
+	shutdown_timeout: 30s
+
+*/
+
+type Config struct {
+	Primary   ClientConfig   `json:"primary" yaml:"primary"`
+	Secondary ClientConfig   `json:"secondary" yaml:"secondary"`
+	API       APIConfig      `json:"api" yaml:"api"`
+	LogLevel  string         `json:"log_level" yaml:"log_level"`
+	Outputs   []OutputConfig `json:"outputs" yaml:"outputs"`
+	Tracing   TracingConfig  `json:"tracing" yaml:"tracing"`
+	SeedFiles []string       `json:"seed_files" yaml:"seed_files"`
+	Workflows []string       `json:"workflows" yaml:"workflows"`
+
+	// Continuous keeps rpt running after the seed files and workflows have
+	// been processed. When false rpt exits with a non-zero status if any
+	// operation failed, writing a RunSummary to SummaryFile if it is set.
+	Continuous  bool   `json:"continuous" yaml:"continuous"`
+	SummaryFile string `json:"summary_file" yaml:"summary_file"`
+
+	// ShutdownTimeout is how long to wait for queued operations to finish
+	// on shutdown, e.g. 30s.
+	ShutdownTimeout string `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+}
+
+type ClientConfig struct {
+	Type     string `json:"type" yaml:"type"`
+	Host     string `json:"host" yaml:"host"`
+	Port     int    `json:"port" yaml:"port"`
+	User     string `json:"user" yaml:"user"`
+	Password string `json:"password" yaml:"password"`
+	SSLMode  string `json:"sslmode" yaml:"sslmode"`
+}
+
+type APIConfig struct {
+	Enabled    bool          `json:"enabled" yaml:"enabled"`
+	BasePath   string        `json:"base_path" yaml:"base_path"`
+	ListenAddr string        `json:"listen_addr" yaml:"listen_addr"`
+	Auth       APIAuthConfig `json:"auth" yaml:"auth"`
+	TLS        APITLSConfig  `json:"tls" yaml:"tls"`
+
+	// IdempotencyWindow is how long an Idempotency-Key is remembered, e.g.
+	// 24h. 0 turns Idempotency-Key handling off.
+	IdempotencyWindow string `json:"idempotency_window" yaml:"idempotency_window"`
+
+	// MaxBodyBytes is the largest request body accepted, 0 for no limit.
+	// RateLimit is the number of requests a second each client may make,
+	// with bursts of up to RateBurst; 0 turns rate limiting off.
+	MaxBodyBytes int64   `json:"max_body_bytes" yaml:"max_body_bytes"`
+	RateLimit    float64 `json:"rate_limit" yaml:"rate_limit"`
+	RateBurst    int     `json:"rate_burst" yaml:"rate_burst"`
+
+	// GRPCListenAddr serves the gRPC API as well when set, e.g. :5001.
+	GRPCListenAddr string `json:"grpc_listen_addr,omitempty" yaml:"grpc_listen_addr,omitempty"`
+
+	// DataDir is where the data files named by workflows run through the API
+	// are read from. Without it those workflows can't use data files.
+	DataDir string `json:"data_dir,omitempty" yaml:"data_dir,omitempty"`
+}
+
+// APITLSConfig serves the API over HTTPS when CertFile is set. ClientAuth is
+// none, optional or require, and needs ClientCAFile unless it is none.
+type APITLSConfig struct {
+	CertFile     string `json:"cert_file,omitempty" yaml:"cert_file,omitempty"`
+	KeyFile      string `json:"key_file,omitempty" yaml:"key_file,omitempty"`
+	ClientCAFile string `json:"client_ca_file,omitempty" yaml:"client_ca_file,omitempty"`
+	ClientAuth   string `json:"client_auth,omitempty" yaml:"client_auth,omitempty"`
+}
+
+// APIAuthConfig lists the callers allowed to use the API and their roles:
+// read, write or admin. Roles overrides the role a route group needs, e.g.
+// query: admin.
+type APIAuthConfig struct {
+	Enabled     bool                  `json:"enabled" yaml:"enabled"`
+	Tokens      []APITokenConfig      `json:"tokens,omitempty" yaml:"tokens,omitempty"`
+	ClientCerts []APIClientCertConfig `json:"client_certs,omitempty" yaml:"client_certs,omitempty"`
+	Roles       map[string]string     `json:"roles,omitempty" yaml:"roles,omitempty"`
+}
+
+type APITokenConfig struct {
+	Name  string `json:"name" yaml:"name"`
+	Token string `json:"token" yaml:"token"`
+	Role  string `json:"role" yaml:"role"`
+}
+
+// APIClientCertConfig gives a role to client certificates with the common
+// name Subject.
+type APIClientCertConfig struct {
+	Subject string `json:"subject" yaml:"subject"`
+	Role    string `json:"role" yaml:"role"`
+}
+
+// TracingConfig configures export of spans to an OpenTelemetry collector
+// over OTLP/HTTP. Endpoint is the collector's base URL; spans are posted to
+// Endpoint/v1/traces.
+type TracingConfig struct {
+	Enabled       bool              `json:"enabled" yaml:"enabled"`
+	Endpoint      string            `json:"endpoint" yaml:"endpoint"`
+	ServiceName   string            `json:"service_name" yaml:"service_name"`
+	Headers       map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	FlushInterval string            `json:"flush_interval,omitempty" yaml:"flush_interval,omitempty"` // e.g. 5s
+}
+
+type OutputConfig struct {
+	Type          string `json:"type" yaml:"type"` // console, file, pull, elastic
+	Logs          *bool  `json:"logs,omitempty" yaml:"logs,omitempty"`
+	Metrics       *bool  `json:"metrics,omitempty" yaml:"metrics,omitempty"`
+	Format        string `json:"format,omitempty" yaml:"format,omitempty"` // file: json, text, csv
+	Path          string `json:"path,omitempty" yaml:"path,omitempty"`
+	MaxSize       int64  `json:"max_size,omitempty" yaml:"max_size,omitempty"` // file: bytes
+	MaxAge        string `json:"max_age,omitempty" yaml:"max_age,omitempty"`   // file: e.g. 24h
+	MaxFiles      int    `json:"max_files,omitempty" yaml:"max_files,omitempty"`
+	URL           string `json:"url,omitempty" yaml:"url,omitempty"`
+	Index         string `json:"index,omitempty" yaml:"index,omitempty"`
+	Username      string `json:"username,omitempty" yaml:"username,omitempty"`
+	Password      string `json:"password,omitempty" yaml:"password,omitempty"`
+	APIKey        string `json:"api_key,omitempty" yaml:"api_key,omitempty"`
+	FlushInterval string `json:"flush_interval,omitempty" yaml:"flush_interval,omitempty"` // elastic: e.g. 5s
+	BatchSize     int    `json:"batch_size,omitempty" yaml:"batch_size,omitempty"`
+	MaxBuffer     int    `json:"max_buffer,omitempty" yaml:"max_buffer,omitempty"`
+	QueueSize     int    `json:"queue_size,omitempty" yaml:"queue_size,omitempty"`     // console, pull
+	QueuePolicy   string `json:"queue_policy,omitempty" yaml:"queue_policy,omitempty"` // console, elastic: block, drop
+}
+
+// ConfigError holds every problem found while loading and validating a Config.
+type ConfigError struct {
+	Problems []string
+}
+
+func (ce *ConfigError) Error() string {
+	return fmt.Sprintf("rpt: invalid configuration:\n  - %s", strings.Join(ce.Problems, "\n  - "))
+}
+
+// NewConfig returns a Config populated with the defaults.
+func NewConfig() *Config {
+	return &Config{
+		Primary: ClientConfig{
+			Type: "postgres",
+			Port: 5432,
+		},
+		Secondary: ClientConfig{
+			Type: "postgres",
+			Port: 5432,
+		},
+		API: APIConfig{
+			BasePath:          "/api",
+			ListenAddr:        ":5000",
+			IdempotencyWindow: "24h",
+			MaxBodyBytes:      1 << 20,
+			RateBurst:         20,
+		},
+		LogLevel:        "INFO",
+		Continuous:      true,
+		ShutdownTimeout: "30s",
+		Tracing: TracingConfig{
+			Endpoint:    "http://localhost:4318",
+			ServiceName: "rpt",
+		},
+	}
+}
+
+// LoadConfig reads the config file at configPath (if any), applies the RPT_*
+// environment variables on top of it and validates the result.
+func LoadConfig(configPath string) (*Config, error) {
+
+	c := NewConfig()
+	problems := []string{}
+
+	if configPath != "" {
+		err := c.readFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	problems = append(problems, c.applyEnvironment()...)
+	problems = append(problems, c.validate()...)
+
+	if len(problems) > 0 {
+		return c, &ConfigError{Problems: problems}
+	}
+
+	return c, nil
+}
+
+// Validate checks the whole Config and reports every problem at once.
+func (c *Config) Validate() error {
+
+	problems := c.validate()
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+
+	return nil
+}
+
+func (c *Config) readFile(configPath string) error {
+
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(content, c)
+	case ".json":
+		dec := json.NewDecoder(strings.NewReader(string(content)))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	default:
+		return fmt.Errorf("rpt: unsupported config file type %q", filepath.Ext(configPath))
+	}
+
+	if err != nil {
+		return fmt.Errorf("rpt: unable to parse config file %s: %s", configPath, err)
+	}
+
+	// Relative seed, workflow and data paths are relative to the config file.
+	dir := filepath.Dir(configPath)
+	for i, f := range c.SeedFiles {
+		c.SeedFiles[i] = relativeTo(dir, f)
+	}
+	for i, f := range c.Workflows {
+		c.Workflows[i] = relativeTo(dir, f)
+	}
+	c.API.DataDir = relativeTo(dir, c.API.DataDir)
+
+	return nil
+}
+
+func (c *Config) applyEnvironment() []string {
+
+	problems := []string{}
+
+	problems = append(problems, c.Primary.applyEnvironment("RPT_PRIMARY")...)
+	problems = append(problems, c.Secondary.applyEnvironment("RPT_SECONDARY")...)
+
+	if v := os.Getenv("RPT_SEED_FILE"); v != "" {
+		c.SeedFiles = []string{v}
+	}
+
+	if v := os.Getenv("RPT_WORKFLOWS"); v != "" {
+		c.Workflows = splitList(v)
+	}
+
+	if v := os.Getenv("RPT_API"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("RPT_API: %q is not a boolean", v))
+		} else {
+			c.API.Enabled = b
+		}
+	}
+
+	if v := os.Getenv("RPT_API_BASEPATH"); v != "" {
+		c.API.BasePath = v
+	}
+
+	if v := os.Getenv("RPT_API_LISTEN_ADDR"); v != "" {
+		c.API.ListenAddr = v
+	}
+
+	if v := os.Getenv("RPT_API_IDEMPOTENCY_WINDOW"); v != "" {
+		c.API.IdempotencyWindow = v
+	}
+
+	if v := os.Getenv("RPT_API_GRPC_LISTEN_ADDR"); v != "" {
+		c.API.GRPCListenAddr = v
+	}
+
+	if v := os.Getenv("RPT_API_DATA_DIR"); v != "" {
+		c.API.DataDir = v
+	}
+
+	if v := os.Getenv("RPT_API_MAX_BODY_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("RPT_API_MAX_BODY_BYTES: %q is not a number", v))
+		} else {
+			c.API.MaxBodyBytes = n
+		}
+	}
+
+	if v := os.Getenv("RPT_API_RATE_LIMIT"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("RPT_API_RATE_LIMIT: %q is not a number", v))
+		} else {
+			c.API.RateLimit = f
+		}
+	}
+
+	if v := os.Getenv("RPT_API_RATE_BURST"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("RPT_API_RATE_BURST: %q is not a number", v))
+		} else {
+			c.API.RateBurst = n
+		}
+	}
+
+	if v := os.Getenv("RPT_API_TLS_CERT_FILE"); v != "" {
+		c.API.TLS.CertFile = v
+	}
+
+	if v := os.Getenv("RPT_API_TLS_KEY_FILE"); v != "" {
+		c.API.TLS.KeyFile = v
+	}
+
+	if v := os.Getenv("RPT_API_TLS_CLIENT_CA_FILE"); v != "" {
+		c.API.TLS.ClientCAFile = v
+	}
+
+	if v := os.Getenv("RPT_API_TLS_CLIENT_AUTH"); v != "" {
+		c.API.TLS.ClientAuth = v
+	}
+
+	// RPT_API_TOKEN adds an admin token and turns authentication on.
+	if v := os.Getenv("RPT_API_TOKEN"); v != "" {
+		c.API.Auth.Enabled = true
+		c.API.Auth.Tokens = append(c.API.Auth.Tokens, APITokenConfig{Name: "RPT_API_TOKEN", Token: v, Role: string(RoleAdmin)})
+	}
+
+	// Setting a tracing endpoint turns tracing on.
+	if v := os.Getenv("RPT_TRACING_ENDPOINT"); v != "" {
+		c.Tracing.Enabled = true
+		c.Tracing.Endpoint = v
+	}
+
+	if v := os.Getenv("RPT_TRACING_SERVICE_NAME"); v != "" {
+		c.Tracing.ServiceName = v
+	}
+
+	if v := os.Getenv("RPT_LOG_LVL"); v != "" {
+		c.LogLevel = v
+	}
+
+	if v := os.Getenv("RPT_CONTINUOUS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("RPT_CONTINUOUS: %q is not a boolean", v))
+		} else {
+			c.Continuous = b
+		}
+	}
+
+	if v := os.Getenv("RPT_SUMMARY_FILE"); v != "" {
+		c.SummaryFile = v
+	}
+
+	if v := os.Getenv("RPT_SHUTDOWN_TIMEOUT"); v != "" {
+		c.ShutdownTimeout = v
+	}
+
+	return problems
+}
+
+func (cc *ClientConfig) applyEnvironment(prefix string) []string {
+
+	problems := []string{}
+
+	// RPT_*_HOST is in the form type:host, e.g. postgres:localhost
+	if v := os.Getenv(prefix + "_HOST"); v != "" {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) == 2 {
+			cc.Type = parts[0]
+			cc.Host = parts[1]
+		} else {
+			cc.Host = parts[0]
+		}
+	}
+
+	if v := os.Getenv(prefix + "_PORT"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s_PORT: %q is not a number", prefix, v))
+		} else {
+			cc.Port = p
+		}
+	}
+
+	if v := os.Getenv(prefix + "_USER"); v != "" {
+		cc.User = v
+	}
+
+	if v := os.Getenv(prefix + "_PASS"); v != "" {
+		cc.Password = v
+	}
+
+	if v := os.Getenv(prefix + "_SSLMODE"); v != "" {
+		cc.SSLMode = v
+	}
+
+	return problems
+}
+
+func (c *Config) validate() []string {
+
+	problems := []string{}
+
+	problems = append(problems, c.Primary.validate("primary")...)
+	problems = append(problems, c.Secondary.validate("secondary")...)
+
+	c.LogLevel = strings.ToUpper(c.LogLevel)
+	if NewLog(c.LogLevel, "") == nil {
+		problems = append(problems, fmt.Sprintf("log_level: %q must be one of DEBUG, INFO, WARN, ERROR", c.LogLevel))
+	}
+
+	if c.API.Enabled {
+		if c.API.ListenAddr == "" {
+			problems = append(problems, "api.listen_addr: required when the API is enabled")
+		}
+		if !strings.HasPrefix(c.API.BasePath, "/") {
+			problems = append(problems, fmt.Sprintf("api.base_path: %q must start with /", c.API.BasePath))
+		}
+		if c.API.Auth.Enabled {
+			problems = append(problems, c.API.Auth.validate()...)
+		}
+		problems = append(problems, c.API.TLS.validate()...)
+		if d, err := time.ParseDuration(c.API.IdempotencyWindow); c.API.IdempotencyWindow != "" && (err != nil || d < 0) {
+			problems = append(problems, fmt.Sprintf("api.idempotency_window: %q is not a valid duration", c.API.IdempotencyWindow))
+		}
+		if c.API.MaxBodyBytes < 0 {
+			problems = append(problems, fmt.Sprintf("api.max_body_bytes: %d must not be negative", c.API.MaxBodyBytes))
+		}
+		if c.API.RateLimit < 0 {
+			problems = append(problems, fmt.Sprintf("api.rate_limit: %v must not be negative", c.API.RateLimit))
+		}
+		if c.API.RateLimit > 0 && c.API.RateBurst < 1 {
+			problems = append(problems, fmt.Sprintf("api.rate_burst: %d must be at least 1", c.API.RateBurst))
+		}
+		if c.API.Auth.Enabled && len(c.API.Auth.ClientCerts) > 0 && c.API.TLS.ClientCAFile == "" {
+			problems = append(problems, "api.auth.client_certs: needs api.tls.client_ca_file to verify client certificates")
+		}
+	}
+
+	if d, err := time.ParseDuration(c.ShutdownTimeout); err != nil || d < 0 {
+		problems = append(problems, fmt.Sprintf("shutdown_timeout: %q is not a valid duration", c.ShutdownTimeout))
+	}
+
+	for i := range c.Outputs {
+		problems = append(problems, c.Outputs[i].validate(fmt.Sprintf("outputs[%d]", i))...)
+	}
+
+	if c.Tracing.Enabled {
+		problems = append(problems, c.Tracing.validate()...)
+	}
+
+	for i, f := range c.SeedFiles {
+		if _, err := os.Stat(f); err != nil {
+			problems = append(problems, fmt.Sprintf("seed_files[%d]: %s", i, err))
+		}
+	}
+
+	for i, f := range c.Workflows {
+		if _, err := os.Stat(f); err != nil {
+			problems = append(problems, fmt.Sprintf("workflows[%d]: %s", i, err))
+		}
+	}
+
+	return problems
+}
+
+func (cc *ClientConfig) validate(name string) []string {
+
+	problems := []string{}
+
+	if cc.Type != "postgres" {
+		problems = append(problems, fmt.Sprintf("%s.type: %q is not a supported client type", name, cc.Type))
+	}
+
+	if cc.Host == "" {
+		problems = append(problems, fmt.Sprintf("%s.host: required", name))
+	}
+
+	if cc.Port < 1 || cc.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("%s.port: %d is not a valid port", name, cc.Port))
+	}
+
+	if cc.User == "" {
+		problems = append(problems, fmt.Sprintf("%s.user: required", name))
+	}
+
+	if cc.Password == "" {
+		problems = append(problems, fmt.Sprintf("%s.password: required", name))
+	}
+
+	ssl, err := validateSSL(cc.SSLMode)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("%s.sslmode: %q is not a valid SSL mode", name, cc.SSLMode))
+	}
+	cc.SSLMode = ssl
+
+	return problems
+}
+
+func (tc *APITLSConfig) validate() []string {
+
+	problems := []string{}
+
+	if tc.CertFile == "" && tc.KeyFile == "" && tc.ClientCAFile == "" {
+		return problems
+	}
+
+	if tc.CertFile == "" || tc.KeyFile == "" {
+		problems = append(problems, "api.tls: cert_file and key_file are both required")
+	}
+
+	files := [][2]string{
+		{"cert_file", tc.CertFile},
+		{"key_file", tc.KeyFile},
+		{"client_ca_file", tc.ClientCAFile},
+	}
+	for _, f := range files {
+		if f[1] == "" {
+			continue
+		}
+		if _, err := os.Stat(f[1]); err != nil {
+			problems = append(problems, fmt.Sprintf("api.tls.%s: %s", f[0], err))
+		}
+	}
+
+	switch ClientAuthMode(tc.ClientAuth) {
+	case "":
+		if tc.ClientCAFile != "" {
+			tc.ClientAuth = string(ClientAuthOptional)
+		} else {
+			tc.ClientAuth = string(ClientAuthNone)
+		}
+	case ClientAuthNone:
+	case ClientAuthOptional, ClientAuthRequire:
+		if tc.ClientCAFile == "" {
+			problems = append(problems, fmt.Sprintf("api.tls.client_auth: %q needs client_ca_file", tc.ClientAuth))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("api.tls.client_auth: %q must be one of none, optional, require", tc.ClientAuth))
+	}
+
+	return problems
+}
+
+func (ac *APIAuthConfig) validate() []string {
+
+	problems := []string{}
+
+	if len(ac.Tokens) == 0 && len(ac.ClientCerts) == 0 {
+		problems = append(problems, "api.auth: at least one token or client certificate is required when authentication is enabled")
+	}
+
+	for i, t := range ac.Tokens {
+		if t.Token == "" {
+			problems = append(problems, fmt.Sprintf("api.auth.tokens[%d].token: required", i))
+		}
+		if !Role(t.Role).Valid() {
+			problems = append(problems, fmt.Sprintf("api.auth.tokens[%d].role: %q must be one of read, write, admin", i, t.Role))
+		}
+	}
+
+	for i, cc := range ac.ClientCerts {
+		if cc.Subject == "" {
+			problems = append(problems, fmt.Sprintf("api.auth.client_certs[%d].subject: required", i))
+		}
+		if !Role(cc.Role).Valid() {
+			problems = append(problems, fmt.Sprintf("api.auth.client_certs[%d].role: %q must be one of read, write, admin", i, cc.Role))
+		}
+	}
+
+	for route, r := range ac.Roles {
+		if !Role(r).Valid() {
+			problems = append(problems, fmt.Sprintf("api.auth.roles.%s: %q must be one of read, write, admin", route, r))
+		}
+	}
+
+	return problems
+}
+
+func (ac *APIAuthConfig) newAuth() *APIAuth {
+
+	aa := NewAPIAuth()
+
+	if len(ac.Tokens) > 0 {
+		ta := NewTokenAuthenticator()
+		for _, t := range ac.Tokens {
+			ta.AddToken(t.Token, t.Name, Role(t.Role))
+		}
+		aa.Authenticators = append(aa.Authenticators, ta)
+	}
+
+	if len(ac.ClientCerts) > 0 {
+		ca := NewCertAuthenticator()
+		for _, cc := range ac.ClientCerts {
+			ca.AddSubject(cc.Subject, Role(cc.Role))
+		}
+		aa.Authenticators = append(aa.Authenticators, ca)
+	}
+
+	for route, r := range ac.Roles {
+		aa.Roles[route] = Role(r)
+	}
+
+	return aa
+}
+
+func (tc *TracingConfig) validate() []string {
+
+	problems := []string{}
+
+	if u, err := url.Parse(tc.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		problems = append(problems, fmt.Sprintf("tracing.endpoint: %q must be an http or https URL", tc.Endpoint))
+	}
+
+	if tc.ServiceName == "" {
+		problems = append(problems, "tracing.service_name: required when tracing is enabled")
+	}
+
+	if d, err := time.ParseDuration(tc.FlushInterval); tc.FlushInterval != "" && (err != nil || d <= 0) {
+		problems = append(problems, fmt.Sprintf("tracing.flush_interval: %q is not a valid duration", tc.FlushInterval))
+	}
+
+	return problems
+}
+
+func (tc *TracingConfig) newExporter(l *Logger) *OTLPExporter {
+
+	e := NewOTLPExporter(tc.Endpoint, tc.ServiceName)
+	for k, v := range tc.Headers {
+		e.Headers[k] = v
+	}
+	e.FlushInterval, _ = time.ParseDuration(tc.FlushInterval)
+	e.Logger = l.With(Fields{FieldComponent: "tracing"})
+
+	return e
+}
+
+func (oc *OutputConfig) validate(name string) []string {
+
+	problems := []string{}
+
+	if oc.QueueSize < 0 {
+		problems = append(problems, fmt.Sprintf("%s.queue_size: must not be negative", name))
+	}
+	switch QueuePolicy(oc.QueuePolicy) {
+	case "", QueueBlock, QueueDrop:
+	default:
+		problems = append(problems, fmt.Sprintf("%s.queue_policy: %q must be one of block, drop", name, oc.QueuePolicy))
+	}
+
+	switch oc.Type {
+	case "console", "pull":
+	case "file":
+		if oc.Path == "" {
+			problems = append(problems, fmt.Sprintf("%s.path: required for file outputs", name))
+		}
+		switch oc.Format {
+		case "json", "text", "csv":
+		case "":
+			oc.Format = "json"
+		default:
+			problems = append(problems, fmt.Sprintf("%s.format: %q must be one of json, text, csv", name, oc.Format))
+		}
+		if oc.MaxSize < 0 {
+			problems = append(problems, fmt.Sprintf("%s.max_size: must not be negative", name))
+		}
+		if d, err := time.ParseDuration(oc.MaxAge); oc.MaxAge != "" && (err != nil || d < 0) {
+			problems = append(problems, fmt.Sprintf("%s.max_age: %q is not a valid duration", name, oc.MaxAge))
+		}
+		if oc.MaxFiles < 0 {
+			problems = append(problems, fmt.Sprintf("%s.max_files: must not be negative", name))
+		}
+	case "elastic":
+		if oc.URL == "" {
+			problems = append(problems, fmt.Sprintf("%s.url: required for elastic outputs", name))
+		} else if u, err := url.Parse(oc.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, fmt.Sprintf("%s.url: %q must be an http or https URL", name, oc.URL))
+		}
+		if d, err := time.ParseDuration(oc.FlushInterval); oc.FlushInterval != "" && (err != nil || d <= 0) {
+			problems = append(problems, fmt.Sprintf("%s.flush_interval: %q is not a valid duration", name, oc.FlushInterval))
+		}
+		if oc.BatchSize < 0 {
+			problems = append(problems, fmt.Sprintf("%s.batch_size: must not be negative", name))
+		}
+		if oc.MaxBuffer < 0 {
+			problems = append(problems, fmt.Sprintf("%s.max_buffer: must not be negative", name))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("%s.type: %q must be one of console, file, pull, elastic", name, oc.Type))
+	}
+
+	return problems
+}
+
+// Outputs receive both logs and metrics unless told otherwise.
+func (oc *OutputConfig) wantsLogs() bool {
+	return oc.Logs == nil || *oc.Logs
+}
+
+func (oc *OutputConfig) wantsMetrics() bool {
+	return oc.Metrics == nil || *oc.Metrics
+}
+
+func (oc *OutputConfig) newOutput() Output {
+
+	switch oc.Type {
+	case "console":
+		c := NewConsoleOutput()
+		if oc.QueueSize > 0 {
+			c.QueueSize = oc.QueueSize
+		}
+		if oc.QueuePolicy != "" {
+			c.Policy = QueuePolicy(oc.QueuePolicy)
+		}
+		return c
+	case "pull":
+		p := NewPullOutput()
+		if oc.QueueSize > 0 {
+			p.MaxEntries = oc.QueueSize
+		}
+		return p
+	case "file":
+		f := NewFileOutput(oc.Path, oc.Format)
+		f.MaxSize = oc.MaxSize
+		f.MaxAge, _ = time.ParseDuration(oc.MaxAge)
+		f.MaxFiles = oc.MaxFiles
+		return f
+	case "elastic":
+		e := NewElasticOutput(oc.URL)
+		if oc.Index != "" {
+			e.Index = oc.Index
+		}
+		e.Username = oc.Username
+		e.Password = oc.Password
+		e.APIKey = oc.APIKey
+		e.FlushInterval, _ = time.ParseDuration(oc.FlushInterval)
+		e.BatchSize = oc.BatchSize
+		e.MaxBuffer = oc.MaxBuffer
+		if oc.QueuePolicy != "" {
+			e.Policy = QueuePolicy(oc.QueuePolicy)
+		}
+		return e
+	}
+
+	return nil
+}
+
+func relativeTo(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func splitList(s string) []string {
+	output := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			output = append(output, v)
+		}
+	}
+	return output
+}
@@ -0,0 +1,339 @@
+package rpt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// withEnv runs f with only the RPT_* environment variables in env set,
+// restoring the environment afterwards.
+func withEnv(env map[string]string, f func()) {
+
+	saved := map[string]string{}
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if strings.HasPrefix(parts[0], "RPT_") {
+			saved[parts[0]] = parts[1]
+			os.Unsetenv(parts[0])
+		}
+	}
+	defer func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+		for k, v := range saved {
+			os.Setenv(k, v)
+		}
+	}()
+
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	f()
+}
+
+// validConfig returns a Config that passes validation.
+func validConfig() *Config {
+	c := NewConfig()
+	for _, cc := range []*ClientConfig{&c.Primary, &c.Secondary} {
+		cc.Host = "localhost"
+		cc.User = "postgres"
+		cc.Password = "secret"
+	}
+	return c
+}
+
+func TestLoadConfig(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rpt-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	seed := filepath.Join(dir, "seed.json")
+	if err := ioutil.WriteFile(seed, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const clients = `
+primary:
+  host: primary.local
+  user: postgres
+  password: secret
+secondary:
+  host: secondary.local
+  user: postgres
+  password: secret
+`
+
+	tests := []struct {
+		name     string
+		file     string // relative to dir, empty for no config file
+		content  string
+		env      map[string]string
+		check    func(t *testing.T, c *Config)
+		problems []string // all of them, for a *ConfigError
+		wantErr  bool     // any other error
+	}{
+		{
+			name:    "yaml",
+			file:    "rpt.yaml",
+			content: clients + "log_level: debug\nseed_files: [seed.json]\napi:\n  enabled: true\n",
+			check: func(t *testing.T, c *Config) {
+				if c.Primary.Host != "primary.local" || c.Primary.Port != 5432 || c.Primary.SSLMode != "disable" {
+					t.Errorf("primary = %+v, want the file over the defaults", c.Primary)
+				}
+				if c.LogLevel != "DEBUG" {
+					t.Errorf("log level = %q, want DEBUG", c.LogLevel)
+				}
+				if !reflect.DeepEqual(c.SeedFiles, []string{seed}) {
+					t.Errorf("seed files = %q, want %q relative to the config file", c.SeedFiles, seed)
+				}
+				if !c.API.Enabled || c.API.BasePath != "/api" {
+					t.Errorf("api = %+v, want enabled with the default base path", c.API)
+				}
+			},
+		},
+		{
+			name:    "json",
+			file:    "rpt.json",
+			content: `{"primary":{"host":"p","user":"u","password":"pw"},"secondary":{"host":"s","user":"u","password":"pw","port":6432}}`,
+			check: func(t *testing.T, c *Config) {
+				if c.Secondary.Host != "s" || c.Secondary.Port != 6432 {
+					t.Errorf("secondary = %+v", c.Secondary)
+				}
+			},
+		},
+		{
+			name:    "environment overrides the file",
+			file:    "rpt.yaml",
+			content: clients,
+			env: map[string]string{
+				"RPT_PRIMARY_HOST":       "postgres:db1",
+				"RPT_PRIMARY_PORT":       "6543",
+				"RPT_SECONDARY_PASS":     "other",
+				"RPT_API":                "true",
+				"RPT_API_TOKEN":          "changeme",
+				"RPT_API_RATE_LIMIT":     "2.5",
+				"RPT_API_MAX_BODY_BYTES": "1024",
+				"RPT_CONTINUOUS":         "false",
+			},
+			check: func(t *testing.T, c *Config) {
+				if c.Primary.Host != "db1" || c.Primary.Port != 6543 {
+					t.Errorf("primary = %+v, want db1:6543", c.Primary)
+				}
+				if c.Secondary.Host != "secondary.local" || c.Secondary.Password != "other" {
+					t.Errorf("secondary = %+v, want the file's host and the environment's password", c.Secondary)
+				}
+				if !c.API.Enabled || !c.API.Auth.Enabled || len(c.API.Auth.Tokens) != 1 || c.API.Auth.Tokens[0].Role != string(RoleAdmin) {
+					t.Errorf("api = %+v, want enabled with an admin token", c.API)
+				}
+				if c.API.RateLimit != 2.5 || c.API.MaxBodyBytes != 1024 {
+					t.Errorf("api limits = %v requests a second, %d bytes", c.API.RateLimit, c.API.MaxBodyBytes)
+				}
+				if c.Continuous {
+					t.Error("continuous is still on")
+				}
+			},
+		},
+		{
+			name: "environment only",
+			env: map[string]string{
+				"RPT_PRIMARY_HOST":   "p",
+				"RPT_PRIMARY_USER":   "u",
+				"RPT_PRIMARY_PASS":   "pw",
+				"RPT_SECONDARY_HOST": "s",
+				"RPT_SECONDARY_USER": "u",
+				"RPT_SECONDARY_PASS": "pw",
+			},
+		},
+		{
+			name:    "every problem is reported",
+			file:    "rpt.yaml",
+			content: "primary:\n  host: p\n  user: u\n  password: pw\n  sslmode: sometimes\nlog_level: loud\nshutdown_timeout: soon\noutputs:\n  - type: file\n  - type: syslog\n",
+			env:     map[string]string{"RPT_SECONDARY_PORT": "x", "RPT_API": "maybe"},
+			problems: []string{
+				"RPT_SECONDARY_PORT: \"x\" is not a number",
+				"RPT_API: \"maybe\" is not a boolean",
+				"primary.sslmode: \"sometimes\" is not a valid SSL mode",
+				"secondary.host: required",
+				"secondary.user: required",
+				"secondary.password: required",
+				"log_level: \"LOUD\" must be one of DEBUG, INFO, WARN, ERROR",
+				"shutdown_timeout: \"soon\" is not a valid duration",
+				"outputs[0].path: required for file outputs",
+				"outputs[1].type: \"syslog\" must be one of console, file, pull, elastic",
+			},
+		},
+		{name: "unknown field", file: "rpt.yaml", content: clients + "primry: {}\n", wantErr: true},
+		{name: "bad json", file: "rpt.json", content: `{"primary":`, wantErr: true},
+		{name: "unsupported file type", file: "rpt.toml", content: "", wantErr: true},
+		{name: "missing file", file: "missing.yaml", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			path := ""
+			if tt.file != "" {
+				path = filepath.Join(dir, tt.file)
+				if tt.content != "" {
+					if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			var c *Config
+			var err error
+			withEnv(tt.env, func() {
+				c, err = LoadConfig(path)
+			})
+
+			ce, isConfigError := err.(*ConfigError)
+			switch {
+			case tt.wantErr:
+				if err == nil || isConfigError {
+					t.Fatalf("error = %v, want a file error", err)
+				}
+				return
+			case tt.problems != nil:
+				if !isConfigError {
+					t.Fatalf("error = %v, want a *ConfigError", err)
+				}
+				if !reflect.DeepEqual(ce.Problems, tt.problems) {
+					t.Errorf("problems =\n%s\nwant\n%s", strings.Join(ce.Problems, "\n"), strings.Join(tt.problems, "\n"))
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+
+			if tt.check != nil {
+				tt.check(t, c)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		change   func(c *Config)
+		problems []string
+	}{
+		{"defaults with clients", func(c *Config) {}, nil},
+		{
+			"api", func(c *Config) {
+				c.API.Enabled = true
+				c.API.BasePath = "api"
+				c.API.ListenAddr = ""
+				c.API.IdempotencyWindow = "-1h"
+				c.API.RateLimit = 1
+				c.API.RateBurst = 0
+			},
+			[]string{
+				"api.listen_addr: required when the API is enabled",
+				"api.base_path: \"api\" must start with /",
+				"api.idempotency_window: \"-1h\" is not a valid duration",
+				"api.rate_burst: 0 must be at least 1",
+			},
+		},
+		{
+			"api settings are ignored while it is disabled", func(c *Config) {
+				c.API.BasePath = "api"
+				c.API.RateLimit = -1
+			},
+			nil,
+		},
+		{
+			"auth", func(c *Config) {
+				c.API.Enabled = true
+				c.API.Auth.Enabled = true
+				c.API.Auth.Tokens = []APITokenConfig{{Name: "ci", Role: "owner"}}
+				c.API.Auth.ClientCerts = []APIClientCertConfig{{Subject: "ui", Role: "read"}}
+			},
+			[]string{
+				"api.auth.tokens[0].token: required",
+				"api.auth.tokens[0].role: \"owner\" must be one of read, write, admin",
+				"api.auth.client_certs: needs api.tls.client_ca_file to verify client certificates",
+			},
+		},
+		{
+			"auth needs a caller", func(c *Config) {
+				c.API.Enabled = true
+				c.API.Auth.Enabled = true
+			},
+			[]string{"api.auth: at least one token or client certificate is required when authentication is enabled"},
+		},
+		{
+			"tls", func(c *Config) {
+				c.API.Enabled = true
+				c.API.TLS.CertFile = "/nonexistent/server.crt"
+				c.API.TLS.ClientAuth = "require"
+			},
+			[]string{
+				"api.tls: cert_file and key_file are both required",
+				"api.tls.cert_file: stat /nonexistent/server.crt: no such file or directory",
+				"api.tls.client_auth: \"require\" needs client_ca_file",
+			},
+		},
+		{
+			"tracing", func(c *Config) {
+				c.Tracing.Enabled = true
+				c.Tracing.Endpoint = "localhost:4318"
+				c.Tracing.ServiceName = ""
+			},
+			[]string{
+				"tracing.endpoint: \"localhost:4318\" must be an http or https URL",
+				"tracing.service_name: required when tracing is enabled",
+			},
+		},
+		{
+			"outputs", func(c *Config) {
+				c.Outputs = []OutputConfig{
+					{Type: "file", Path: "rpt.log", Format: "xml", MaxAge: "daily"},
+					{Type: "elastic", URL: "ftp://localhost", QueuePolicy: "spill"},
+					{Type: "console", QueueSize: -1},
+				}
+			},
+			[]string{
+				"outputs[0].format: \"xml\" must be one of json, text, csv",
+				"outputs[0].max_age: \"daily\" is not a valid duration",
+				"outputs[1].queue_policy: \"spill\" must be one of block, drop",
+				"outputs[1].url: \"ftp://localhost\" must be an http or https URL",
+				"outputs[2].queue_size: must not be negative",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			c := validConfig()
+			tt.change(c)
+
+			err := c.Validate()
+			if tt.problems == nil {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+
+			ce, ok := err.(*ConfigError)
+			if !ok {
+				t.Fatalf("Validate() = %v, want a *ConfigError", err)
+			}
+			if !reflect.DeepEqual(ce.Problems, tt.problems) {
+				t.Errorf("problems =\n%s\nwant\n%s", strings.Join(ce.Problems, "\n"), strings.Join(tt.problems, "\n"))
+			}
+		})
+	}
+}
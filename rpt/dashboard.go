@@ -0,0 +1,515 @@
+package rpt
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+)
+
+/*
+
+The dashboard is a single page served at GET /dashboard that drives the API
+from a browser. It lists recent operation sets (GET /operations) with the
+output of each operation (GET /operation/{id}), lists the configured
+workflows and runs them (GET /workflow, POST /workflow/run), and has forms to
+seed the primary (POST /data/seed) and query either client (POST /query).
+
+Lag and latency are charted by polling GET /metrics, which is written by the
+Prometheus metric output: replication lag from the rpt_replication_lag_*
+gauges, and mean operation and API request latency from the change in the
+_sum and _count of the rpt_*_duration_seconds histograms between polls. The
+charts only cover the time the page has been open.
+
+The page itself needs no authentication. When the API has it, the bearer
+token entered on the page is kept in the browser's local storage and sent
+with every request the page makes.
+
+*/
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(dashboardHTML))
+
+// dashboardCSP keeps the page to its own inline script and style and to
+// requests back to the API.
+const dashboardCSP = "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'; img-src 'self' data:; frame-ancestors 'none'; base-uri 'none'; form-action 'none'"
+
+func (a *APIServer) HandleDashboard(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleDashboard %s %s", r.Method, r.URL.Path)
+
+	b := &bytes.Buffer{}
+	if err := dashboardTemplate.Execute(b, a.BasePath); err != nil {
+		a.log.Errorf("Unable to render the dashboard: %s", err)
+		writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Unable to render the dashboard", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", dashboardCSP)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-store")
+
+	_, err := w.Write(b.Bytes())
+	if err != nil {
+		a.log.Errorf("Unable to write response: %s", err)
+	}
+}
+
+// The base path is passed in through data-base rather than into the script,
+// so the template has nothing to escape inside it.
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>rpt</title>
+<style>
+body { font: 14px/1.4 system-ui, sans-serif; margin: 0; color: #222; background: #f6f7f9; }
+header { display: flex; align-items: center; gap: 1em; padding: .6em 1em; background: #243447; color: #fff; }
+header h1 { font-size: 1.2em; margin: 0; }
+header .spacer { flex: 1; }
+header input { width: 16em; }
+main { display: grid; grid-template-columns: minmax(0, 3fr) minmax(0, 2fr); gap: 1em; padding: 1em; }
+section { background: #fff; border: 1px solid #dde1e6; border-radius: 4px; padding: .8em 1em; }
+section h2 { font-size: 1em; margin: 0 0 .6em; }
+.wide { grid-column: 1 / -1; }
+.charts { display: grid; grid-template-columns: repeat(3, minmax(0, 1fr)); gap: 1em; }
+.chart h3 { font-size: .9em; font-weight: normal; margin: 0 0 .3em; }
+.chart svg { width: 100%; height: 140px; background: #fafbfc; border: 1px solid #eee; }
+.legend span { margin-right: 1em; font-size: .85em; }
+table { width: 100%; border-collapse: collapse; }
+th, td { text-align: left; padding: .25em .4em; border-bottom: 1px solid #eee; vertical-align: top; }
+tbody tr.set { cursor: pointer; }
+tbody tr.set:hover, tbody tr.selected { background: #eef3fb; }
+code, pre, textarea { font: 12px/1.4 ui-monospace, monospace; }
+pre { background: #fafbfc; border: 1px solid #eee; padding: .5em; overflow: auto; max-height: 20em; margin: .3em 0 .8em; }
+form { display: grid; gap: .4em; margin-bottom: 1em; }
+form label { display: grid; gap: .1em; font-size: .9em; }
+form .row { display: flex; gap: .6em; align-items: center; }
+textarea { width: 100%; box-sizing: border-box; min-height: 6em; }
+button { cursor: pointer; }
+.status { font-size: .85em; padding: .05em .4em; border-radius: 3px; background: #e5e7ea; }
+.status.done { background: #d6f0dc; }
+.status.failed { background: #f8d7da; }
+.muted { color: #778; }
+#message { min-height: 1.4em; }
+#message.error { color: #b00020; }
+</style>
+</head>
+<body data-base="{{.}}">
+<header>
+	<h1>rpt</h1>
+	<span>state: <strong id="state">?</strong></span>
+	<span class="spacer"></span>
+	<label>Token <input id="token" type="password" autocomplete="off" placeholder="only if the API uses auth"></label>
+	<button id="save-token">Save</button>
+</header>
+<main>
+	<section class="wide">
+		<h2>Metrics</h2>
+		<div class="charts">
+			<div class="chart"><h3>Replication lag (seconds)</h3><svg id="chart-lag-seconds" viewBox="0 0 300 140" preserveAspectRatio="none"></svg><div class="legend" id="legend-lag-seconds"></div></div>
+			<div class="chart"><h3>Replication lag (bytes)</h3><svg id="chart-lag-bytes" viewBox="0 0 300 140" preserveAspectRatio="none"></svg><div class="legend" id="legend-lag-bytes"></div></div>
+			<div class="chart"><h3>Mean latency (seconds)</h3><svg id="chart-latency" viewBox="0 0 300 140" preserveAspectRatio="none"></svg><div class="legend" id="legend-latency"></div></div>
+		</div>
+	</section>
+
+	<section>
+		<h2>Operation sets <button id="refresh">Refresh</button></h2>
+		<table>
+			<thead><tr><th>Created</th><th>Workflow</th><th>Operations</th><th>Status</th></tr></thead>
+			<tbody id="sets"></tbody>
+		</table>
+		<div id="detail"></div>
+	</section>
+
+	<div>
+		<section>
+			<h2>Workflows</h2>
+			<table>
+				<thead><tr><th>Name</th><th>Steps</th><th></th></tr></thead>
+				<tbody id="workflows"></tbody>
+			</table>
+		</section>
+
+		<section>
+			<h2>Run</h2>
+			<div id="message"></div>
+
+			<form id="query-form">
+				<strong>Query</strong>
+				<label>Name <input name="set-name"></label>
+				<label>SQL <textarea name="sql" required></textarea></label>
+				<div class="row">
+					<label>Client <select name="client"><option value="primary">primary</option><option value="secondary">secondary</option></select></label>
+					<label class="row"><input type="checkbox" name="wait"> wait for the result</label>
+					<button type="submit">Query</button>
+				</div>
+			</form>
+
+			<form id="seed-form">
+				<strong>Seed the primary</strong>
+				<label>Data set (JSON, as in a seed file) <textarea name="data" required>{"Name": "", "Tables": {}}</textarea></label>
+				<div class="row"><button type="submit">Seed</button></div>
+			</form>
+
+			<form id="workflow-form">
+				<strong>Workflow</strong>
+				<label>Workflow (JSON; data files are relative to the server's data directory) <textarea name="workflow" required>{"Name": "", "Steps": []}</textarea></label>
+				<div class="row"><button type="submit">Run workflow</button></div>
+			</form>
+		</section>
+	</div>
+</main>
+<script>
+"use strict";
+
+var base = document.body.getAttribute("data-base");
+var tokenKey = "rpt.token";
+var pollInterval = 5000;
+var maxPoints = 120;
+var colors = ["#1f77b4", "#d62728", "#2ca02c", "#ff7f0e", "#9467bd"];
+
+var selected = "";
+var series = { lagSeconds: {}, lagBytes: {}, latency: {} };
+var lastTotals = null;
+
+function $(id) { return document.getElementById(id); }
+
+function el(tag, text, cls) {
+	var e = document.createElement(tag);
+	if (text !== undefined && text !== null) { e.textContent = String(text); }
+	if (cls) { e.className = cls; }
+	return e;
+}
+
+function api(method, path, body) {
+	var headers = { "Accept": "application/json" };
+	var token = localStorage.getItem(tokenKey);
+	if (token) { headers["Authorization"] = "Bearer " + token; }
+	var init = { method: method, headers: headers };
+	if (body !== undefined) {
+		headers["Content-Type"] = "application/json";
+		init.body = typeof body === "string" ? body : JSON.stringify(body);
+	}
+	return fetch(base + "/" + path, init).then(function (resp) {
+		return resp.text().then(function (text) {
+			var data = text;
+			if ((resp.headers.get("Content-Type") || "").indexOf("application/json") === 0 && text) {
+				data = JSON.parse(text);
+			}
+			if (!resp.ok) {
+				var msg = data && data.message ? data.message : resp.status + " " + resp.statusText;
+				throw new Error(msg);
+			}
+			return { status: resp.status, data: data };
+		});
+	});
+}
+
+function showMessage(text, isError) {
+	var m = $("message");
+	m.textContent = text;
+	m.className = isError ? "error" : "";
+}
+
+function statusBadge(done, failed) {
+	if (failed) { return el("span", "failed", "status failed"); }
+	if (done) { return el("span", "done", "status done"); }
+	return el("span", "running", "status");
+}
+
+// STATE
+
+function loadState() {
+	return api("GET", "state").then(function (r) {
+		$("state").textContent = r.data.State || "?";
+	}).catch(function (e) {
+		$("state").textContent = e.message;
+	});
+}
+
+// OPERATION SETS
+
+function loadSets() {
+	return api("GET", "operations?limit=50").then(function (r) {
+		var body = $("sets");
+		body.textContent = "";
+		var sets = r.data.OperationSets || [];
+		if (sets.length === 0) {
+			var tr = el("tr");
+			var td = el("td", "No operation sets yet", "muted");
+			td.colSpan = 4;
+			tr.appendChild(td);
+			body.appendChild(tr);
+		}
+		sets.forEach(function (s) {
+			var tr = el("tr", null, s.ID === selected ? "set selected" : "set");
+			tr.appendChild(el("td", new Date(s.Created).toLocaleTimeString()));
+			tr.appendChild(el("td", s.Workflow || "-"));
+			tr.appendChild(el("td", s.Operations.map(function (o) { return o.Name; }).join(", ")));
+			var td = el("td");
+			td.appendChild(statusBadge(s.Done, s.Failed));
+			tr.appendChild(td);
+			tr.addEventListener("click", function () {
+				selected = s.ID;
+				loadSets();
+			});
+			body.appendChild(tr);
+			if (s.ID === selected) { showSet(s); }
+		});
+	}).catch(function (e) {
+		showMessage("Unable to list operation sets: " + e.message, true);
+	});
+}
+
+function showSet(s) {
+	return api("GET", "operation/" + encodeURIComponent(s.ID)).then(function (r) {
+		var detail = $("detail");
+		detail.textContent = "";
+		var h = el("h2", "Operation set ");
+		h.appendChild(el("code", s.ID));
+		detail.appendChild(h);
+		s.Operations.forEach(function (o) {
+			var out = (r.data.Operations || {})[o.ID] || {};
+			var p = el("div");
+			p.appendChild(el("strong", o.Name + " "));
+			p.appendChild(statusBadge(o.Done, o.Failed));
+			if (out.Duration) { p.appendChild(el("span", " " + out.Duration, "muted")); }
+			p.appendChild(el("div", o.ID, "muted"));
+			detail.appendChild(p);
+			detail.appendChild(el("pre", JSON.stringify(out.Output, null, 2)));
+		});
+	}).catch(function (e) {
+		$("detail").textContent = "Unable to load " + s.ID + ": " + e.message;
+	});
+}
+
+// WORKFLOWS
+
+function loadWorkflows() {
+	return api("GET", "workflow").then(function (r) {
+		var body = $("workflows");
+		body.textContent = "";
+		var workflows = r.data.Workflows || [];
+		if (workflows.length === 0) {
+			var tr = el("tr");
+			var td = el("td", "No workflows are configured", "muted");
+			td.colSpan = 3;
+			tr.appendChild(td);
+			body.appendChild(tr);
+		}
+		workflows.forEach(function (wf) {
+			var tr = el("tr");
+			tr.appendChild(el("td", wf.Name));
+			tr.appendChild(el("td", (wf.Steps || []).map(function (s) { return s.Name || s.Operation; }).join(", ")));
+			var td = el("td");
+			var run = el("button", "Run");
+			run.addEventListener("click", function () { runWorkflow({ Name: wf.Name }); });
+			var edit = el("button", "Edit");
+			edit.addEventListener("click", function () {
+				document.querySelector("#workflow-form textarea").value = JSON.stringify(wf, null, 2);
+			});
+			td.appendChild(run);
+			td.appendChild(edit);
+			tr.appendChild(td);
+			body.appendChild(tr);
+		});
+	}).catch(function (e) {
+		showMessage("Unable to list workflows: " + e.message, true);
+	});
+}
+
+function runWorkflow(wf) {
+	return submitted(api("POST", "workflow/run", wf), "Workflow " + wf.Name);
+}
+
+// FORMS
+
+// submitted reports the outcome of a request that queued an operation set and
+// selects the set.
+function submitted(p, what) {
+	showMessage(what + ": sending...", false);
+	return p.then(function (r) {
+		var id = r.data.ID;
+		showMessage(what + (r.status === 202 ? " queued as " : " finished as ") + id, false);
+		selected = id;
+		return loadSets();
+	}).catch(function (e) {
+		showMessage(what + ": " + e.message, true);
+	});
+}
+
+function parseJSON(text, what) {
+	try {
+		return JSON.parse(text);
+	} catch (e) {
+		showMessage(what + " is not valid JSON: " + e.message, true);
+		return null;
+	}
+}
+
+$("query-form").addEventListener("submit", function (ev) {
+	ev.preventDefault();
+	var f = ev.target.elements;
+	var client = f.namedItem("client").value;
+	var path = "query?target=" + encodeURIComponent(client);
+	if (f.namedItem("wait").checked) { path += "&wait=true&timeout=30s"; }
+	submitted(api("POST", path, { Name: f.namedItem("set-name").value, Query: f.namedItem("sql").value }), "Query on " + client);
+});
+
+$("seed-form").addEventListener("submit", function (ev) {
+	ev.preventDefault();
+	var ds = parseJSON(ev.target.elements.namedItem("data").value, "The data set");
+	if (ds) { submitted(api("POST", "data/seed", ds), "Seed"); }
+});
+
+$("workflow-form").addEventListener("submit", function (ev) {
+	ev.preventDefault();
+	var wf = parseJSON(ev.target.elements.namedItem("workflow").value, "The workflow");
+	if (wf) { runWorkflow(wf); }
+});
+
+// METRICS
+
+// parseMetrics reads the Prometheus text format into samples of name, labels
+// and value.
+function parseMetrics(text) {
+	var samples = [];
+	text.split("\n").forEach(function (line) {
+		if (!line || line.charAt(0) === "#") { return; }
+		var sp = line.lastIndexOf(" ");
+		var key = line.slice(0, sp);
+		var value = parseFloat(line.slice(sp + 1));
+		var brace = key.indexOf("{");
+		var name = brace < 0 ? key : key.slice(0, brace);
+		var labels = brace < 0 ? "" : key.slice(brace + 1, key.length - 1);
+		samples.push({ name: name, labels: labels, value: value });
+	});
+	return samples;
+}
+
+function label(labels, key) {
+	var i = labels.indexOf(key + "=\"");
+	if (i < 0) { return ""; }
+	var start = i + key.length + 2;
+	return labels.slice(start, labels.indexOf("\"", start));
+}
+
+function addPoint(group, name, t, v) {
+	var s = group[name] || (group[name] = []);
+	s.push({ t: t, v: v });
+	if (s.length > maxPoints) { s.shift(); }
+}
+
+function sampleMetrics() {
+	return api("GET", "metrics").then(function (r) {
+		var now = Date.now();
+		var lagSeconds = {}, lagBytes = {};
+		var totals = { operationSum: 0, operationCount: 0, apiSum: 0, apiCount: 0 };
+
+		parseMetrics(r.data).forEach(function (m) {
+			var who = label(m.labels, "workflow") || label(m.labels, "client") || "lag";
+			switch (m.name) {
+			case "rpt_replication_lag_seconds":
+				lagSeconds[who] = Math.max(lagSeconds[who] || 0, m.value);
+				break;
+			case "rpt_replication_lag_bytes":
+				lagBytes[who] = Math.max(lagBytes[who] || 0, m.value);
+				break;
+			case "rpt_operation_duration_seconds_sum": totals.operationSum += m.value; break;
+			case "rpt_operation_duration_seconds_count": totals.operationCount += m.value; break;
+			case "rpt_api_request_duration_seconds_sum": totals.apiSum += m.value; break;
+			case "rpt_api_request_duration_seconds_count": totals.apiCount += m.value; break;
+			}
+		});
+
+		Object.keys(lagSeconds).forEach(function (k) { addPoint(series.lagSeconds, k, now, lagSeconds[k]); });
+		Object.keys(lagBytes).forEach(function (k) { addPoint(series.lagBytes, k, now, lagBytes[k]); });
+
+		// Latency is the mean of the observations made since the last poll.
+		if (lastTotals) {
+			var ops = totals.operationCount - lastTotals.operationCount;
+			var reqs = totals.apiCount - lastTotals.apiCount;
+			addPoint(series.latency, "operations", now, ops > 0 ? (totals.operationSum - lastTotals.operationSum) / ops : 0);
+			addPoint(series.latency, "API requests", now, reqs > 0 ? (totals.apiSum - lastTotals.apiSum) / reqs : 0);
+		}
+		lastTotals = totals;
+
+		drawChart("lag-seconds", series.lagSeconds);
+		drawChart("lag-bytes", series.lagBytes);
+		drawChart("latency", series.latency);
+	}).catch(function (e) {
+		showMessage("Unable to read metrics: " + e.message, true);
+	});
+}
+
+function drawChart(id, group) {
+	var svg = $("chart-" + id), legend = $("legend-" + id);
+	var ns = "http://www.w3.org/2000/svg";
+	var w = 300, h = 140, pad = 4;
+	svg.textContent = "";
+	legend.textContent = "";
+
+	var names = Object.keys(group).sort();
+	var t0 = Infinity, t1 = -Infinity, max = 0;
+	names.forEach(function (n) {
+		group[n].forEach(function (p) {
+			t0 = Math.min(t0, p.t);
+			t1 = Math.max(t1, p.t);
+			max = Math.max(max, p.v);
+		});
+	});
+	if (names.length === 0) {
+		legend.appendChild(el("span", "No samples yet", "muted"));
+		return;
+	}
+	if (max === 0) { max = 1; }
+	var span = Math.max(t1 - t0, 1);
+
+	names.forEach(function (n, i) {
+		var color = colors[i % colors.length];
+		var points = group[n].map(function (p) {
+			var x = pad + (p.t - t0) / span * (w - 2 * pad);
+			var y = h - pad - p.v / max * (h - 2 * pad);
+			return x.toFixed(1) + "," + y.toFixed(1);
+		});
+		var line = document.createElementNS(ns, "polyline");
+		line.setAttribute("points", points.join(" "));
+		line.setAttribute("fill", "none");
+		line.setAttribute("stroke", color);
+		line.setAttribute("stroke-width", "1.5");
+		line.setAttribute("vector-effect", "non-scaling-stroke");
+		svg.appendChild(line);
+
+		var last = group[n][group[n].length - 1].v;
+		var item = el("span", n + ": " + +last.toPrecision(4));
+		item.style.color = color;
+		legend.appendChild(item);
+	});
+	legend.appendChild(el("span", "max " + +max.toPrecision(4), "muted"));
+}
+
+// START
+
+$("token").value = localStorage.getItem(tokenKey) || "";
+$("save-token").addEventListener("click", function () {
+	var t = $("token").value.trim();
+	if (t) { localStorage.setItem(tokenKey, t); } else { localStorage.removeItem(tokenKey); }
+	refresh();
+	loadWorkflows();
+});
+$("refresh").addEventListener("click", function () { refresh(); });
+
+function refresh() {
+	loadState();
+	loadSets();
+	sampleMetrics();
+}
+
+refresh();
+loadWorkflows();
+setInterval(refresh, pollInterval);
+</script>
+</body>
+</html>
+`
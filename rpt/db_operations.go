@@ -4,7 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -23,37 +23,122 @@ type DBOperation struct {
 	client    DBClient
 	result    interface{}
 	data      DataSet
+	labels    map[string]string
+	metrics   *MetricCollection
+	logger    *Logger
+	others    []DBClient   // clients used besides client, for tracing
+	mu        sync.RWMutex // guards started, completed, result and errors
 }
 
 func (dbo *DBOperation) Start() {
+	dbo.StartContext(context.Background())
+}
+
+// StartContext runs the operation in a span that is a child of the span in
+// ctx. Clients that trace their statements do so under the same span.
+func (dbo *DBOperation) StartContext(ctx context.Context) {
+	ctx, span := StartSpan(ctx, dbo.Name, SpanKindInternal)
+	defer span.End()
+
+	span.SetAttribute("rpt.operation.id", dbo.ID)
+	for k, v := range dbo.labels {
+		if v != "" && k != "operation" {
+			span.SetAttribute("rpt."+k, v)
+		}
+	}
+
+	for _, c := range append([]DBClient{dbo.client}, dbo.others...) {
+		if tc, ok := c.(tracedClient); ok {
+			tc.setContext(ctx)
+			defer tc.setContext(context.Background())
+		}
+	}
+
+	dbo.mu.Lock()
 	dbo.started = time.Now()
+	dbo.mu.Unlock()
 
 	res, err := dbo.operation(dbo.client, dbo.data)
+	span.SetError(err)
 
+	dbo.mu.Lock()
 	dbo.result = res
 	if err != nil {
 		dbo.errors = append(dbo.errors, err)
 	}
+	dbo.mu.Unlock()
 
 	d := dbo.Complete()
-	fmt.Printf("\nCompleted in %s\n", d)
+	dbo.recordMetrics()
+
+	if err != nil {
+		dbo.logger.Errorf("%s failed after %s: %s", dbo.Name, d, err)
+		return
+	}
+	dbo.logger.Infof("%s completed in %s", dbo.Name, d)
+}
+
+// recordMetrics records the outcome and duration of the operation, the
+// duration again as a summary so /metrics serves its p50, p95 and p99, and the
+// lag measured by ReplicationLag.
+func (dbo *DBOperation) recordMetrics() {
+
+	status := "success"
+	if dbo.Failed() {
+		status = "failure"
+	}
+
+	dbo.metrics.AddMetric(NewCounter("rpt_operations_total", labelsWith(dbo.labels, "status", status)).Inc())
+	dbo.metrics.AddMetric(NewHistogram("rpt_operation_duration_seconds", dbo.labels).ObserveDuration(dbo.Duration()))
+	dbo.metrics.AddMetric(NewSummary("rpt_operation_latency_seconds", dbo.labels).ObserveDuration(dbo.Duration()))
+
+	if lag, ok := dbo.Result().(*ReplicationLagResult); ok {
+		dbo.metrics.AddMetric(NewGauge("rpt_replication_lag_bytes", dbo.labels).Set(float64(lag.LagBytes)))
+		dbo.metrics.AddMetric(NewGauge("rpt_replication_lag_seconds", dbo.labels).Set(lag.LagSeconds))
+	}
+}
+
+// Metrics returns the metrics recorded by Start.
+func (dbo *DBOperation) Metrics() *MetricCollection {
+	return dbo.metrics
+}
+
+// SetLabel adds a label to every metric the operation records. operation is
+// always set; workflow and client are set when the operation is queued.
+func (dbo *DBOperation) SetLabel(key, value string) {
+	dbo.labels[key] = value
+}
+
+// SetLogger sets the Logger that Start reports to. Without one nothing is
+// logged.
+func (dbo *DBOperation) SetLogger(l *Logger) {
+	dbo.logger = l.With(Fields{FieldOperationID: dbo.ID})
 }
 
 func (dbo *DBOperation) Started() time.Time {
+	dbo.mu.RLock()
+	defer dbo.mu.RUnlock()
 	return dbo.started
 }
 
 func (dbo *DBOperation) Complete() time.Duration {
+	dbo.mu.Lock()
 	dbo.completed = time.Now()
+	dbo.mu.Unlock()
 	return dbo.Duration()
 }
 
 func (dbo *DBOperation) Completed() time.Time {
+	dbo.mu.RLock()
+	defer dbo.mu.RUnlock()
 	return dbo.completed
 }
 
 func (dbo *DBOperation) Duration() time.Duration {
 
+	dbo.mu.RLock()
+	defer dbo.mu.RUnlock()
+
 	if dbo.completed.Sub(dbo.started) <= 0 {
 		return 0
 	}
@@ -61,6 +146,24 @@ func (dbo *DBOperation) Duration() time.Duration {
 	return dbo.completed.Sub(dbo.started)
 }
 
+func (dbo *DBOperation) Result() interface{} {
+	dbo.mu.RLock()
+	defer dbo.mu.RUnlock()
+	return dbo.result
+}
+
+func (dbo *DBOperation) Errors() []error {
+	dbo.mu.RLock()
+	defer dbo.mu.RUnlock()
+	return append([]error{}, dbo.errors...)
+}
+
+func (dbo *DBOperation) Failed() bool {
+	dbo.mu.RLock()
+	defer dbo.mu.RUnlock()
+	return len(dbo.errors) > 0
+}
+
 func (dbo *DBOperation) GetData() DataSet {
 	return dbo.data
 }
@@ -68,8 +171,8 @@ func (dbo *DBOperation) GetData() DataSet {
 func (dbo *DBOperation) GetResult() []byte {
 
 	output := &map[string]interface{}{
-		"Result": dbo.result,
-		"Errors": dbo.errors,
+		"Result": dbo.Result(),
+		"Errors": dbo.Errors(),
 	}
 
 	outputJson, _ := json.MarshalIndent(output, "", "  ")
@@ -95,7 +198,11 @@ type DBOperationSet struct {
 	Operations      []*DBOperation
 	ctx             context.Context
 	ID              string
+	Workflow        string
+	created         time.Time
+	done            chan struct{} // closed once every operation has run
 	lookupOperation map[string]*DBOperation
+	onStep          func(i int, op *DBOperation) // called as each operation completes
 }
 
 func (dbos *DBOperationSet) GetOutputJSON() []byte {
@@ -124,9 +231,88 @@ func (dbos *DBOperationSet) GetOutputJSON() []byte {
 	return ToJSON(output)
 }
 
+// Start runs every operation in the set in order.
+func (dbos *DBOperationSet) Start() {
+	dbos.StartContext(context.Background())
+}
+
+// StartContext runs every operation in the set in order, in a span that is a
+// child of the span in ctx.
+func (dbos *DBOperationSet) StartContext(ctx context.Context) {
+	ctx, span := StartSpan(ctx, "operation_set", SpanKindInternal)
+	defer span.End()
+
+	span.SetAttribute("rpt.set_id", dbos.ID)
+	if dbos.Workflow != "" {
+		span.SetAttribute("rpt.workflow", dbos.Workflow)
+	}
+
+	for i, op := range dbos.Operations {
+		op.StartContext(ctx)
+		if dbos.onStep != nil {
+			dbos.onStep(i, op)
+		}
+	}
+
+	if dbos.Failed() {
+		span.SetError(fmt.Errorf("rpt: operation set %s failed", dbos.ID))
+	}
+
+	close(dbos.done)
+}
+
+// Done returns a channel that is closed once every operation in the set has
+// run.
+func (dbos *DBOperationSet) Done() <-chan struct{} {
+	return dbos.done
+}
+
+// Context returns the context the set was created with, which carries the
+// span of the request that queued it.
+func (dbos *DBOperationSet) Context() context.Context {
+	if dbos.ctx == nil {
+		return context.Background()
+	}
+	return dbos.ctx
+}
+
+// Created returns when the set was created.
+func (dbos *DBOperationSet) Created() time.Time {
+	return dbos.created
+}
+
+// Metrics returns the metrics recorded by every operation in the set.
+func (dbos *DBOperationSet) Metrics() *MetricCollection {
+	mc, _ := NewMetricCollection()
+	for _, op := range dbos.Operations {
+		mc.AddMetrics(op.Metrics())
+	}
+	return mc
+}
+
+func (dbos *DBOperationSet) Failed() bool {
+	for _, op := range dbos.Operations {
+		if op.Failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Completed reports whether every operation in the set has run.
+func (dbos *DBOperationSet) Completed() bool {
+	for _, op := range dbos.Operations {
+		if op.Completed().IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
 func (dbos *DBOperationSet) Cancel() {}
 
 func (dbos *DBOperationSet) AddOperation(dbo *DBOperation) {
+	dbo.SetLabel("workflow", dbos.Workflow)
 	dbos.lookupOperation[dbo.ID] = dbo
 	dbos.Operations = append(dbos.Operations, dbo)
 }
@@ -149,6 +335,37 @@ type DBClient interface {
 	Seed(d DataSet) (interface{}, error)
 	Query(s string) (interface{}, error)
 	ListDB() (interface{}, error)
+	ReplicationStatus() (*ReplicationStatus, error)
+}
+
+// tracedClient is implemented by clients that trace the statements they run.
+// DBOperation sets the context for the duration of the operation, so each
+// client must only run one operation at a time.
+type tracedClient interface {
+	setContext(ctx context.Context)
+}
+
+// ReplicationStatus is a point-in-time view of a client's replication position.
+// On a primary LSN is the current write position, on a standby it is the last
+// replayed position and ReplayDelay is the time since the last replayed
+// transaction.
+type ReplicationStatus struct {
+	InRecovery  bool
+	LSN         string
+	ReplayDelay time.Duration
+}
+
+type ReplicationLagResult struct {
+	Primary    *ReplicationStatus
+	Secondary  *ReplicationStatus
+	LagBytes   int64
+	LagSeconds float64
+}
+
+type CompareResult struct {
+	Match     bool
+	Primary   interface{}
+	Secondary interface{}
 }
 
 // OPERATION FUNCTIONS
@@ -156,6 +373,7 @@ type DBClient interface {
 func newDBOperation(n string, c DBClient, d DataSet, o func(db DBClient, data DataSet) (interface{}, error)) *DBOperation {
 
 	e := []error{}
+	mc, _ := NewMetricCollection()
 
 	dbo := &DBOperation{
 		result:    "",
@@ -168,11 +386,23 @@ func newDBOperation(n string, c DBClient, d DataSet, o func(db DBClient, data Da
 		operation: o,
 		data:      d,
 		ID:        NewGUID(),
+		labels:    map[string]string{"operation": n, "workflow": ""},
+		metrics:   mc,
 	}
 
 	return dbo
 }
 
+// NewDBOperationSet returns a set that runs ops in order, ready to queue
+// with RptClient.Queue.
+func NewDBOperationSet(ops ...*DBOperation) *DBOperationSet {
+	dbos := newDBOperationSet(nil)
+	for _, op := range ops {
+		dbos.AddOperation(op)
+	}
+	return dbos
+}
+
 func newDBOperationSet(ctx context.Context) *DBOperationSet {
 
 	lookup := &map[string]*DBOperation{}
@@ -180,6 +410,8 @@ func newDBOperationSet(ctx context.Context) *DBOperationSet {
 	return &DBOperationSet{
 		ID:              NewGUID(),
 		ctx:             ctx,
+		created:         time.Now(),
+		done:            make(chan struct{}),
 		Operations:      []*DBOperation{},
 		lookupOperation: *lookup,
 	}
@@ -254,20 +486,136 @@ func Query(client DBClient, data DataSet) *DBOperation {
 
 	dbo := newDBOperation("query", client, data, func(db DBClient, data DataSet) (interface{}, error) {
 
-		log.Println(string(ToJSON(data)))
+		q := DBQueryDataSet{}
+		_ = json.Unmarshal(ToJSON(data), &q)
+
+		res, err := db.Query(q.Query)
+		if err != nil {
+			return "", err
+		}
+
+		return res, nil
+	})
+
+	return dbo
+}
+
+func ConnectClient(client DBClient) *DBOperation {
+	return newDBOperation("connect_client", client, nil, func(db DBClient, data DataSet) (interface{}, error) {
+		return "", db.Connect()
+	})
+}
+
+func DisconnectClient(client DBClient) *DBOperation {
+	return newDBOperation("disconnect_client", client, nil, func(db DBClient, data DataSet) (interface{}, error) {
+		return "", db.Disconnect()
+	})
+}
+
+func ReconnectClient(client DBClient) *DBOperation {
+	return newDBOperation("reconnect_client", client, nil, func(db DBClient, data DataSet) (interface{}, error) {
+		return "", db.Reconnect()
+	})
+}
+
+// ReplicationLag measures how far the secondary is behind the primary, both in
+// WAL bytes and in time since the last replayed transaction. It fails if the
+// secondary is not a standby.
+func ReplicationLag(primary, secondary DBClient) *DBOperation {
+
+	dbo := newDBOperation("replication_lag", primary, nil, func(db DBClient, data DataSet) (interface{}, error) {
+
+		p, err := db.ReplicationStatus()
+		if err != nil {
+			return "", err
+		}
+
+		s, err := secondary.ReplicationStatus()
+		if err != nil {
+			return "", err
+		}
+		// A secondary that isn't in recovery reports its own write position,
+		// which says nothing about how far behind the primary it is.
+		if !s.InRecovery {
+			return "", fmt.Errorf("rpt: secondary is not in recovery, it is not replicating from the primary")
+		}
+
+		lag, err := lsnDiff(p.LSN, s.LSN)
+		if err != nil {
+			return "", err
+		}
+
+		return &ReplicationLagResult{
+			Primary:    p,
+			Secondary:  s,
+			LagBytes:   lag,
+			LagSeconds: s.ReplayDelay.Seconds(),
+		}, nil
+	})
+	dbo.others = []DBClient{secondary}
+
+	return dbo
+}
+
+// Compare runs the same query against both clients and fails if the results
+// differ.
+func Compare(primary, secondary DBClient, data DataSet) *DBOperation {
+
+	dbo := newDBOperation("compare", primary, data, func(db DBClient, data DataSet) (interface{}, error) {
 
 		q := DBQueryDataSet{}
 		_ = json.Unmarshal(ToJSON(data), &q)
 
-		log.Println(q)
+		p, err := db.Query(q.Query)
+		if err != nil {
+			return "", err
+		}
 
-		res, err := db.Query(q.Query)
+		s, err := secondary.Query(q.Query)
 		if err != nil {
 			return "", err
 		}
 
+		res := &CompareResult{
+			Match:     string(ToJSON(p)) == string(ToJSON(s)),
+			Primary:   p,
+			Secondary: s,
+		}
+
+		if !res.Match {
+			return res, fmt.Errorf("rpt: primary and secondary results differ")
+		}
+
 		return res, nil
 	})
+	dbo.others = []DBClient{secondary}
 
 	return dbo
 }
+
+// lsnDiff returns the number of bytes between two LSNs in the X/Y form.
+func lsnDiff(a, b string) (int64, error) {
+
+	la, err := parseLSN(a)
+	if err != nil {
+		return 0, err
+	}
+
+	lb, err := parseLSN(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(la - lb), nil
+}
+
+func parseLSN(lsn string) (uint64, error) {
+
+	var hi, lo uint32
+	_, err := fmt.Sscanf(lsn, "%X/%X", &hi, &lo)
+	if err != nil {
+		return 0, fmt.Errorf("rpt: invalid LSN %q", lsn)
+	}
+
+	return uint64(hi)<<32 | uint64(lo), nil
+}
@@ -0,0 +1,425 @@
+package rpt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+ElasticOutput batches log events and metrics and sends them to the _bulk API
+of an Elasticsearch or OpenSearch cluster.
+
+Documents are buffered and sent every FlushInterval, or as soon as BatchSize
+documents are waiting. While the cluster is unavailable the buffer is kept and
+retried with a backoff of up to maxElasticBackoff. Once MaxBuffer documents
+are waiting, Policy decides whether writers wait for the next successful
+flush or the oldest documents are dropped.
+
+Index is a pattern. {type} is replaced with "logs" or "metrics", and anything
+else in braces is a Go time layout applied to the document timestamp:
+
+	rpt-{type}-{2006.01.02}  ->  rpt-logs-2020.06.01
+
+*/
+
+const (
+	defaultElasticIndex         = "rpt-{type}-{2006.01.02}"
+	defaultElasticFlushInterval = 5 * time.Second
+	defaultElasticBatchSize     = 500
+	defaultElasticMaxBuffer     = 10000
+	maxElasticBackoff           = time.Minute
+)
+
+type ElasticOutput struct {
+	Description   string
+	URL           string
+	Index         string
+	Username      string
+	Password      string
+	APIKey        string
+	FlushInterval time.Duration
+	BatchSize     int
+	MaxBuffer     int
+	Policy        QueuePolicy
+	Client        *http.Client
+	mu            sync.Mutex
+	sent          *sync.Cond // signalled when documents leave the buffer
+	closed        bool
+	buffer        []*elasticDoc
+	dropped       int
+	flush         chan struct{}
+	done          chan struct{}
+	wg            sync.WaitGroup
+}
+
+// elasticDoc is a single bulk index action and its source.
+type elasticDoc struct {
+	index  string
+	source []byte
+}
+
+type elasticBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+func NewElasticOutput(url string) *ElasticOutput {
+	return &ElasticOutput{
+		Description:   "elastic_output",
+		URL:           url,
+		Index:         defaultElasticIndex,
+		FlushInterval: defaultElasticFlushInterval,
+		BatchSize:     defaultElasticBatchSize,
+		MaxBuffer:     defaultElasticMaxBuffer,
+		Policy:        QueueDrop,
+		Client:        &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (e *ElasticOutput) WriteLog(l *Log) {
+
+	docs := make([]*elasticDoc, 0, len(l.Events))
+	for _, le := range l.Events {
+		docs = append(docs, e.newDoc("logs", le.Time, map[string]interface{}{
+			"@timestamp": le.Time,
+			"type":       "log",
+			"level":      le.Level,
+			"message":    le.Description,
+			"log":        l.Description,
+			"fields":     le.Fields,
+		}))
+	}
+
+	e.add(docs)
+}
+
+func (e *ElasticOutput) WriteMetric(mc *MetricCollection) {
+
+	docs := make([]*elasticDoc, 0, len(mc.Metrics))
+	for _, m := range mc.Metrics {
+		var value interface{} = m.Value
+		if v, ok := metricFloat(m.Value); ok {
+			value = v
+		}
+		docs = append(docs, e.newDoc("metrics", m.Timestamp, map[string]interface{}{
+			"@timestamp": m.Timestamp,
+			"type":       "metric",
+			"kind":       m.Kind,
+			"name":       m.Label,
+			"value":      value,
+			"labels":     m.Labels,
+		}))
+	}
+
+	e.add(docs)
+}
+
+// Connect starts the flush loop. It does not wait for the cluster to be
+// reachable; anything written before then is buffered.
+func (e *ElasticOutput) Connect() error {
+
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("elastic output: url %q must be http or https", e.URL)
+	}
+
+	if e.Index == "" {
+		e.Index = defaultElasticIndex
+	}
+	if e.FlushInterval <= 0 {
+		e.FlushInterval = defaultElasticFlushInterval
+	}
+	if e.BatchSize <= 0 {
+		e.BatchSize = defaultElasticBatchSize
+	}
+	if e.MaxBuffer <= 0 {
+		e.MaxBuffer = defaultElasticMaxBuffer
+	}
+	if e.Client == nil {
+		e.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	e.sent = sync.NewCond(&e.mu)
+	e.flush = make(chan struct{}, 1)
+	e.done = make(chan struct{})
+
+	e.wg.Add(1)
+	go e.process()
+
+	return nil
+}
+
+// Done stops the flush loop after one last attempt to send the buffer.
+func (e *ElasticOutput) Done() {
+
+	if e.done == nil {
+		return
+	}
+
+	e.mu.Lock()
+	e.closed = true
+	e.sent.Broadcast()
+	e.mu.Unlock()
+
+	close(e.done)
+	e.wg.Wait()
+	e.done = nil
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.buffer) > 0 || e.dropped > 0 {
+		log.Printf("rpt: elastic output: %d documents were not indexed", len(e.buffer)+e.dropped)
+	}
+}
+
+func (e *ElasticOutput) GetDescription() string {
+	return e.Description
+}
+
+func (e *ElasticOutput) resetLogs() {}
+
+func (e *ElasticOutput) resetMetrics() {}
+
+func (e *ElasticOutput) pullLogs() *map[string]interface{} { return nil }
+
+func (e *ElasticOutput) pullMetrics() *map[string]interface{} { return nil }
+
+func (e *ElasticOutput) newDoc(docType string, t time.Time, source map[string]interface{}) *elasticDoc {
+	out, _ := json.Marshal(source)
+	return &elasticDoc{
+		index:  elasticIndex(e.Index, docType, t),
+		source: out,
+	}
+}
+
+func (e *ElasticOutput) add(docs []*elasticDoc) {
+
+	if len(docs) == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	for e.Policy == QueueBlock && e.sent != nil && !e.closed && len(e.buffer) > 0 && len(e.buffer)+len(docs) > e.MaxBuffer {
+		e.requestFlush()
+		e.sent.Wait()
+	}
+	e.buffer = append(e.buffer, docs...)
+	e.trim()
+	full := len(e.buffer) >= e.BatchSize
+	e.mu.Unlock()
+
+	if full {
+		e.requestFlush()
+	}
+}
+
+func (e *ElasticOutput) requestFlush() {
+	if e.flush == nil {
+		return
+	}
+	select {
+	case e.flush <- struct{}{}:
+	default:
+	}
+}
+
+// trim drops the oldest documents beyond MaxBuffer. The caller holds e.mu.
+func (e *ElasticOutput) trim() {
+	if e.MaxBuffer > 0 && len(e.buffer) > e.MaxBuffer {
+		n := len(e.buffer) - e.MaxBuffer
+		e.dropped += n
+		e.buffer = e.buffer[n:]
+		log.Printf("rpt: elastic output: buffer full, dropped %d documents", n)
+	}
+}
+
+func (e *ElasticOutput) process() {
+
+	defer e.wg.Done()
+
+	wait := e.FlushInterval
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			e.send()
+			return
+		case <-e.flush:
+		case <-timer.C:
+		}
+
+		if err := e.send(); err != nil {
+			wait *= 2
+			if wait > maxElasticBackoff {
+				wait = maxElasticBackoff
+			}
+			log.Printf("rpt: elastic output: %s, retrying in %s", err, wait)
+		} else {
+			wait = e.FlushInterval
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+// send posts batches until the buffer is empty. Documents that fail with a
+// retryable status go back to the front of the buffer.
+func (e *ElasticOutput) send() error {
+
+	for {
+		e.mu.Lock()
+		n := len(e.buffer)
+		if n > e.BatchSize {
+			n = e.BatchSize
+		}
+		batch := e.buffer[:n:n]
+		e.buffer = e.buffer[n:]
+		e.mu.Unlock()
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		retry, err := e.bulk(batch)
+
+		e.mu.Lock()
+		if len(retry) > 0 {
+			e.buffer = append(retry, e.buffer...)
+			e.trim()
+		}
+		if len(retry) < len(batch) {
+			e.sent.Broadcast()
+		}
+		e.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+		if len(retry) > 0 {
+			return fmt.Errorf("%d documents were rejected", len(retry))
+		}
+	}
+}
+
+// bulk sends one batch and returns the documents that should be retried.
+func (e *ElasticOutput) bulk(batch []*elasticDoc) ([]*elasticDoc, error) {
+
+	body := &bytes.Buffer{}
+	for _, d := range batch {
+		action, _ := json.Marshal(map[string]interface{}{
+			"index": map[string]string{"_index": d.index},
+		})
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(d.source)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(e.URL, "/")+"/_bulk", body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if e.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+e.APIKey)
+	} else if e.Username != "" {
+		req.SetBasicAuth(e.Username, e.Password)
+	}
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return batch, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return batch, fmt.Errorf("bulk request failed: %s", resp.Status)
+	}
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		log.Printf("rpt: elastic output: dropped %d documents: %s: %s", len(batch), resp.Status, msg)
+		return nil, nil
+	}
+
+	result := &elasticBulkResponse{}
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil || !result.Errors {
+		return nil, nil
+	}
+
+	retry := []*elasticDoc{}
+	for i, item := range result.Items {
+		if i >= len(batch) {
+			break
+		}
+		for _, r := range item {
+			switch {
+			case r.Status == http.StatusTooManyRequests || r.Status >= 500:
+				retry = append(retry, batch[i])
+			case r.Status >= 300:
+				log.Printf("rpt: elastic output: dropped document for %s: %s", batch[i].index, r.Error)
+			}
+		}
+	}
+
+	return retry, nil
+}
+
+func elasticIndex(pattern, docType string, t time.Time) string {
+
+	b := &strings.Builder{}
+
+	for {
+		start := strings.IndexByte(pattern, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(pattern[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+
+		b.WriteString(pattern[:start])
+		token := pattern[start+1 : end]
+		if token == "type" {
+			b.WriteString(docType)
+		} else {
+			b.WriteString(t.UTC().Format(token))
+		}
+		pattern = pattern[end+1:]
+	}
+
+	b.WriteString(pattern)
+
+	// Index names must be lowercase.
+	return strings.ToLower(b.String())
+}
@@ -0,0 +1,297 @@
+package rpt
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bulkServer stands in for the _bulk API of a cluster. reply decides the
+// response to the nth request, counting from 0; the documents of requests
+// answered with 200 and no item errors are recorded as indexed.
+type bulkServer struct {
+	*httptest.Server
+	reply func(n int, docs int) (int, string)
+
+	mu       sync.Mutex
+	requests int
+	batches  []int
+	indexed  []string // index of each indexed document
+	auth     []string
+}
+
+func newBulkServer(reply func(n int, docs int) (int, string)) *bulkServer {
+
+	b := &bulkServer{reply: reply}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.handle))
+
+	return b
+}
+
+func (b *bulkServer) handle(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost || r.URL.Path != "/_bulk" {
+		http.NotFound(w, r)
+		return
+	}
+
+	indices := []string{}
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		action := map[string]map[string]string{}
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		indices = append(indices, action["index"]["_index"])
+		scanner.Scan() // the document source
+	}
+
+	b.mu.Lock()
+	n := b.requests
+	b.requests++
+	b.auth = append(b.auth, r.Header.Get("Authorization"))
+	b.mu.Unlock()
+
+	status, body := http.StatusOK, `{"errors":false}`
+	if b.reply != nil {
+		status, body = b.reply(n, len(indices))
+	}
+
+	if status == http.StatusOK && !strings.Contains(body, `"errors":true`) {
+		b.mu.Lock()
+		b.batches = append(b.batches, len(indices))
+		b.indexed = append(b.indexed, indices...)
+		b.mu.Unlock()
+	}
+
+	w.WriteHeader(status)
+	fmt.Fprint(w, body)
+}
+
+// waitIndexed waits until n documents have been indexed.
+func (b *bulkServer) waitIndexed(t *testing.T, n int) {
+
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		got := len(b.indexed)
+		b.mu.Unlock()
+		if got >= n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d documents to be indexed", n)
+}
+
+func testLog(events int) *Log {
+	l := NewLog("INFO", "test_log")
+	for i := 0; i < events; i++ {
+		l.Infof("event %d", i)
+	}
+	return l
+}
+
+func TestElasticOutputBulk(t *testing.T) {
+
+	itemErrors := func(status int, docs int) string {
+		items := make([]map[string]map[string]int, docs)
+		for i := range items {
+			items[i] = map[string]map[string]int{"index": {"status": status}}
+		}
+		out, _ := json.Marshal(map[string]interface{}{"errors": true, "items": items})
+		return string(out)
+	}
+
+	tests := []struct {
+		name      string
+		configure func(e *ElasticOutput)
+		reply     func(n int, docs int) (int, string)
+		events    int
+		indexed   int
+		maxBatch  int
+		auth      string
+	}{
+		{
+			name:      "batches",
+			configure: func(e *ElasticOutput) { e.BatchSize = 2 },
+			events:    5,
+			indexed:   5,
+			maxBatch:  2,
+		},
+		{
+			name: "api key",
+			configure: func(e *ElasticOutput) {
+				e.APIKey = "secret"
+				e.Username = "ignored"
+			},
+			events:  1,
+			indexed: 1,
+			auth:    "ApiKey secret",
+		},
+		{
+			name: "basic auth",
+			configure: func(e *ElasticOutput) {
+				e.Username = "rpt"
+				e.Password = "pass"
+			},
+			events:  1,
+			indexed: 1,
+			auth:    "Basic cnB0OnBhc3M=",
+		},
+		{
+			name: "retries unavailable cluster",
+			reply: func(n int, docs int) (int, string) {
+				if n < 2 {
+					return http.StatusServiceUnavailable, ""
+				}
+				return http.StatusOK, `{"errors":false}`
+			},
+			events:  3,
+			indexed: 3,
+		},
+		{
+			name: "retries rejected documents",
+			reply: func(n int, docs int) (int, string) {
+				if n == 0 {
+					return http.StatusOK, itemErrors(http.StatusTooManyRequests, docs)
+				}
+				return http.StatusOK, `{"errors":false}`
+			},
+			events:  2,
+			indexed: 2,
+		},
+		{
+			name: "drops bad requests",
+			reply: func(n int, docs int) (int, string) {
+				return http.StatusBadRequest, `{"error":"bad"}`
+			},
+			events:  2,
+			indexed: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			srv := newBulkServer(tt.reply)
+			defer srv.Close()
+
+			e := NewElasticOutput(srv.URL)
+			e.Index = "rpt-{type}"
+			e.FlushInterval = 10 * time.Millisecond
+			if tt.configure != nil {
+				tt.configure(e)
+			}
+			if err := e.Connect(); err != nil {
+				t.Fatal(err)
+			}
+
+			e.WriteLog(testLog(tt.events))
+			if tt.indexed > 0 {
+				srv.waitIndexed(t, tt.indexed)
+			}
+			e.Done()
+
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+
+			if len(srv.indexed) != tt.indexed {
+				t.Errorf("indexed %d documents, want %d", len(srv.indexed), tt.indexed)
+			}
+			for _, index := range srv.indexed {
+				if index != "rpt-logs" {
+					t.Errorf("indexed into %q, want rpt-logs", index)
+				}
+			}
+			for _, n := range srv.batches {
+				if tt.maxBatch > 0 && n > tt.maxBatch {
+					t.Errorf("sent a batch of %d documents, want at most %d", n, tt.maxBatch)
+				}
+			}
+			for _, auth := range srv.auth {
+				if auth != tt.auth {
+					t.Errorf("Authorization = %q, want %q", auth, tt.auth)
+				}
+			}
+		})
+	}
+}
+
+func TestElasticOutputMetrics(t *testing.T) {
+
+	srv := newBulkServer(nil)
+	defer srv.Close()
+
+	e := NewElasticOutput(srv.URL)
+	e.FlushInterval = 10 * time.Millisecond
+	if err := e.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	mc, _ := NewMetricCollection()
+	mc.AddMetric(&Metric{Kind: MetricGauge, Label: "lag_bytes", Value: 42, Timestamp: ts})
+	e.WriteMetric(mc)
+
+	srv.waitIndexed(t, 1)
+	e.Done()
+
+	if got, want := srv.indexed[0], "rpt-metrics-2020.06.01"; got != want {
+		t.Errorf("indexed into %q, want %q", got, want)
+	}
+}
+
+func TestElasticOutputConnect(t *testing.T) {
+
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"http://localhost:9200", false},
+		{"https://localhost:9200", false},
+		{"localhost:9200", true},
+		{"ftp://localhost", true},
+	}
+
+	for _, tt := range tests {
+		e := NewElasticOutput(tt.url)
+		err := e.Connect()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Connect(%q) error = %v, want error %t", tt.url, err, tt.wantErr)
+		}
+		e.Done()
+	}
+}
+
+func TestElasticIndex(t *testing.T) {
+
+	ts := time.Date(2020, 6, 1, 23, 30, 0, 0, time.FixedZone("", -2*60*60))
+
+	tests := []struct {
+		pattern string
+		docType string
+		want    string
+	}{
+		{defaultElasticIndex, "logs", "rpt-logs-2020.06.02"},
+		{"rpt-{type}", "metrics", "rpt-metrics"},
+		{"RPT-{type}-{2006}", "logs", "rpt-logs-2020"},
+		{"rpt-{type", "logs", "rpt-{type"},
+		{"rpt", "logs", "rpt"},
+	}
+
+	for _, tt := range tests {
+		if got := elasticIndex(tt.pattern, tt.docType, ts); got != tt.want {
+			t.Errorf("elasticIndex(%q, %q) = %q, want %q", tt.pattern, tt.docType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,651 @@
+package rpt
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+/*
+
+GRPCServer serves the API over gRPC as the service rpt.v1.Rpt, next to the
+HTTP API. It shares the APIServer's operation queue, operation store,
+progress events, authentication, rate limits and TLS certificates:
+
+	Seed(DBDataSet) Accepted                  POST /data/seed
+	Query(QueryRequest) Accepted              POST /query
+	ReadData(ReadRequest) Accepted            unimplemented
+	WriteData(DataRequest) Accepted           unimplemented
+	DeleteData(DataRequest) Accepted          unimplemented
+	GetOperation(OperationRequest) OperationStatus
+	                                          GET /operation/{id}
+	WatchOperations(ProgressFilter) stream ProgressEvent
+	                                          GET /operations/stream
+	RunWorkflow(Workflow) Accepted            POST /workflow/run
+	ClientAction(ClientRequest) Accepted      POST /client/{action}/{target}
+
+Messages are the rpt types encoded as JSON with the "json" codec (content
+type application/grpc+json) rather than protobuf, so there is no generated
+code. GRPCClient is a typed Go client; other languages need a JSON codec
+registered under the same name. Bearer tokens are sent as authorization
+metadata, as they would be in the HTTP header.
+
+*/
+
+const grpcServiceName = "rpt.v1.Rpt"
+
+type GRPCServer struct {
+	ListenAddr string
+
+	mu     sync.Mutex
+	server *grpc.Server
+}
+
+func NewGRPCServer(listenAddr string) *GRPCServer {
+	return &GRPCServer{ListenAddr: listenAddr}
+}
+
+// start answers gRPC requests for a until Shutdown is called. If the server
+// can't be started the RptClient is asked to stop, as for the HTTP API.
+func (g *GRPCServer) start(a *APIServer) {
+
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(g.unaryInterceptor(a)),
+		grpc.StreamInterceptor(g.streamInterceptor(a)),
+	}
+	if a.MaxBodyBytes > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(int(a.MaxBodyBytes)))
+	}
+	if a.TLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(grpcTLSConfig(a.TLS))))
+	}
+
+	s := grpc.NewServer(opts...)
+	s.RegisterService(&grpcServiceDesc, &grpcService{a: a})
+
+	g.mu.Lock()
+	g.server = s
+	g.mu.Unlock()
+
+	go func() {
+		err := g.serve(a, s)
+		if err != nil && err != grpc.ErrServerStopped {
+			a.log.Errorf("gRPC server: %s", err)
+			a.requestState(context.Background(), newInternalState(EventStop))
+		}
+	}()
+}
+
+func (g *GRPCServer) serve(a *APIServer, s *grpc.Server) error {
+	l, err := net.Listen("tcp", g.ListenAddr)
+	if err != nil {
+		return err
+	}
+	a.log.Infof("Listening for gRPC on %s", g.ListenAddr)
+	return s.Serve(l)
+}
+
+// Shutdown stops accepting requests and waits for in-flight requests to
+// finish until ctx expires.
+func (g *GRPCServer) Shutdown(ctx context.Context) error {
+	g.mu.Lock()
+	s := g.server
+	g.mu.Unlock()
+
+	if s == nil {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Stop()
+		return ctx.Err()
+	}
+}
+
+// grpcTLSConfig serves the APITLS certificates with the h2 protocol gRPC
+// needs.
+func grpcTLSConfig(t *APITLS) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2"},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := t.current().Clone()
+			c.NextProtos = []string{"h2"}
+			return c, nil
+		},
+	}
+}
+
+// MESSAGES
+
+type QueryRequest struct {
+	DBQueryDataSet
+	Target string // primary or secondary, primary if empty
+}
+
+type ReadRequest struct {
+	Target string
+	Query  string
+}
+
+type DataRequest struct {
+	Target string
+	Data   DBDataSet
+}
+
+type OperationRequest struct {
+	ID string // an operation or operation set ID
+}
+
+type OperationStatus struct {
+	ID        string
+	Completed bool
+	Output    json.RawMessage // as returned by GET /operation/{id}
+}
+
+type ClientRequest struct {
+	Target string // primary or secondary
+	Action string // connect, disconnect or reconnect
+}
+
+// CODEC
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// SERVICE
+
+type grpcService struct {
+	a *APIServer
+}
+
+// grpcRoutes names the HTTP route each method mirrors, for auth, metrics and
+// spans.
+var grpcRoutes = map[string]string{
+	"Seed":            "data/seed",
+	"Query":           "query",
+	"ReadData":        "data/read",
+	"WriteData":       "data/write",
+	"DeleteData":      "data/delete",
+	"GetOperation":    "operation/{id}",
+	"WatchOperations": "operations/stream",
+	"RunWorkflow":     "workflow/run",
+	"ClientAction":    "client",
+}
+
+func (s *grpcService) queue(ops *DBOperationSet) (*Accepted, error) {
+	switch err := s.a.AddOperationSet(ops); err {
+	case nil:
+	case errShuttingDown:
+		return nil, status.Error(codes.Unavailable, "rpt is shutting down")
+	default:
+		return nil, status.Error(codes.Unavailable, "The operation queue is full, try again later")
+	}
+	return newAccepted(ops), nil
+}
+
+func (s *grpcService) client(target string) (DBClient, error) {
+	c, err := s.a.client(target)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return c, nil
+}
+
+func (s *grpcService) Seed(ctx context.Context, ds *DBDataSet) (*Accepted, error) {
+	if strings.TrimSpace(ds.Name) == "" {
+		return nil, status.Error(codes.InvalidArgument, "Name is required")
+	}
+	ops := newDBOperationSet(ctx)
+	ops.AddOperation(SeedData(s.a.primary, ds))
+	return s.queue(ops)
+}
+
+func (s *grpcService) Query(ctx context.Context, q *QueryRequest) (*Accepted, error) {
+	if strings.TrimSpace(q.Query) == "" {
+		return nil, status.Error(codes.InvalidArgument, "Query is required")
+	}
+	c, err := s.client(q.Target)
+	if err != nil {
+		return nil, err
+	}
+	ops := newDBOperationSet(ctx)
+	ops.AddOperation(Query(c, &q.DBQueryDataSet))
+	return s.queue(ops)
+}
+
+// ReadData, WriteData and DeleteData are Unimplemented until the clients can
+// read, write and delete data. The HTTP API has no routes for them either.
+
+func (s *grpcService) ReadData(ctx context.Context, req *ReadRequest) (*Accepted, error) {
+	return nil, status.Error(codes.Unimplemented, "Reading data is not supported yet")
+}
+
+func (s *grpcService) WriteData(ctx context.Context, req *DataRequest) (*Accepted, error) {
+	return nil, status.Error(codes.Unimplemented, "Writing data is not supported yet")
+}
+
+func (s *grpcService) DeleteData(ctx context.Context, req *DataRequest) (*Accepted, error) {
+	return nil, status.Error(codes.Unimplemented, "Deleting data is not supported yet")
+}
+
+func (s *grpcService) GetOperation(ctx context.Context, req *OperationRequest) (*OperationStatus, error) {
+
+	if ops := s.a.LookupOperationSet(req.ID); ops != nil {
+		return &OperationStatus{ID: ops.ID, Completed: ops.Completed(), Output: ops.GetOutputJSON()}, nil
+	}
+
+	s.a.mu.Lock()
+	defer s.a.mu.Unlock()
+
+	for _, ops := range s.a.lookupOperationSet {
+		if op := ops.LookupOperation(req.ID); op != nil {
+			return &OperationStatus{ID: op.ID, Completed: !op.Completed().IsZero(), Output: op.GetOutputJSON()}, nil
+		}
+	}
+
+	return nil, status.Errorf(codes.NotFound, "No operation or operation set with ID %s", req.ID)
+}
+
+func (s *grpcService) WatchOperations(f *ProgressFilter, stream grpc.ServerStream) error {
+
+	if s.a.progress == nil {
+		return status.Error(codes.Unavailable, "Progress events are not available")
+	}
+
+	s.a.mu.Lock()
+	closing := s.a.closing
+	s.a.mu.Unlock()
+
+	events, unsubscribe := s.a.progress.Subscribe(64)
+	defer unsubscribe()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if !f.Match(e) {
+				continue
+			}
+			if err := stream.SendMsg(e); err != nil {
+				return err
+			}
+		case <-closing:
+			return nil
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *grpcService) RunWorkflow(ctx context.Context, w *Workflow) (*Accepted, error) {
+	ops, err := s.a.buildWorkflow(ctx, w)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return s.queue(ops)
+}
+
+func (s *grpcService) ClientAction(ctx context.Context, req *ClientRequest) (*Accepted, error) {
+
+	if req.Target == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target is required")
+	}
+	c, err := s.client(req.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	op := clientAction(req.Action, c)
+	switch {
+	case req.Action == "configure":
+		return nil, status.Error(codes.Unimplemented, "Configuring clients is not supported yet")
+	case op == nil:
+		return nil, status.Errorf(codes.InvalidArgument, "Unknown action %q, must be connect, disconnect or reconnect", req.Action)
+	}
+	op.SetLabel("client", req.Target)
+
+	ops := newDBOperationSet(ctx)
+	ops.AddOperation(op)
+	return s.queue(ops)
+}
+
+// SERVICE DESCRIPTION
+
+// grpcUnary describes a unary method whose request is made by newRequest and
+// handled by call.
+func grpcUnary(name string, newRequest func() interface{}, call func(s *grpcService, ctx context.Context, req interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := newRequest()
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			s := srv.(*grpcService)
+			if interceptor == nil {
+				return call(s, ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcServiceName + "/" + name}
+			return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(s, ctx, req)
+			})
+		},
+	}
+}
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		grpcUnary("Seed", func() interface{} { return &DBDataSet{} }, func(s *grpcService, ctx context.Context, req interface{}) (interface{}, error) {
+			return s.Seed(ctx, req.(*DBDataSet))
+		}),
+		grpcUnary("Query", func() interface{} { return &QueryRequest{} }, func(s *grpcService, ctx context.Context, req interface{}) (interface{}, error) {
+			return s.Query(ctx, req.(*QueryRequest))
+		}),
+		grpcUnary("ReadData", func() interface{} { return &ReadRequest{} }, func(s *grpcService, ctx context.Context, req interface{}) (interface{}, error) {
+			return s.ReadData(ctx, req.(*ReadRequest))
+		}),
+		grpcUnary("WriteData", func() interface{} { return &DataRequest{} }, func(s *grpcService, ctx context.Context, req interface{}) (interface{}, error) {
+			return s.WriteData(ctx, req.(*DataRequest))
+		}),
+		grpcUnary("DeleteData", func() interface{} { return &DataRequest{} }, func(s *grpcService, ctx context.Context, req interface{}) (interface{}, error) {
+			return s.DeleteData(ctx, req.(*DataRequest))
+		}),
+		grpcUnary("GetOperation", func() interface{} { return &OperationRequest{} }, func(s *grpcService, ctx context.Context, req interface{}) (interface{}, error) {
+			return s.GetOperation(ctx, req.(*OperationRequest))
+		}),
+		grpcUnary("RunWorkflow", func() interface{} { return &Workflow{} }, func(s *grpcService, ctx context.Context, req interface{}) (interface{}, error) {
+			return s.RunWorkflow(ctx, req.(*Workflow))
+		}),
+		grpcUnary("ClientAction", func() interface{} { return &ClientRequest{} }, func(s *grpcService, ctx context.Context, req interface{}) (interface{}, error) {
+			return s.ClientAction(ctx, req.(*ClientRequest))
+		}),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchOperations",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				f := &ProgressFilter{}
+				if err := stream.RecvMsg(f); err != nil {
+					return err
+				}
+				return srv.(*grpcService).WatchOperations(f, stream)
+			},
+		},
+	},
+}
+
+// INTERCEPTORS
+
+func (g *GRPCServer) unaryInterceptor(a *APIServer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var resp interface{}
+		err := g.instrument(a, ctx, info.FullMethod, func(ctx context.Context) error {
+			var err error
+			resp, err = handler(ctx, req)
+			return err
+		})
+		return resp, err
+	}
+}
+
+func (g *GRPCServer) streamInterceptor(a *APIServer) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return g.instrument(a, ss.Context(), info.FullMethod, func(ctx context.Context) error {
+			return handler(srv, &grpcContextStream{ServerStream: ss, ctx: ctx})
+		})
+	}
+}
+
+// instrument does for gRPC calls what APIServer.instrument does for HTTP
+// requests: it traces the call, authenticates and rate limits the caller and
+// records the request metrics.
+func (g *GRPCServer) instrument(a *APIServer, ctx context.Context, fullMethod string, call func(ctx context.Context) error) error {
+
+	start := time.Now()
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	route := grpcRoutes[method]
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	h := http.Header{}
+	for k, vs := range md {
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+
+	ctx = a.tracer.Extract(ctx, h)
+	ctx, span := StartSpan(ctx, grpcServiceName+"/"+method, SpanKindServer)
+	span.SetAttribute("rpc.system", "grpc")
+	span.SetAttribute("rpc.service", grpcServiceName)
+	span.SetAttribute("rpc.method", method)
+
+	ctx, err := g.authorize(a, ctx, h, method, route)
+	if err == nil {
+		err = call(ctx)
+	}
+
+	code := status.Code(err)
+	span.SetAttribute("rpc.grpc.status_code", int(code))
+	switch code {
+	case codes.Unknown, codes.Internal, codes.Unavailable, codes.DataLoss:
+		span.SetError(err)
+	}
+	span.End()
+
+	labels := map[string]string{
+		"route":  route,
+		"method": "GRPC",
+		"status": code.String(),
+	}
+
+	mc, _ := NewMetricCollection()
+	mc.AddMetric(NewCounter("rpt_api_requests_total", labels).Inc())
+	mc.AddMetric(NewHistogram("rpt_api_request_duration_seconds", labels).ObserveDuration(time.Since(start)))
+	a.Logger.WriteMetric(mc)
+
+	return err
+}
+
+// authorize checks the caller may use route and is within the rate limit. The
+// returned context carries the caller's Principal.
+func (g *GRPCServer) authorize(a *APIServer, ctx context.Context, h http.Header, method, route string) (context.Context, error) {
+
+	// The authenticators and rate limiter work on HTTP requests, so the
+	// call's metadata and peer are presented as one.
+	r := (&http.Request{Method: http.MethodPost, Header: h}).WithContext(ctx)
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			r.TLS = &info.State
+		}
+	}
+
+	if a.Auth != nil {
+		p, err := a.Auth.Authenticate(r)
+		if err != nil || p == nil {
+			// As over HTTP, failed attempts count against the IP address.
+			if err := g.limit(a, ctx, r, method); err != nil {
+				return ctx, err
+			}
+			a.log.Warnf("Unauthenticated gRPC %s from %s", method, r.RemoteAddr)
+			return ctx, status.Error(codes.Unauthenticated, "Authentication is required")
+		}
+
+		SpanFromContext(ctx).SetAttribute("enduser.id", p.Name)
+
+		if required := a.Auth.RequiredRole(route); !p.Role.Allows(required) {
+			a.log.Warnf("%s (%s) is not allowed to call %s, which needs %s", p.Name, p.Role, method, required)
+			return ctx, status.Errorf(codes.PermissionDenied, "This method needs the %s role", required)
+		}
+
+		ctx = context.WithValue(ctx, principalContextKey{}, p)
+		r = r.WithContext(ctx)
+	}
+
+	if err := g.limit(a, ctx, r, method); err != nil {
+		return ctx, err
+	}
+
+	return ctx, nil
+}
+
+// limit applies the rate limit to the caller of r, returning ResourceExhausted
+// if they are over it.
+func (g *GRPCServer) limit(a *APIServer, ctx context.Context, r *http.Request, method string) error {
+	if a.RateLimiter == nil {
+		return nil
+	}
+	client := rateLimitClient(r)
+	if ok, retryAfter := a.RateLimiter.Allow(client); !ok {
+		a.log.Warnf("Rate limited gRPC %s from %s", method, client)
+		_ = grpc.SetHeader(ctx, metadata.Pairs("retry-after", retryAfterSeconds(retryAfter)))
+		return status.Errorf(codes.ResourceExhausted, "Too many requests, try again in %ss", retryAfterSeconds(retryAfter))
+	}
+	return nil
+}
+
+// grpcContextStream is a ServerStream with a context carrying the caller.
+type grpcContextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *grpcContextStream) Context() context.Context {
+	return s.ctx
+}
+
+// CLIENT
+
+// GRPCClient calls the rpt.v1.Rpt service.
+type GRPCClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewGRPCClient returns a client using cc, which should be dialled to a
+// GRPCServer. To authenticate, dial with grpc.WithPerRPCCredentials or add
+// authorization metadata to each call's context.
+func NewGRPCClient(cc *grpc.ClientConn) *GRPCClient {
+	return &GRPCClient{cc: cc}
+}
+
+func (c *GRPCClient) invoke(ctx context.Context, method string, in, out interface{}, opts []grpc.CallOption) error {
+	opts = append([]grpc.CallOption{grpc.CallContentSubtype("json")}, opts...)
+	return c.cc.Invoke(ctx, "/"+grpcServiceName+"/"+method, in, out, opts...)
+}
+
+func (c *GRPCClient) Seed(ctx context.Context, ds *DBDataSet, opts ...grpc.CallOption) (*Accepted, error) {
+	out := &Accepted{}
+	return out, c.invoke(ctx, "Seed", ds, out, opts)
+}
+
+func (c *GRPCClient) Query(ctx context.Context, q *QueryRequest, opts ...grpc.CallOption) (*Accepted, error) {
+	out := &Accepted{}
+	return out, c.invoke(ctx, "Query", q, out, opts)
+}
+
+func (c *GRPCClient) ReadData(ctx context.Context, req *ReadRequest, opts ...grpc.CallOption) (*Accepted, error) {
+	out := &Accepted{}
+	return out, c.invoke(ctx, "ReadData", req, out, opts)
+}
+
+func (c *GRPCClient) WriteData(ctx context.Context, req *DataRequest, opts ...grpc.CallOption) (*Accepted, error) {
+	out := &Accepted{}
+	return out, c.invoke(ctx, "WriteData", req, out, opts)
+}
+
+func (c *GRPCClient) DeleteData(ctx context.Context, req *DataRequest, opts ...grpc.CallOption) (*Accepted, error) {
+	out := &Accepted{}
+	return out, c.invoke(ctx, "DeleteData", req, out, opts)
+}
+
+func (c *GRPCClient) GetOperation(ctx context.Context, id string, opts ...grpc.CallOption) (*OperationStatus, error) {
+	out := &OperationStatus{}
+	return out, c.invoke(ctx, "GetOperation", &OperationRequest{ID: id}, out, opts)
+}
+
+func (c *GRPCClient) RunWorkflow(ctx context.Context, w *Workflow, opts ...grpc.CallOption) (*Accepted, error) {
+	out := &Accepted{}
+	return out, c.invoke(ctx, "RunWorkflow", w, out, opts)
+}
+
+func (c *GRPCClient) ClientAction(ctx context.Context, req *ClientRequest, opts ...grpc.CallOption) (*Accepted, error) {
+	out := &Accepted{}
+	return out, c.invoke(ctx, "ClientAction", req, out, opts)
+}
+
+// WatchOperations streams the progress events matching f until ctx is done
+// or the server closes the stream.
+func (c *GRPCClient) WatchOperations(ctx context.Context, f *ProgressFilter, opts ...grpc.CallOption) (*ProgressWatcher, error) {
+
+	opts = append([]grpc.CallOption{grpc.CallContentSubtype("json")}, opts...)
+	desc := &grpcServiceDesc.Streams[0]
+
+	stream, err := c.cc.NewStream(ctx, desc, "/"+grpcServiceName+"/"+desc.StreamName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(f); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	return &ProgressWatcher{stream: stream}, nil
+}
+
+type ProgressWatcher struct {
+	stream grpc.ClientStream
+}
+
+// Recv returns the next event, or io.EOF once the server ends the stream.
+func (pw *ProgressWatcher) Recv() (*ProgressEvent, error) {
+	e := &ProgressEvent{}
+	if err := pw.stream.RecvMsg(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,220 @@
+package rpt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+
+Idempotency lets callers retry the POSTs that queue operations without
+running them twice. A request with an Idempotency-Key header is remembered,
+with a hash of its body and query parameters, against the operation set it
+queued for Window. A retry with the same key gets the original set instead of
+a new one: 200 with its output if it has finished, otherwise 202 with its ID,
+as the first response was. Replies to retries carry Idempotent-Replayed: true.
+
+Keys are scoped to the caller and the route. Reusing a key with a different
+body or query parameters (other than wait and timeout) is a 422, and a retry
+that arrives while the original request is still being handled is a 409.
+Requests that fail without queueing anything are forgotten, so they can be
+retried with the same key.
+
+*/
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotencyReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength  = 255
+	idempotencySweepInterval = time.Minute
+)
+
+type Idempotency struct {
+	Window time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+}
+
+type idempotencyEntry struct {
+	hash    [sha256.Size]byte
+	created time.Time
+	setID   string // the operation set queued by the original request
+	pending bool   // the original request is still being handled
+}
+
+type idempotencyContextKey struct{}
+
+func NewIdempotency(window time.Duration) *Idempotency {
+	return &Idempotency{
+		Window:  window,
+		entries: map[string]*idempotencyEntry{},
+	}
+}
+
+// begin returns a copy of the entry for key, and true if there was none and
+// a pending one has been created for this request.
+func (i *Idempotency) begin(key string, hash [sha256.Size]byte) (idempotencyEntry, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(i.lastSweep) >= idempotencySweepInterval {
+		for k, e := range i.entries {
+			if !e.pending && now.Sub(e.created) >= i.Window {
+				delete(i.entries, k)
+			}
+		}
+		i.lastSweep = now
+	}
+
+	if e, ok := i.entries[key]; ok && (e.pending || now.Sub(e.created) < i.Window) {
+		return *e, false
+	}
+
+	e := &idempotencyEntry{hash: hash, created: now, pending: true}
+	if i.entries == nil {
+		i.entries = map[string]*idempotencyEntry{}
+	}
+	i.entries[key] = e
+
+	return *e, true
+}
+
+// record notes that the request with ctx queued the operation set id.
+func (i *Idempotency) record(ctx context.Context, id string) {
+	if i == nil {
+		return
+	}
+	key, ok := ctx.Value(idempotencyContextKey{}).(string)
+	if !ok {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if e, ok := i.entries[key]; ok && e.setID == "" {
+		e.setID = id
+	}
+}
+
+// finish marks the request for key as handled, forgetting it if it queued
+// nothing.
+func (i *Idempotency) finish(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	e, ok := i.entries[key]
+	if !ok {
+		return
+	}
+	if e.setID == "" {
+		delete(i.entries, key)
+		return
+	}
+	e.pending = false
+	e.created = time.Now()
+}
+
+func (i *Idempotency) forget(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.entries, key)
+}
+
+// idempotencyHash identifies a request by its body and query parameters,
+// such as ?target, apart from wait and timeout, which only change how long
+// the request waits and may differ between retries.
+func idempotencyHash(r *http.Request, body []byte) [sha256.Size]byte {
+	q := r.URL.Query()
+	q.Del("wait")
+	q.Del("timeout")
+
+	h := sha256.New()
+	h.Write([]byte(q.Encode()))
+	h.Write([]byte{0})
+	h.Write(body)
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// idempotent deduplicates POSTs to route that carry an Idempotency-Key.
+func (a *APIServer) idempotent(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if a.Idempotency == nil || key == "" || r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("%s must be at most %d characters", IdempotencyKeyHeader, maxIdempotencyKeyLength), nil)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		caller := ""
+		if p := PrincipalFromContext(r.Context()); p != nil {
+			caller = p.Name
+		}
+		scoped := caller + "\x00" + route + "\x00" + key
+
+		hash := idempotencyHash(r, body)
+		e, created := a.Idempotency.begin(scoped, hash)
+		if created {
+			defer a.Idempotency.finish(scoped)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), idempotencyContextKey{}, scoped)))
+			return
+		}
+
+		switch {
+		case e.hash != hash:
+			writeError(w, http.StatusUnprocessableEntity, ErrCodeIdempotencyKeyReused, fmt.Sprintf("%s was used for a different request", IdempotencyKeyHeader), nil)
+			return
+		case e.pending:
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusConflict, ErrCodeIdempotencyConflict, fmt.Sprintf("The request with this %s is still being handled", IdempotencyKeyHeader), nil)
+			return
+		}
+
+		ops := a.LookupOperationSet(e.setID)
+		if ops == nil {
+			// The set was cleared, so the key can't be honoured any more.
+			a.Idempotency.forget(scoped)
+			writeError(w, http.StatusGone, ErrCodeNotFound, fmt.Sprintf("Operation set %s queued by this %s is no longer available", e.setID, IdempotencyKeyHeader), nil)
+			return
+		}
+
+		a.log.With(Fields{FieldOperationSetID: ops.ID}).Debugf("Replaying %s %s for %s", r.Method, r.URL.Path, IdempotencyKeyHeader)
+		w.Header().Set(IdempotencyReplayedHeader, "true")
+
+		wait, _ := queryWait(r)
+		if wait > 0 {
+			waitFinished(r.Context(), ops, wait)
+		}
+
+		if ops.Completed() {
+			a.writeResult(w, ops)
+			return
+		}
+		a.writeAccepted(w, ops)
+	})
+}
@@ -0,0 +1,135 @@
+package rpt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClient is a DBClient that answers every query with its text.
+type fakeClient struct{}
+
+func (fakeClient) Connect() error                                 { return nil }
+func (fakeClient) Disconnect() error                              { return nil }
+func (fakeClient) Reconnect() error                               { return nil }
+func (fakeClient) Seed(d DataSet) (interface{}, error)            { return nil, nil }
+func (fakeClient) Query(s string) (interface{}, error)            { return s, nil }
+func (fakeClient) ListDB() (interface{}, error)                   { return nil, nil }
+func (fakeClient) ReplicationStatus() (*ReplicationStatus, error) { return &ReplicationStatus{}, nil }
+
+// newTestAPIServer returns an API server over fake clients whose operation
+// queue holds up to queue sets. Nothing runs the queued sets.
+func newTestAPIServer(queue int) *APIServer {
+	return &APIServer{
+		BasePath:   "/api",
+		Operations: make(chan *DBOperationSet, queue),
+		primary:    fakeClient{},
+		secondary:  fakeClient{},
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+
+	a := newTestAPIServer(10)
+	a.Idempotency = NewIdempotency(time.Hour)
+	h := a.Handler()
+
+	const query = `{"Name":"count","Query":"SELECT count(*) FROM users"}`
+
+	// The steps run in order against the same server. A step with replay
+	// set expects the operation set queued by the step of that name back.
+	tests := []struct {
+		name   string
+		key    string
+		path   string
+		body   string
+		before func()
+		status int
+		code   string
+		replay string
+	}{
+		{name: "first", key: "k1", path: "/api/query", body: query, status: http.StatusAccepted},
+		{name: "retry", key: "k1", path: "/api/query", body: query, status: http.StatusAccepted, replay: "first"},
+		{name: "retry ignores wait", key: "k1", path: "/api/query?wait=true&timeout=1ms", body: query, status: http.StatusAccepted, replay: "first"},
+		{name: "different body", key: "k1", path: "/api/query", body: `{"Name":"count","Query":"SELECT 1"}`, status: http.StatusUnprocessableEntity, code: ErrCodeIdempotencyKeyReused},
+		{name: "different target", key: "k1", path: "/api/query?target=secondary", body: query, status: http.StatusUnprocessableEntity, code: ErrCodeIdempotencyKeyReused},
+		{
+			name: "retry after the set finished", key: "k1", path: "/api/query", body: query,
+			before: func() {
+				ops := <-a.Operations
+				ops.Start()
+			},
+			status: http.StatusOK, replay: "first",
+		},
+		{name: "other key", key: "k2", path: "/api/query", body: query, status: http.StatusAccepted},
+		{
+			name: "set no longer available", key: "k2", path: "/api/query", body: query,
+			before: a.clearLookupOperationSet,
+			status: http.StatusGone, code: ErrCodeNotFound,
+		},
+		{name: "reused after gone", key: "k2", path: "/api/query", body: query, status: http.StatusAccepted},
+		{name: "invalid", key: "k3", path: "/api/query", body: `{"Name":"count","Query":" "}`, status: http.StatusBadRequest, code: ErrCodeInvalidRequest},
+		{name: "fixed after invalid", key: "k3", path: "/api/query", body: query, status: http.StatusAccepted},
+		{
+			name: "in flight", key: "k4", path: "/api/query", body: query,
+			before: func() {
+				r := httptest.NewRequest(http.MethodPost, "/api/query", nil)
+				a.Idempotency.begin("\x00query\x00k4", idempotencyHash(r, []byte(query)))
+			},
+			status: http.StatusConflict, code: ErrCodeIdempotencyConflict,
+		},
+		{name: "key too long", key: strings.Repeat("k", maxIdempotencyKeyLength+1), path: "/api/query", body: query, status: http.StatusBadRequest, code: ErrCodeInvalidRequest},
+		{name: "no key", path: "/api/query", body: query, status: http.StatusAccepted},
+		{name: "no key again", path: "/api/query", body: query, status: http.StatusAccepted},
+	}
+
+	ids := map[string]string{}
+	seen := map[string]bool{}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if tt.before != nil {
+				tt.before()
+			}
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.key != "" {
+				req.Header.Set(IdempotencyKeyHeader, tt.key)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got, want := w.Header().Get(IdempotencyReplayedHeader) == "true", tt.replay != ""; got != want {
+				t.Errorf("%s = %q, want replayed %t", IdempotencyReplayedHeader, w.Header().Get(IdempotencyReplayedHeader), want)
+			}
+			if tt.code != "" {
+				e := &APIError{}
+				if err := json.Unmarshal(w.Body.Bytes(), e); err != nil {
+					t.Fatalf("error response %q is not JSON: %s", w.Body, err)
+				}
+				if e.Code != tt.code {
+					t.Errorf("error code = %q, want %q", e.Code, tt.code)
+				}
+				return
+			}
+
+			id := strings.TrimPrefix(w.Header().Get("Location"), "/api/operation/")
+			switch {
+			case tt.replay != "" && id != ids[tt.replay]:
+				t.Errorf("replayed operation set %s, want %s", id, ids[tt.replay])
+			case tt.replay == "" && seen[id]:
+				t.Errorf("operation set %s was queued again", id)
+			}
+			ids[tt.name] = id
+			seen[id] = true
+		})
+	}
+}
@@ -1,42 +1,312 @@
 package rpt
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // LOGGER
 
+/*
+
+Logger writes each event to the log outputs as soon as it is logged. Events
+below Level are discarded, and events logged after Done go to the standard
+library logger instead.
+
+With returns a Logger that adds fields to every event and shares the outputs
+of the Logger it came from:
+
+	l := r.Logger.With(Fields{FieldOperationSetID: dbos.ID, FieldWorkflow: dbos.Workflow})
+	l.Infof("Operation set completed")
+
+A nil *Logger discards everything, so it can be left unset. Outputs report
+their own errors to the standard library logger, since they cannot log
+through themselves.
+
+*/
+
+type Fields map[string]string
+
+const (
+	FieldComponent      = "component"
+	FieldOperationID    = "operation_id"
+	FieldOperationSetID = "set_id"
+	FieldClient         = "client"
+	FieldWorkflow       = "workflow"
+)
+
+var logLevels = map[string]int{
+	"DEBUG": 0,
+	"INFO":  1,
+	"WARN":  2,
+	"ERROR": 3,
+}
+
 type Logger struct {
 	LogOutputs    []Output
 	MetricOutputs []Output
+	Level         string // DEBUG, INFO, WARN, ERROR; INFO if empty
+
+	root   *Logger // outputs are held by the root, nil for the root itself
+	fields Fields
+	mu     sync.RWMutex
+	done   bool
+}
+
+func NewLogger(level string) *Logger {
+	return &Logger{Level: level}
+}
+
+// With returns a Logger that adds f to the fields of every event.
+func (l *Logger) With(f Fields) *Logger {
+
+	if l == nil {
+		return nil
+	}
+
+	fields := make(Fields, len(l.fields)+len(f))
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	for k, v := range f {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+
+	return &Logger{
+		root:   l.base(),
+		fields: fields,
+	}
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.logf("DEBUG", format, v...)
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.logf("INFO", format, v...)
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.logf("WARN", format, v...)
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.logf("ERROR", format, v...)
+}
+
+func (l *Logger) logf(level string, format string, v ...interface{}) {
+
+	if l == nil || !l.Enabled(level) {
+		return
+	}
+
+	le := &LogEvent{
+		Level:       level,
+		Time:        time.Now(),
+		Description: fmt.Sprintf(format, v...),
+		Fields:      l.fields,
+	}
+
+	description := "rpt_log"
+	if c, ok := l.fields[FieldComponent]; ok {
+		description = fmt.Sprintf("%s_log", c)
+	}
+
+	l.WriteLog(&Log{
+		Level:       level,
+		Description: description,
+		Events:      []*LogEvent{le},
+	})
+}
+
+// Enabled reports whether events at level are written.
+func (l *Logger) Enabled(level string) bool {
+
+	if l == nil {
+		return false
+	}
+
+	min, ok := logLevels[l.base().Level]
+	if !ok {
+		min = logLevels["INFO"]
+	}
+
+	return logLevels[level] >= min
 }
 
 func (l *Logger) WriteLog(lg *Log) {
-	for _, o := range l.LogOutputs {
+
+	if l == nil {
+		return
+	}
+
+	b := l.base()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.done {
+		for _, le := range lg.Events {
+			log.Printf("%s %s%s", le.Level, le.Description, formatFields(le.Fields))
+		}
+		return
+	}
+
+	for _, o := range b.LogOutputs {
 		o.WriteLog(lg)
 	}
 }
 
 func (l *Logger) WriteMetric(mc *MetricCollection) {
-	for _, o := range l.MetricOutputs {
+
+	if l == nil {
+		return
+	}
+
+	b := l.base()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.done {
+		return
+	}
+
+	for _, o := range b.MetricOutputs {
 		o.WriteMetric(mc)
 	}
 }
 
+// Done flushes and closes every output. Outputs registered for both logs and
+// metrics are only closed once.
+func (l *Logger) Done() {
+
+	if l == nil {
+		return
+	}
+
+	b := l.base()
+	b.mu.Lock()
+	if b.done {
+		b.mu.Unlock()
+		return
+	}
+	b.done = true
+	outputs := append(append([]Output{}, b.LogOutputs...), b.MetricOutputs...)
+	b.mu.Unlock()
+
+	done := map[Output]bool{}
+
+	for _, o := range outputs {
+		if done[o] {
+			continue
+		}
+		o.Done()
+		done[o] = true
+	}
+}
+
 func (l *Logger) AddLogOutput(o Output) {
-	l.LogOutputs = append(l.LogOutputs, o)
+	if l == nil {
+		return
+	}
+	b := l.base()
+	b.mu.Lock()
+	b.LogOutputs = append(b.LogOutputs, o)
+	b.mu.Unlock()
 }
 
 func (l *Logger) AddMetricOutput(o Output) {
-	l.MetricOutputs = append(l.MetricOutputs, o)
+	if l == nil {
+		return
+	}
+	b := l.base()
+	b.mu.Lock()
+	b.MetricOutputs = append(b.MetricOutputs, o)
+	b.mu.Unlock()
+}
+
+// HasLogOutputs reports whether any log output has been added.
+func (l *Logger) HasLogOutputs() bool {
+	if l == nil {
+		return false
+	}
+	b := l.base()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.LogOutputs) > 0
+}
+
+// logOutputs returns a copy of the log outputs.
+func (l *Logger) logOutputs() []Output {
+	if l == nil {
+		return nil
+	}
+	b := l.base()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]Output{}, b.LogOutputs...)
+}
+
+// metricOutputs returns a copy of the metric outputs.
+func (l *Logger) metricOutputs() []Output {
+	if l == nil {
+		return nil
+	}
+	b := l.base()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]Output{}, b.MetricOutputs...)
+}
+
+func (l *Logger) base() *Logger {
+	if l.root != nil {
+		return l.root
+	}
+	return l
+}
+
+// formatFields renders fields as " key=value" pairs sorted by key.
+func formatFields(f Fields) string {
+
+	if len(f) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b := &strings.Builder{}
+	for _, k := range keys {
+		v := f[k]
+		if strings.ContainsAny(v, " \t\"=") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(b, " %s=%s", k, v)
+	}
+
+	return b.String()
 }
 
 // OUTPUT
 
+// Every Output is safe for concurrent use. Outputs that queue entries hold at
+// most defaultQueueSize of them unless configured otherwise.
 type Output interface {
 	WriteLog(*Log)
 	WriteMetric(*MetricCollection)
@@ -49,6 +319,16 @@ type Output interface {
 	pullLogs() *map[string]interface{}
 }
 
+// QueuePolicy decides what a queueing output does when its queue is full.
+type QueuePolicy string
+
+const (
+	QueueBlock QueuePolicy = "block" // the writer waits for space
+	QueueDrop  QueuePolicy = "drop"  // the entry is dropped
+)
+
+const defaultQueueSize = 1000
+
 // LOG
 
 type Log struct {
@@ -61,6 +341,7 @@ type LogEvent struct {
 	Level       string
 	Time        time.Time
 	Description string
+	Fields      Fields `json:",omitempty"`
 }
 
 func (l *Log) Debugf(format string, v ...interface{}) {
@@ -108,50 +389,64 @@ func NewLog(level, description string) *Log {
 	return output
 }
 
-// ELASTIC OUTPUT
-
-type ElasticOutput struct {
-	Description string
-	ToProcess   chan *Log
-}
-
-func (e *ElasticOutput) WriteLog(l *Log) {}
-
-func (e *ElasticOutput) WriteMetric(mc *MetricCollection) {}
-
-func (e *ElasticOutput) Connect() error {
-	return nil
-}
-
-func (e *ElasticOutput) Done() {}
-
-func (e *ElasticOutput) GetDescription() string {
-	return e.Description
-}
-
-func (e *ElasticOutput) resetLogs() {}
-
-func (e *ElasticOutput) resetMetrics() {}
-
-func (e *ElasticOutput) pullLogs() *map[string]interface{} { return nil }
-
-func (e *ElasticOutput) pullMetrics() *map[string]interface{} { return nil }
-
 // FILE OUTPUT
 
+// FileOutput writes logs and metrics to FilePath as JSON lines, text or CSV.
+// The file is rotated when it reaches MaxSize bytes or is older than MaxAge,
+// and only the newest MaxFiles rotated files are kept. Zero disables each
+// limit.
 type FileOutput struct {
 	Description string
 	ToProcess   chan *Log
 	FileType    string //json, text, csv
 	FilePath    string
+	MaxSize     int64
+	MaxAge      time.Duration
+	MaxFiles    int
 	mu          sync.RWMutex
+	file        *os.File
+	size        int64
+	opened      time.Time
+}
+
+// fileRecord is a single log event or metric as written by FileOutput.
+type fileRecord struct {
+	Time        time.Time
+	Type        string            // log, metric
+	Level       string            `json:",omitempty"`
+	Description string            `json:",omitempty"`
+	Log         string            `json:",omitempty"`
+	Kind        MetricKind        `json:",omitempty"`
+	Name        string            `json:",omitempty"`
+	Value       interface{}       `json:",omitempty"`
+	Labels      map[string]string `json:",omitempty"`
+	Fields      Fields            `json:",omitempty"`
+}
+
+var fileCSVHeader = []string{"time", "type", "level", "log", "description", "kind", "name", "value", "labels", "fields"}
+
+func NewFileOutput(filePath, fileType string) *FileOutput {
+	return &FileOutput{
+		Description: "file_output",
+		FileType:    fileType,
+		FilePath:    filePath,
+	}
 }
 
 func (f *FileOutput) WriteLog(l *Log) {
 
 	f.mu.Lock()
 
-	//do stuff
+	for _, le := range l.Events {
+		f.write(&fileRecord{
+			Time:        le.Time,
+			Type:        "log",
+			Level:       le.Level,
+			Description: le.Description,
+			Log:         l.Description,
+			Fields:      le.Fields,
+		})
+	}
 
 	f.mu.Unlock()
 }
@@ -160,16 +455,51 @@ func (f *FileOutput) WriteMetric(mc *MetricCollection) {
 
 	f.mu.Lock()
 
-	//do stuff
+	for _, m := range mc.Metrics {
+		f.write(&fileRecord{
+			Time:   m.Timestamp,
+			Type:   "metric",
+			Kind:   m.Kind,
+			Name:   m.Label,
+			Value:  m.Value,
+			Labels: m.Labels,
+		})
+	}
 
 	f.mu.Unlock()
 }
 
 func (f *FileOutput) Connect() error {
-	return nil
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := os.MkdirAll(filepath.Dir(f.FilePath), 0755)
+	if err != nil {
+		return err
+	}
+
+	return f.open()
 }
 
-func (f *FileOutput) Done() {}
+// Done syncs the file to disk and closes it.
+func (f *FileOutput) Done() {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return
+	}
+
+	if err := f.file.Sync(); err != nil {
+		log.Printf("rpt: file output %s: %s", f.FilePath, err)
+	}
+	if err := f.file.Close(); err != nil {
+		log.Printf("rpt: file output %s: %s", f.FilePath, err)
+	}
+	f.file = nil
+}
 
 func (f *FileOutput) GetDescription() string {
 	return f.Description
@@ -183,33 +513,289 @@ func (f *FileOutput) pullLogs() *map[string]interface{} { return nil }
 
 func (f *FileOutput) pullMetrics() *map[string]interface{} { return nil }
 
+// open opens FilePath for appending. A new or empty CSV file gets a header.
+func (f *FileOutput) open() error {
+
+	file, err := os.OpenFile(f.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+
+	if f.size == 0 && f.FileType == "csv" {
+		return f.writeBytes(csvLine(fileCSVHeader))
+	}
+
+	return nil
+}
+
+func (f *FileOutput) write(rec *fileRecord) {
+
+	if f.file == nil {
+		return
+	}
+
+	if (f.MaxSize > 0 && f.size >= f.MaxSize) || (f.MaxAge > 0 && time.Since(f.opened) >= f.MaxAge) {
+		err := f.rotate()
+		if err != nil {
+			log.Printf("rpt: file output %s: unable to rotate: %s", f.FilePath, err)
+			if f.file == nil {
+				return
+			}
+		}
+	}
+
+	err := f.writeBytes(f.format(rec))
+	if err != nil {
+		log.Printf("rpt: file output %s: %s", f.FilePath, err)
+	}
+}
+
+func (f *FileOutput) writeBytes(b []byte) error {
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return err
+}
+
+func (f *FileOutput) format(rec *fileRecord) []byte {
+
+	switch f.FileType {
+	case "text":
+		if rec.Type == "metric" {
+			return []byte(fmt.Sprintf("%s METRIC %s%s = %s\n", rec.Time.Format("2006/01/02 15:04:05.000"), rec.Name, promLabels(rec.Labels), fmt.Sprint(rec.Value)))
+		}
+		return []byte(fmt.Sprintf("%s %s %s%s\n", rec.Time.Format("2006/01/02 15:04:05.000"), rec.Level, rec.Description, formatFields(rec.Fields)))
+	case "csv":
+		value := ""
+		if rec.Value != nil {
+			value = fmt.Sprint(rec.Value)
+		}
+		return csvLine([]string{rec.Time.Format(time.RFC3339Nano), rec.Type, rec.Level, rec.Log, rec.Description, string(rec.Kind), rec.Name, value, promLabels(rec.Labels), strings.TrimSpace(formatFields(rec.Fields))})
+	default:
+		out, _ := json.Marshal(rec)
+		return append(out, '\n')
+	}
+}
+
+// rotatedTimeFormat is the timestamp in the names of rotated files.
+const rotatedTimeFormat = "20060102T150405.000"
+
+// rotate renames the current file to name-<timestamp>.ext, removes the oldest
+// rotated files beyond MaxFiles and opens a new file. A counter is added to
+// the timestamp when a file was already rotated in the same millisecond, as
+// in name-<timestamp>-1.ext. The new file is opened even if an earlier step
+// fails, so that later records aren't lost.
+func (f *FileOutput) rotate() error {
+
+	var errs []error
+	if err := f.file.Sync(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := f.file.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	f.file = nil
+
+	ext := filepath.Ext(f.FilePath)
+	base := strings.TrimSuffix(f.FilePath, ext)
+	ts := time.Now().Format(rotatedTimeFormat)
+	rotated := fmt.Sprintf("%s-%s%s", base, ts, ext)
+	for n := 1; ; n++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s-%s-%d%s", base, ts, n, ext)
+	}
+
+	if err := os.Rename(f.FilePath, rotated); err != nil {
+		errs = append(errs, err)
+	} else if f.MaxFiles > 0 {
+		if err := f.prune(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := f.open(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// prune removes the oldest files rotated from FilePath beyond MaxFiles. Only
+// names with a rotation timestamp match, not other files that share the
+// prefix, such as rpt-metrics.csv next to rpt.csv.
+func (f *FileOutput) prune() error {
+
+	ext := filepath.Ext(f.FilePath)
+	prefix := strings.TrimSuffix(filepath.Base(f.FilePath), ext) + "-"
+	dir := filepath.Dir(f.FilePath)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	type rotatedFile struct {
+		path string
+		ts   string
+		n    int
+	}
+
+	rotated := []rotatedFile{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		ts := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		n := 0
+		if i := len(rotatedTimeFormat); len(ts) > i+1 && ts[i] == '-' {
+			if n, err = strconv.Atoi(ts[i+1:]); err != nil || n < 1 {
+				continue
+			}
+			ts = ts[:i]
+		}
+		if _, err := time.Parse(rotatedTimeFormat, ts); err != nil {
+			continue
+		}
+		rotated = append(rotated, rotatedFile{filepath.Join(dir, name), ts, n})
+	}
+
+	// The timestamp sorts oldest first, then the counter.
+	sort.Slice(rotated, func(i, j int) bool {
+		if rotated[i].ts != rotated[j].ts {
+			return rotated[i].ts < rotated[j].ts
+		}
+		return rotated[i].n < rotated[j].n
+	})
+	for len(rotated) > f.MaxFiles {
+		if err := os.Remove(rotated[0].path); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+
+	return nil
+}
+
+func csvLine(fields []string) []byte {
+	b := &bytes.Buffer{}
+	w := csv.NewWriter(b)
+	_ = w.Write(fields)
+	w.Flush()
+	return b.Bytes()
+}
+
 // CONSOLE OUTPUT
 
+// ConsoleOutput writes logs and metrics from two queues of QueueSize entries.
+// When a queue is full Policy decides whether the writer waits or the entry
+// is dropped.
 type ConsoleOutput struct {
 	Description      string
+	QueueSize        int
+	Policy           QueuePolicy
 	logsToProcess    chan *Log
 	metricsToProcess chan *MetricCollection
+	wg               sync.WaitGroup
+	mu               sync.RWMutex
+	closed           bool
+	dropped          uint64
 }
 
 func (c *ConsoleOutput) WriteLog(l *Log) {
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed || c.logsToProcess == nil {
+		return
+	}
+
+	if c.Policy == QueueDrop {
+		select {
+		case c.logsToProcess <- l:
+		default:
+			atomic.AddUint64(&c.dropped, 1)
+		}
+		return
+	}
+
 	c.logsToProcess <- l
 }
 
 func (c *ConsoleOutput) WriteMetric(mc *MetricCollection) {
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed || c.metricsToProcess == nil {
+		return
+	}
+
+	if c.Policy == QueueDrop {
+		select {
+		case c.metricsToProcess <- mc:
+		default:
+			atomic.AddUint64(&c.dropped, 1)
+		}
+		return
+	}
+
 	c.metricsToProcess <- mc
 }
 
 func (c *ConsoleOutput) Connect() error {
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaultQueueSize
+	}
+
+	c.logsToProcess = make(chan *Log, c.QueueSize)
+	c.metricsToProcess = make(chan *MetricCollection, c.QueueSize)
+
+	c.wg.Add(2)
 	go consoleOutputMetricProcessor(c)
 	go consoleOutputLogProcessor(c)
 
 	return nil
 }
 
+// Done closes the queues and waits for everything already queued to be
+// written.
 func (c *ConsoleOutput) Done() {
+
+	c.mu.Lock()
+	if c.closed || c.logsToProcess == nil {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
 	close(c.logsToProcess)
 	close(c.metricsToProcess)
+	c.mu.Unlock()
+
+	c.wg.Wait()
+
+	if n := atomic.LoadUint64(&c.dropped); n > 0 {
+		log.Printf("rpt: console output: dropped %d entries from a full queue", n)
+	}
 }
 
 func (c *ConsoleOutput) GetDescription() string {
@@ -237,9 +823,9 @@ func (c *ConsoleOutput) pullMetrics() *map[string]interface{} {
 
 func NewConsoleOutput() *ConsoleOutput {
 	output := &ConsoleOutput{
-		Description:      "console_output",
-		logsToProcess:    make(chan *Log, 20),
-		metricsToProcess: make(chan *MetricCollection, 20),
+		Description: "console_output",
+		QueueSize:   defaultQueueSize,
+		Policy:      QueueBlock,
 	}
 
 	return output
@@ -248,17 +834,17 @@ func NewConsoleOutput() *ConsoleOutput {
 func consoleOutputMetricProcessor(c *ConsoleOutput) {
 	for mc := range c.metricsToProcess {
 		for _, m := range mc.Metrics {
-			os.Stdout.WriteString(fmt.Sprintf("%s METRIC %s = %s\n", m.Timestamp.Format("2006/01/02 15:04:05:000"), m.Label, fmt.Sprint(m.Value)))
+			os.Stdout.WriteString(fmt.Sprintf("%s METRIC %s%s = %s\n", m.Timestamp.Format("2006/01/02 15:04:05:000"), m.Label, promLabels(m.Labels), fmt.Sprint(m.Value)))
 		}
 	}
-	log.Println("Closed metrics")
+	c.wg.Done()
 }
 
 func consoleOutputLogProcessor(c *ConsoleOutput) {
 	for ls := range c.logsToProcess {
 		for _, le := range ls.Events {
 
-			msg := fmt.Sprintf("%s %s %s\n", le.Time.Format("2006/01/02 15:04:05:000"), le.Level, le.Description)
+			msg := fmt.Sprintf("%s %s %s%s\n", le.Time.Format("2006/01/02 15:04:05:000"), le.Level, le.Description, formatFields(le.Fields))
 
 			if le.Level == "ERROR" {
 				os.Stdout.WriteString(msg)
@@ -267,23 +853,125 @@ func consoleOutputLogProcessor(c *ConsoleOutput) {
 			}
 		}
 	}
-	log.Println("Closed logs")
+	c.wg.Done()
 }
 
 // PULL OUTPUT
 
+// PullOutput keeps logs and metrics until they are pulled. Only the newest
+// MaxEntries of each are kept. Logs can also be read without removing them
+// with Logs, or followed as they are written with Subscribe.
 type PullOutput struct {
 	Description  string
+	MaxEntries   int
 	CacheMetrics []*MetricCollection
 	CacheLogs    []*Log
+	mu           sync.Mutex
+	subscribers  map[chan *LogEntry]struct{}
+}
+
+// LogEntry is a LogEvent together with the description of its Log.
+type LogEntry struct {
+	Log string
+	*LogEvent
+}
+
+// LogFilter selects log events. Zero values match everything.
+type LogFilter struct {
+	Level       string // minimum level
+	Since       time.Time
+	Until       time.Time
+	OperationID string // matches the operation or operation set ID
+}
+
+func (f *LogFilter) Match(le *LogEvent) bool {
+
+	if f.Level != "" && logLevels[le.Level] < logLevels[f.Level] {
+		return false
+	}
+	if !f.Since.IsZero() && le.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && le.Time.After(f.Until) {
+		return false
+	}
+	if f.OperationID != "" && le.Fields[FieldOperationID] != f.OperationID && le.Fields[FieldOperationSetID] != f.OperationID {
+		return false
+	}
+
+	return true
 }
 
 func (p *PullOutput) WriteLog(l *Log) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.CacheLogs = append(p.CacheLogs, l)
+	if p.MaxEntries > 0 && len(p.CacheLogs) > p.MaxEntries {
+		p.CacheLogs = p.CacheLogs[len(p.CacheLogs)-p.MaxEntries:]
+	}
+
+	for _, le := range l.Events {
+		entry := &LogEntry{Log: l.Description, LogEvent: le}
+		for sub := range p.subscribers {
+			// Slow subscribers miss events rather than hold up the logger.
+			select {
+			case sub <- entry:
+			default:
+			}
+		}
+	}
+}
+
+// Logs returns the cached log events that match f, oldest first, without
+// removing them.
+func (p *PullOutput) Logs(f *LogFilter) []*LogEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entries := []*LogEntry{}
+	for _, l := range p.CacheLogs {
+		for _, le := range l.Events {
+			if f.Match(le) {
+				entries = append(entries, &LogEntry{Log: l.Description, LogEvent: le})
+			}
+		}
+	}
+
+	return entries
+}
+
+// Subscribe returns a channel that receives every log event written from now
+// on, and a function that ends the subscription. The channel holds up to size
+// events; events are dropped while it is full. It is closed by the returned
+// function or by Done.
+func (p *PullOutput) Subscribe(size int) (<-chan *LogEntry, func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sub := make(chan *LogEntry, size)
+	if p.subscribers == nil {
+		p.subscribers = map[chan *LogEntry]struct{}{}
+	}
+	p.subscribers[sub] = struct{}{}
+
+	return sub, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if _, ok := p.subscribers[sub]; ok {
+			delete(p.subscribers, sub)
+			close(sub)
+		}
+	}
 }
 
 func (p *PullOutput) WriteMetric(mc *MetricCollection) {
+	p.mu.Lock()
 	p.CacheMetrics = append(p.CacheMetrics, mc)
+	if p.MaxEntries > 0 && len(p.CacheMetrics) > p.MaxEntries {
+		p.CacheMetrics = p.CacheMetrics[len(p.CacheMetrics)-p.MaxEntries:]
+	}
+	p.mu.Unlock()
 }
 
 func (p *PullOutput) Connect() error {
@@ -296,6 +984,13 @@ func (p *PullOutput) Connect() error {
 func (p *PullOutput) Done() {
 	p.resetLogs()
 	p.resetMetrics()
+
+	p.mu.Lock()
+	for sub := range p.subscribers {
+		close(sub)
+	}
+	p.subscribers = nil
+	p.mu.Unlock()
 }
 
 func (p *PullOutput) GetDescription() string {
@@ -304,31 +999,41 @@ func (p *PullOutput) GetDescription() string {
 }
 
 func (p *PullOutput) resetMetrics() {
+	p.mu.Lock()
 	p.CacheMetrics = []*MetricCollection{}
+	p.mu.Unlock()
 }
 
 func (p *PullOutput) resetLogs() {
+	p.mu.Lock()
 	p.CacheLogs = []*Log{}
+	p.mu.Unlock()
 }
 
 func (p *PullOutput) pullMetrics() *map[string]interface{} {
 
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	output := &map[string]interface{}{
 		"Metrics": p.CacheMetrics,
 	}
 
-	p.resetMetrics()
+	p.CacheMetrics = []*MetricCollection{}
 
 	return output
 }
 
 func (p *PullOutput) pullLogs() *map[string]interface{} {
 
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	output := &map[string]interface{}{
 		"Logs": p.CacheLogs,
 	}
 
-	p.resetLogs()
+	p.CacheLogs = []*Log{}
 
 	return output
 }
@@ -336,6 +1041,7 @@ func (p *PullOutput) pullLogs() *map[string]interface{} {
 func NewPullOutput() *PullOutput {
 	pull := &PullOutput{
 		Description:  "pull_output",
+		MaxEntries:   defaultQueueSize,
 		CacheLogs:    []*Log{},
 		CacheMetrics: []*MetricCollection{},
 	}
@@ -346,8 +1052,10 @@ func NewPullOutput() *PullOutput {
 // METRIC
 
 type Metric struct {
+	Kind      MetricKind
 	Label     string
 	Value     interface{}
+	Labels    map[string]string
 	Timestamp time.Time
 }
 
@@ -359,6 +1067,10 @@ func (mc *MetricCollection) AddMetric(m *Metric) {
 	mc.Metrics = append(mc.Metrics, m)
 }
 
+func (mc *MetricCollection) AddMetrics(other *MetricCollection) {
+	mc.Metrics = append(mc.Metrics, other.Metrics...)
+}
+
 func NewMetricCollection() (*MetricCollection, error) {
 
 	m := []*Metric{}
@@ -0,0 +1,288 @@
+package rpt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoggerConcurrent(t *testing.T) {
+
+	const writers, events = 8, 50
+
+	l := NewLogger("DEBUG")
+	pull := NewPullOutput()
+	pull.MaxEntries = writers * events
+	l.AddLogOutput(pull)
+	l.AddMetricOutput(pull)
+
+	sub, unsubscribe := pull.Subscribe(writers * events)
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			log := l.With(Fields{FieldOperationID: fmt.Sprintf("op-%d", i)})
+			for j := 0; j < events; j++ {
+				log.Infof("event %d", j)
+				mc, _ := NewMetricCollection()
+				mc.AddMetric(NewCounter("events_total", nil).Inc())
+				l.WriteMetric(mc)
+			}
+		}(i)
+	}
+
+	// Outputs are added, read and subscribed to while the writers run.
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < events; i++ {
+			l.AddLogOutput(&PullOutput{})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < events; i++ {
+			pull.Logs(&LogFilter{OperationID: "op-0"})
+			l.HasLogOutputs()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < events; i++ {
+			_, cancel := pull.Subscribe(1)
+			cancel()
+		}
+	}()
+
+	wg.Wait()
+
+	if got := len(pull.Logs(&LogFilter{})); got != writers*events {
+		t.Errorf("pull output has %d log events, want %d", got, writers*events)
+	}
+	if got := len(pull.Logs(&LogFilter{OperationID: "op-3"})); got != events {
+		t.Errorf("pull output has %d log events for op-3, want %d", got, events)
+	}
+	if got := len(pull.CacheMetrics); got != writers*events {
+		t.Errorf("pull output has %d metric collections, want %d", got, writers*events)
+	}
+
+	unsubscribe()
+	received := 0
+	for range sub {
+		received++
+	}
+	if received != writers*events {
+		t.Errorf("subscriber received %d log events, want %d", received, writers*events)
+	}
+
+	l.Done()
+	l.Done()
+}
+
+func TestLoggerEnabled(t *testing.T) {
+
+	tests := []struct {
+		level   string
+		enabled map[string]bool
+	}{
+		{"DEBUG", map[string]bool{"DEBUG": true, "INFO": true, "WARN": true, "ERROR": true}},
+		{"WARN", map[string]bool{"DEBUG": false, "INFO": false, "WARN": true, "ERROR": true}},
+		{"", map[string]bool{"DEBUG": false, "INFO": true, "WARN": true, "ERROR": true}},
+		{"VERBOSE", map[string]bool{"DEBUG": false, "INFO": true, "WARN": true, "ERROR": true}},
+	}
+
+	for _, tt := range tests {
+		l := NewLogger(tt.level).With(Fields{FieldComponent: "test"})
+		for level, want := range tt.enabled {
+			if got := l.Enabled(level); got != want {
+				t.Errorf("logger at %q: Enabled(%q) = %t, want %t", tt.level, level, got, want)
+			}
+		}
+	}
+
+	var l *Logger
+	if l.Enabled("ERROR") {
+		t.Error("nil logger is enabled")
+	}
+}
+
+func TestLogFilter(t *testing.T) {
+
+	now := time.Now()
+	le := &LogEvent{
+		Level:  "WARN",
+		Time:   now,
+		Fields: Fields{FieldOperationID: "op-1", FieldOperationSetID: "set-1"},
+	}
+
+	tests := []struct {
+		name   string
+		filter LogFilter
+		match  bool
+	}{
+		{"empty", LogFilter{}, true},
+		{"lower level", LogFilter{Level: "INFO"}, true},
+		{"same level", LogFilter{Level: "WARN"}, true},
+		{"higher level", LogFilter{Level: "ERROR"}, false},
+		{"since before", LogFilter{Since: now.Add(-time.Second)}, true},
+		{"since after", LogFilter{Since: now.Add(time.Second)}, false},
+		{"until after", LogFilter{Until: now.Add(time.Second)}, true},
+		{"until before", LogFilter{Until: now.Add(-time.Second)}, false},
+		{"operation", LogFilter{OperationID: "op-1"}, true},
+		{"operation set", LogFilter{OperationID: "set-1"}, true},
+		{"other operation", LogFilter{OperationID: "op-2"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.filter.Match(le); got != tt.match {
+			t.Errorf("%s: Match = %t, want %t", tt.name, got, tt.match)
+		}
+	}
+}
+
+func TestPullOutputMaxEntries(t *testing.T) {
+
+	tests := []struct {
+		max    int
+		writes int
+		want   int
+	}{
+		{0, 5, 5},
+		{3, 2, 2},
+		{3, 5, 3},
+	}
+
+	for _, tt := range tests {
+		p := &PullOutput{MaxEntries: tt.max}
+		for i := 0; i < tt.writes; i++ {
+			l := NewLog("INFO", "test_log")
+			l.Infof("event %d", i)
+			p.WriteLog(l)
+			mc, _ := NewMetricCollection()
+			p.WriteMetric(mc)
+		}
+
+		entries := p.Logs(&LogFilter{})
+		if len(entries) != tt.want {
+			t.Errorf("MaxEntries %d after %d writes: %d log events, want %d", tt.max, tt.writes, len(entries), tt.want)
+			continue
+		}
+		if last := entries[len(entries)-1].Description; last != fmt.Sprintf("event %d", tt.writes-1) {
+			t.Errorf("MaxEntries %d after %d writes: newest event is %q", tt.max, tt.writes, last)
+		}
+		if len(p.CacheMetrics) != tt.want {
+			t.Errorf("MaxEntries %d after %d writes: %d metric collections, want %d", tt.max, tt.writes, len(p.CacheMetrics), tt.want)
+		}
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+
+	var l *Logger
+
+	tests := []struct {
+		name string
+		call func()
+	}{
+		{"Infof", func() { l.Infof("discarded") }},
+		{"With", func() { l.With(Fields{FieldComponent: "test"}).Errorf("discarded") }},
+		{"WriteLog", func() { l.WriteLog(testLog(1)) }},
+		{"WriteMetric", func() { l.WriteMetric(&MetricCollection{}) }},
+		{"AddLogOutput", func() { l.AddLogOutput(NewPullOutput()) }},
+		{"AddMetricOutput", func() { l.AddMetricOutput(NewPullOutput()) }},
+		{"HasLogOutputs", func() { l.HasLogOutputs() }},
+		{"Done", func() { l.Done() }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("panicked on a nil Logger: %v", r)
+				}
+			}()
+			tt.call()
+		})
+	}
+}
+
+func TestFileOutputRotate(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		maxFiles int
+		events   int
+		files    int
+	}{
+		{"keeps every rotation", 0, 20, 20},
+		{"prunes the oldest", 3, 20, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			dir, err := ioutil.TempDir("", "rpt-log")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			// A stray file sharing the prefix is neither counted nor pruned.
+			stray := filepath.Join(dir, "rpt-metrics.log")
+			if err := ioutil.WriteFile(stray, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			// Each event fills the file, so the writes below rotate many
+			// times within the same millisecond.
+			f := NewFileOutput(filepath.Join(dir, "rpt.log"), "text")
+			f.MaxSize = 1
+			f.MaxFiles = tt.maxFiles
+			if err := f.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			f.WriteLog(testLog(tt.events))
+			f.Done()
+
+			names, err := filepath.Glob(filepath.Join(dir, "rpt*.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := map[string]bool{}
+			files := 0
+			for _, name := range names {
+				if name == stray {
+					continue
+				}
+				files++
+				b, err := ioutil.ReadFile(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+					lines[line[strings.LastIndex(line, " INFO ")+6:]] = true
+				}
+			}
+
+			if files != tt.files {
+				t.Errorf("%d files, want %d", files, tt.files)
+			}
+			if tt.maxFiles == 0 && len(lines) != tt.events {
+				t.Errorf("%d distinct events kept, want %d", len(lines), tt.events)
+			}
+			if tt.maxFiles > 0 && !lines[fmt.Sprintf("event %d", tt.events-1)] {
+				t.Errorf("newest event was pruned")
+			}
+			if _, err := os.Stat(stray); err != nil {
+				t.Errorf("stray file: %s", err)
+			}
+		})
+	}
+}
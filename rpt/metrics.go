@@ -0,0 +1,157 @@
+package rpt
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// MetricKind tells outputs how to aggregate a Metric.
+type MetricKind string
+
+const (
+	MetricCounter   MetricKind = "counter"   // values are added
+	MetricGauge     MetricKind = "gauge"     // the last value wins
+	MetricHistogram MetricKind = "histogram" // values are observed into buckets
+	MetricSummary   MetricKind = "summary"   // values are observed for quantiles
+)
+
+// INSTRUMENTS
+
+// Counter, Gauge and Histogram create typed Metrics with a fixed name and
+// label set. They do not hold any state, so they are safe for concurrent use.
+// Each Metric gets its own copy of the labels, so changing the map later does
+// not change what was already recorded.
+
+type Counter struct {
+	Name   string
+	Labels map[string]string
+}
+
+func NewCounter(name string, labels map[string]string) *Counter {
+	return &Counter{Name: name, Labels: labels}
+}
+
+func (c *Counter) Add(v float64) *Metric {
+	return newMetric(MetricCounter, c.Name, c.Labels, v)
+}
+
+func (c *Counter) Inc() *Metric {
+	return c.Add(1)
+}
+
+type Gauge struct {
+	Name   string
+	Labels map[string]string
+}
+
+func NewGauge(name string, labels map[string]string) *Gauge {
+	return &Gauge{Name: name, Labels: labels}
+}
+
+func (g *Gauge) Set(v float64) *Metric {
+	return newMetric(MetricGauge, g.Name, g.Labels, v)
+}
+
+type Histogram struct {
+	Name   string
+	Labels map[string]string
+	Kind   MetricKind // MetricHistogram or MetricSummary
+}
+
+func NewHistogram(name string, labels map[string]string) *Histogram {
+	return &Histogram{Name: name, Labels: labels, Kind: MetricHistogram}
+}
+
+func NewSummary(name string, labels map[string]string) *Histogram {
+	return &Histogram{Name: name, Labels: labels, Kind: MetricSummary}
+}
+
+func (h *Histogram) Observe(v float64) *Metric {
+	return newMetric(h.Kind, h.Name, h.Labels, v)
+}
+
+func (h *Histogram) ObserveDuration(d time.Duration) *Metric {
+	return h.Observe(d.Seconds())
+}
+
+func newMetric(kind MetricKind, name string, labels map[string]string, v float64) *Metric {
+
+	l := make(map[string]string, len(labels))
+	for k, v := range labels {
+		l[k] = v
+	}
+
+	return &Metric{
+		Kind:      kind,
+		Label:     name,
+		Value:     v,
+		Labels:    l,
+		Timestamp: time.Now(),
+	}
+}
+
+// PERCENTILES
+
+type Percentiles struct {
+	Count int
+	P50   float64
+	P95   float64
+	P99   float64
+}
+
+// Percentiles returns p50, p95 and p99 of every metric called name whose
+// labels include match.
+func (mc *MetricCollection) Percentiles(name string, match map[string]string) *Percentiles {
+
+	values := []float64{}
+	for _, m := range mc.Metrics {
+		if m.Label != name || !labelsMatch(m.Labels, match) {
+			continue
+		}
+		if v, ok := metricFloat(m.Value); ok {
+			values = append(values, v)
+		}
+	}
+
+	sort.Float64s(values)
+
+	return &Percentiles{
+		Count: len(values),
+		P50:   quantile(values, 0.5),
+		P95:   quantile(values, 0.95),
+		P99:   quantile(values, 0.99),
+	}
+}
+
+// quantile uses the nearest-rank method on sorted values.
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	return sorted[rank]
+}
+
+func labelsMatch(labels, match map[string]string) bool {
+	for k, v := range match {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func labelsWith(labels map[string]string, key, value string) map[string]string {
+	l := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		l[k] = v
+	}
+	l[key] = value
+	return l
+}
@@ -0,0 +1,75 @@
+package rpt
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricLabelsAreCopied(t *testing.T) {
+
+	labels := map[string]string{"operation": "query"}
+
+	tests := []struct {
+		name   string
+		metric *Metric
+	}{
+		{"counter", NewCounter("rpt_operations_total", labels).Inc()},
+		{"gauge", NewGauge("rpt_replication_lag_bytes", labels).Set(1)},
+		{"histogram", NewHistogram("rpt_operation_duration_seconds", labels).Observe(1)},
+		{"summary", NewSummary("rpt_operation_latency_seconds", labels).Observe(1)},
+	}
+
+	labels["operation"] = "seed_data"
+
+	for _, tt := range tests {
+		if got := tt.metric.Labels["operation"]; got != "query" {
+			t.Errorf("%s: operation label = %q after the map changed, want query", tt.name, got)
+		}
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+
+	mc, _ := NewMetricCollection()
+	for i := 1; i <= 100; i++ {
+		mc.AddMetric(NewHistogram("d", map[string]string{"operation": "query"}).Observe(float64(i)))
+	}
+	mc.AddMetric(NewHistogram("d", map[string]string{"operation": "seed"}).Observe(1000))
+
+	tests := []struct {
+		match map[string]string
+		want  Percentiles
+	}{
+		{map[string]string{"operation": "query"}, Percentiles{Count: 100, P50: 50, P95: 95, P99: 99}},
+		{map[string]string{"operation": "seed"}, Percentiles{Count: 1, P50: 1000, P95: 1000, P99: 1000}},
+		{map[string]string{"operation": "lag"}, Percentiles{}},
+	}
+
+	for _, tt := range tests {
+		if got := mc.Percentiles("d", tt.match); *got != tt.want {
+			t.Errorf("Percentiles(%v) = %+v, want %+v", tt.match, *got, tt.want)
+		}
+	}
+}
+
+func TestOperationLatencySummary(t *testing.T) {
+
+	dbo := newDBOperation("query", nil, nil, func(DBClient, DataSet) (interface{}, error) {
+		time.Sleep(time.Millisecond)
+		return "", nil
+	})
+	dbo.Start()
+
+	p := NewPrometheusOutput()
+	p.WriteMetric(dbo.Metrics())
+
+	b := &strings.Builder{}
+	p.WriteTo(b)
+
+	for _, q := range []string{"0.5", "0.95", "0.99"} {
+		if !strings.Contains(b.String(), `rpt_operation_latency_seconds{operation="query",quantile="`+q+`",workflow=""}`) {
+			t.Errorf("no %s quantile for the operation in:\n%s", q, b.String())
+		}
+	}
+}
@@ -0,0 +1,589 @@
+package rpt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/gddo/httputil/header"
+)
+
+/*
+
+The API is described by the route table in routes. SetupRoutes registers it
+and OpenAPI turns it into an OpenAPI 3 document, served at GET /openapi.json,
+so the two can't drift apart.
+
+Routes with a request schema have their JSON bodies checked against it before
+the handler decodes them. Validation covers the parts of JSON Schema the
+document uses: type, properties, required, additionalProperties, items, enum
+and minLength. Property names match case-insensitively, like encoding/json.
+
+*/
+
+const openAPIVersion = "3.0.3"
+
+// apiRoute describes one path of the API.
+type apiRoute struct {
+	path        string // relative to BasePath; {name} segments are path parameters
+	methods     []string
+	handler     http.HandlerFunc
+	summary     string
+	query       []apiParam
+	request     string         // schema of the JSON request body
+	status      int            // success status, 200 if not set
+	response    string         // schema of the success response
+	contentType string         // of the success response, application/json if not set
+	alternate   map[int]string // other success statuses and their schemas
+	idempotent  bool           // POSTs honour Idempotency-Key
+}
+
+type apiParam struct {
+	name        string
+	description string
+}
+
+var logFilterParams = []apiParam{
+	{"level", "Minimum level: DEBUG, INFO, WARN or ERROR"},
+	{"since", "RFC 3339 time, or a duration such as 5m meaning 5 minutes ago"},
+	{"until", "RFC 3339 time, or a duration such as 5m meaning 5 minutes ago"},
+	{"operation_id", "An operation or operation set ID"},
+}
+
+func (a *APIServer) routes() []*apiRoute {
+	get, post := http.MethodGet, http.MethodPost
+	return []*apiRoute{
+		{path: "health", methods: []string{get}, handler: a.HandleHealth, summary: "Liveness check", contentType: "text/plain"},
+		{path: "openapi.json", methods: []string{get}, handler: a.HandleOpenAPI, summary: "This document"},
+		{path: "dashboard", methods: []string{get}, handler: a.HandleDashboard, summary: "Web UI to run and watch operations", contentType: "text/html"},
+		{path: "state", methods: []string{get}, handler: a.HandleState, summary: "Lifecycle state and transition history", response: "State"},
+		{path: "metrics", methods: []string{get}, handler: a.HandleMetrics, summary: "Metrics in the Prometheus text format", contentType: "text/plain"},
+		{path: "close", methods: []string{post}, handler: a.HandleClose, summary: "Process the queued operations, then stop", status: http.StatusAccepted},
+		{path: "query", methods: []string{post}, handler: a.HandleQuery, summary: "Queue a query against a client", request: "DBQueryDataSet", status: http.StatusAccepted, response: "Accepted",
+			query:     []apiParam{{"target", "primary or secondary; primary by default"}, {"wait", "true to answer with the result if the query finishes within timeout"}, {"timeout", "How long to wait, e.g. 5s; 30s by default"}},
+			alternate: map[int]string{http.StatusOK: "DBOperationSetOutput"}, idempotent: true},
+		{path: "workflow", methods: []string{get}, handler: a.HandleWorkflow, summary: "Configured workflows", response: "Workflows"},
+		{path: "workflow/run", methods: []string{post}, handler: a.HandleRunWorkflow, summary: "Queue the steps of a workflow, or a configured workflow, as one operation set", request: "Workflow", status: http.StatusAccepted, response: "Accepted", idempotent: true},
+		{path: "operation/{id}", methods: []string{get}, handler: a.HandleOperation, summary: "Status and output of an operation or operation set", response: "OperationOutput"},
+		{path: "operations", methods: []string{get}, handler: a.HandleOperations, summary: "Operation sets, newest first", response: "OperationSets",
+			query: []apiParam{{"workflow", "A workflow name"}, {"limit", "How many sets to list; 50 by default"}}},
+		{path: "operations/stream", methods: []string{get}, handler: a.HandleOperationStream, summary: "Operation progress as Server-Sent Events", contentType: "text/event-stream", response: "ProgressEvent",
+			query: []apiParam{{"id", "An operation or operation set ID"}, {"workflow", "A workflow name"}}},
+		{path: "logs", methods: []string{get}, handler: a.HandleLogs, summary: "Cached log events, oldest first", query: logFilterParams, response: "Logs"},
+		{path: "logs/stream", methods: []string{get}, handler: a.HandleLogStream, summary: "Log events as Server-Sent Events", query: logFilterParams, contentType: "text/event-stream", response: "LogEntry"},
+		{path: "data/seed", methods: []string{post}, handler: a.HandleSeedData, summary: "Queue seeding the primary with a data set", request: "DBDataSet", status: http.StatusAccepted, response: "Accepted", idempotent: true},
+		{path: "client/configure/{target}", methods: []string{post}, handler: clientTarget(a.HandleConfigureClient), summary: "Configure a client (not supported yet)"},
+		{path: "client/connect/{target}", methods: []string{post}, handler: clientTarget(a.HandleConnectClient), summary: "Queue connecting a client", status: http.StatusAccepted, response: "Accepted"},
+		{path: "client/disconnect/{target}", methods: []string{post}, handler: clientTarget(a.HandleDisconnectClient), summary: "Queue disconnecting a client", status: http.StatusAccepted, response: "Accepted"},
+		{path: "client/reconnect/{target}", methods: []string{post}, handler: clientTarget(a.HandleReconnectClient), summary: "Queue reconnecting a client", status: http.StatusAccepted, response: "Accepted"},
+	}
+}
+
+func (a *APIServer) HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	a.log.Debugf("HandleOpenAPI %s %s", r.Method, r.URL.Path)
+	_, err := w.Write(ToJSON(a.OpenAPI()))
+	if err != nil {
+		a.log.Errorf("Unable to write response: %s", err)
+	}
+}
+
+// OpenAPI returns the OpenAPI 3 document for the server's routes.
+func (a *APIServer) OpenAPI() map[string]interface{} {
+
+	paths := map[string]interface{}{}
+	for _, rt := range a.routes() {
+		item := map[string]interface{}{}
+		for _, m := range rt.methods {
+			item[strings.ToLower(m)] = rt.operation(m)
+		}
+		paths["/"+rt.path] = item
+	}
+
+	components := map[string]interface{}{
+		"schemas": apiSchemas,
+	}
+
+	doc := map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":   "rpt",
+			"version": "1",
+		},
+		"servers": []map[string]string{
+			{"url": a.BasePath},
+		},
+		"paths":      paths,
+		"components": components,
+	}
+
+	if a.Auth != nil {
+		components["securitySchemes"] = map[string]interface{}{
+			"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+		}
+		doc["security"] = []map[string][]string{{"bearer": {}}}
+	}
+
+	return doc
+}
+
+func (rt *apiRoute) operation(method string) map[string]interface{} {
+
+	params := []map[string]interface{}{}
+	for _, s := range splitPath(rt.path) {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			params = append(params, map[string]interface{}{
+				"name":     s[1 : len(s)-1],
+				"in":       "path",
+				"required": true,
+				"schema":   &Schema{Type: "string"},
+			})
+		}
+	}
+	if rt.idempotent && method == http.MethodPost {
+		params = append(params, map[string]interface{}{
+			"name":        IdempotencyKeyHeader,
+			"in":          "header",
+			"description": "Retries with the same key get the original operation set instead of queueing a new one",
+			"schema":      &Schema{Type: "string", MaxLength: maxIdempotencyKeyLength},
+		})
+	}
+	for _, p := range rt.query {
+		params = append(params, map[string]interface{}{
+			"name":        p.name,
+			"in":          "query",
+			"description": p.description,
+			"schema":      &Schema{Type: "string"},
+		})
+	}
+
+	status, contentType := rt.status, rt.contentType
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	success := map[string]interface{}{
+		"description": http.StatusText(status),
+	}
+	if rt.response != "" {
+		success["content"] = map[string]interface{}{
+			contentType: map[string]interface{}{"schema": schemaRef(rt.response)},
+		}
+	} else if contentType != "application/json" {
+		success["content"] = map[string]interface{}{
+			contentType: map[string]interface{}{"schema": &Schema{Type: "string"}},
+		}
+	}
+
+	responses := map[string]interface{}{
+		fmt.Sprint(status): success,
+		"default": map[string]interface{}{
+			"description": "Error",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemaRef("Error")},
+			},
+		},
+	}
+	for st, name := range rt.alternate {
+		responses[fmt.Sprint(st)] = map[string]interface{}{
+			"description": http.StatusText(st),
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemaRef(name)},
+			},
+		}
+	}
+
+	op := map[string]interface{}{
+		"summary":     rt.summary,
+		"operationId": operationID(method, rt.path),
+		"parameters":  params,
+		"responses":   responses,
+	}
+
+	if rt.request != "" && method != http.MethodGet {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemaRef(rt.request)},
+			},
+		}
+	}
+
+	return op
+}
+
+// operationID turns POST client/connect/{target} into postClientConnectTarget.
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, s := range strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == '{' || r == '}' || r == '.' || r == '_'
+	}) {
+		id += strings.ToUpper(s[:1]) + s[1:]
+	}
+	return id
+}
+
+// SCHEMAS
+
+// Schema is the subset of the OpenAPI schema object used by the document.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"` // bool or *Schema
+	Enum                 []string           `json:"enum,omitempty"`
+	MinLength            int                `json:"minLength,omitempty"`
+	MaxLength            int                `json:"maxLength,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+}
+
+func schemaRef(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+var (
+	stringSchema      = &Schema{Type: "string"}
+	stringArraySchema = &Schema{Type: "array", Items: stringSchema}
+	timeSchema        = &Schema{Type: "string", Format: "date-time"}
+	anySchema         = &Schema{}
+)
+
+var apiSchemas = map[string]*Schema{
+	"Error": {
+		Type:     "object",
+		Required: []string{"code", "message"},
+		Properties: map[string]*Schema{
+			"code":    {Type: "string", Description: "Stable error code, e.g. invalid_request"},
+			"message": stringSchema,
+			"details": anySchema,
+		},
+	},
+	"DBQueryDataSet": {
+		Type:                 "object",
+		Required:             []string{"Query"},
+		AdditionalProperties: false,
+		Properties: map[string]*Schema{
+			"Name":  stringSchema,
+			"Query": {Type: "string", MinLength: 1},
+		},
+	},
+	"DBDataSet": {
+		Type:                 "object",
+		Required:             []string{"Name"},
+		AdditionalProperties: false,
+		Properties: map[string]*Schema{
+			"Name":   {Type: "string", MinLength: 1},
+			"Tables": {Type: "object", AdditionalProperties: schemaRef("DataTable")},
+		},
+	},
+	"DataTable": {
+		Type:                 "object",
+		AdditionalProperties: false,
+		Properties: map[string]*Schema{
+			"Columns":     {Type: "object", AdditionalProperties: schemaRef("DataColumn")},
+			"Rows":        stringArraySchema,
+			"Delimiter":   stringSchema,
+			"Constraints": stringArraySchema,
+		},
+	},
+	"DataColumn": {
+		Type:                 "object",
+		AdditionalProperties: false,
+		Properties: map[string]*Schema{
+			"Header":       stringSchema,
+			"DataType":     stringSchema,
+			"Constraints":  stringArraySchema,
+			"DefaultValue": anySchema,
+		},
+	},
+	"Accepted": {
+		Type: "object",
+		Properties: map[string]*Schema{
+			"ID":         {Type: "string", Description: "Operation set ID"},
+			"Operations": {Type: "array", Items: stringSchema, Description: "Operation IDs"},
+		},
+	},
+	"OperationOutput": {
+		OneOf: []*Schema{schemaRef("DBOperationOutput"), schemaRef("DBOperationSetOutput")},
+	},
+	"DBOperationOutput": {
+		Type: "object",
+		Properties: map[string]*Schema{
+			"Started":   timeSchema,
+			"Completed": timeSchema,
+			"Duration":  {Type: "string", Description: "Go duration, e.g. 1.5s"},
+			"Output":    {Type: "object"},
+		},
+	},
+	"DBOperationSetOutput": {
+		Type: "object",
+		Properties: map[string]*Schema{
+			"ID":         stringSchema,
+			"Operations": {Type: "object", AdditionalProperties: schemaRef("DBOperationOutput")},
+		},
+	},
+	"OperationSets": {
+		Type: "object",
+		Properties: map[string]*Schema{
+			"OperationSets": {Type: "array", Items: schemaRef("OperationSetInfo")},
+		},
+	},
+	"OperationSetInfo": {
+		Type: "object",
+		Properties: map[string]*Schema{
+			"ID":         stringSchema,
+			"Workflow":   stringSchema,
+			"Created":    timeSchema,
+			"Done":       {Type: "boolean", Description: "Every operation has run"},
+			"Failed":     {Type: "boolean"},
+			"Operations": {Type: "array", Items: schemaRef("OperationInfo")},
+		},
+	},
+	"OperationInfo": {
+		Type: "object",
+		Properties: map[string]*Schema{
+			"ID":       stringSchema,
+			"Name":     stringSchema,
+			"Done":     {Type: "boolean"},
+			"Failed":   {Type: "boolean"},
+			"Duration": {Type: "number", Description: "Seconds, once done"},
+		},
+	},
+	"State": {
+		Type: "object",
+		Properties: map[string]*Schema{
+			"State":   stringSchema,
+			"History": {Type: "array", Items: &Schema{Type: "object"}},
+		},
+	},
+	"Logs": {
+		Type: "object",
+		Properties: map[string]*Schema{
+			"Logs": {Type: "array", Items: schemaRef("LogEntry")},
+		},
+	},
+	"LogEntry": {
+		Type: "object",
+		Properties: map[string]*Schema{
+			"Log":         stringSchema,
+			"Level":       {Type: "string", Enum: []string{"DEBUG", "INFO", "WARN", "ERROR"}},
+			"Time":        timeSchema,
+			"Description": stringSchema,
+			"Fields":      {Type: "object", AdditionalProperties: stringSchema},
+		},
+	},
+	"Workflow": {
+		Type:                 "object",
+		Required:             []string{"Name"},
+		AdditionalProperties: false,
+		Properties: map[string]*Schema{
+			"Name":  {Type: "string", MinLength: 1},
+			"Steps": {Type: "array", Items: schemaRef("WorkflowStep"), Description: "Leave out to run the configured workflow called Name"},
+		},
+	},
+	"Workflows": {
+		Type: "object",
+		Properties: map[string]*Schema{
+			"Workflows": {Type: "array", Items: schemaRef("Workflow")},
+		},
+	},
+	"WorkflowStep": {
+		Type:                 "object",
+		Required:             []string{"Operation"},
+		AdditionalProperties: false,
+		Properties: map[string]*Schema{
+			"Name":      stringSchema,
+			"Operation": {Type: "string", Enum: []string{"seed", "query", "lag", "compare"}},
+			"Target":    {Type: "string", Enum: []string{"", "primary", "secondary"}},
+			"DataFile":  {Type: "string", Description: "Relative path in the server's data directory, for seed"},
+			"Query":     {Type: "string", Description: "For query and compare"},
+		},
+	},
+	"ProgressEvent": {
+		Type: "object",
+		Properties: map[string]*Schema{
+			"Type":        {Type: "string", Enum: []string{"queued", "started", "step_completed", "metrics_sampled", "finished"}},
+			"Time":        timeSchema,
+			"SetID":       stringSchema,
+			"Workflow":    stringSchema,
+			"OperationID": stringSchema,
+			"Operation":   stringSchema,
+			"Client":      stringSchema,
+			"Step":        {Type: "integer"},
+			"Steps":       {Type: "integer"},
+			"Duration":    {Type: "number", Description: "Seconds"},
+			"Failed":      {Type: "boolean"},
+			"Errors":      stringArraySchema,
+			"Metrics":     {Type: "array", Items: &Schema{Type: "object"}},
+		},
+	},
+}
+
+// VALIDATION
+
+// validateBody checks JSON bodies against the named schema before calling
+// next. Bodies that are not JSON are left for the handler to reject.
+func validateBody(schemaName string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if ct, _ := header.ParseValueAndParams(r.Header, "Content-Type"); ct != "" && ct != "application/json" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var v interface{}
+		if json.Unmarshal(body, &v) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		problems := validateSchema(v, apiSchemas[schemaName], "")
+		if len(problems) > 0 {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidBody, "Request body does not match the "+schemaName+" schema", map[string][]string{"errors": problems})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateSchema returns a description of each way v does not match s. path
+// is the location of v in the document, e.g. Tables.users.Rows[2].
+func validateSchema(v interface{}, s *Schema, path string) []string {
+
+	if s == nil {
+		return nil
+	}
+	if s.Ref != "" {
+		return validateSchema(v, apiSchemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")], path)
+	}
+
+	// encoding/json accepts null for any field.
+	if v == nil && path != "" {
+		return nil
+	}
+
+	at := path
+	if at == "" {
+		at = "body"
+	}
+
+	problems := []string{}
+
+	switch s.Type {
+	case "":
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: must be an object", at)}
+		}
+		problems = append(problems, validateObject(obj, s, path)...)
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: must be an array", at)}
+		}
+		for i, item := range arr {
+			problems = append(problems, validateSchema(item, s.Items, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s: must be a string", at)}
+		}
+		if len(str) < s.MinLength {
+			problems = append(problems, fmt.Sprintf("%s: must not be empty", at))
+		}
+		if len(s.Enum) > 0 && !containsString(s.Enum, str) {
+			problems = append(problems, fmt.Sprintf("%s: must be one of %s", at, strings.Join(s.Enum, ", ")))
+		}
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok {
+			return []string{fmt.Sprintf("%s: must be a number", at)}
+		}
+		if s.Type == "integer" && n != float64(int64(n)) {
+			return []string{fmt.Sprintf("%s: must be an integer", at)}
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return []string{fmt.Sprintf("%s: must be a boolean", at)}
+		}
+	}
+
+	return problems
+}
+
+func validateObject(obj map[string]interface{}, s *Schema, path string) []string {
+
+	problems := []string{}
+
+	prefix := path
+	if prefix != "" {
+		prefix += "."
+	}
+
+	// Match property names the way encoding/json does.
+	props := map[string]string{}
+	for name := range s.Properties {
+		props[strings.ToLower(name)] = name
+	}
+
+	present := map[string]bool{}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if name, ok := props[strings.ToLower(k)]; ok {
+			present[name] = true
+			problems = append(problems, validateSchema(obj[k], s.Properties[name], prefix+name)...)
+			continue
+		}
+		switch ap := s.AdditionalProperties.(type) {
+		case bool:
+			if !ap {
+				problems = append(problems, fmt.Sprintf("%s%s: unknown field", prefix, k))
+			}
+		case *Schema:
+			problems = append(problems, validateSchema(obj[k], ap, prefix+k)...)
+		}
+	}
+
+	for _, name := range s.Required {
+		if !present[name] {
+			problems = append(problems, fmt.Sprintf("%s%s: required", prefix, name))
+		}
+	}
+
+	return problems
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package rpt
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestValidateSchema(t *testing.T) {
+
+	counts := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"Step":   {Type: "integer"},
+			"Ratio":  {Type: "number"},
+			"Failed": {Type: "boolean"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		schema   *Schema
+		body     string
+		problems []string
+	}{
+		{"query", apiSchemas["DBQueryDataSet"], `{"Name":"count","Query":"SELECT 1"}`, nil},
+		{"field names ignore case", apiSchemas["DBQueryDataSet"], `{"query":"SELECT 1"}`, nil},
+		{"null field", apiSchemas["DBQueryDataSet"], `{"Name":null,"Query":"SELECT 1"}`, nil},
+		{"not an object", apiSchemas["DBQueryDataSet"], `["SELECT 1"]`, []string{"body: must be an object"}},
+		{"null body", apiSchemas["DBQueryDataSet"], `null`, []string{"body: must be an object"}},
+		{
+			"every problem is reported", apiSchemas["DBQueryDataSet"], `{"Name":1,"Quer":"SELECT 1"}`,
+			[]string{"Name: must be a string", "Quer: unknown field", "Query: required"},
+		},
+		{"empty string", apiSchemas["DBQueryDataSet"], `{"Query":""}`, []string{"Query: must not be empty"}},
+		{
+			"workflow", apiSchemas["Workflow"],
+			`{"Name":"check","Steps":[{"Operation":"seed","DataFile":"users.json"},{"Operation":"query","Target":"secondary","Query":"SELECT 1"}]}`,
+			nil,
+		},
+		{
+			"nested problems", apiSchemas["Workflow"],
+			`{"Name":"check","Steps":[{"Operation":"seed"},{"Operation":"drop","Target":"tertiary"},"lag"]}`,
+			[]string{
+				"Steps[1].Operation: must be one of seed, query, lag, compare",
+				"Steps[1].Target: must be one of , primary, secondary",
+				"Steps[2]: must be an object",
+			},
+		},
+		{"steps not an array", apiSchemas["Workflow"], `{"Name":"check","Steps":{}}`, []string{"Steps: must be an array"}},
+		{
+			"additional properties schema", apiSchemas["DBDataSet"],
+			`{"Name":"users","Tables":{"users":{"Rows":["1,alice"],"Columns":{"id":{"Header":"id","Unique":true}}},"roles":[]}}`,
+			[]string{"Tables.roles: must be an object", "Tables.users.Columns.id.Unique: unknown field"},
+		},
+		{"numbers", counts, `{"Step":2,"Ratio":0.5,"Failed":false}`, nil},
+		{
+			"wrong numbers", counts, `{"Step":2.5,"Ratio":"half","Failed":0}`,
+			[]string{"Failed: must be a boolean", "Ratio: must be a number", "Step: must be an integer"},
+		},
+		{"no schema", nil, `{"anything":true}`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			var v interface{}
+			if err := json.Unmarshal([]byte(tt.body), &v); err != nil {
+				t.Fatal(err)
+			}
+
+			problems := validateSchema(v, tt.schema, "")
+			if len(problems) == 0 && len(tt.problems) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(problems, tt.problems) {
+				t.Errorf("problems = %q, want %q", problems, tt.problems)
+			}
+		})
+	}
+}
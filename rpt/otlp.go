@@ -0,0 +1,328 @@
+package rpt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+OTLPExporter sends spans to an OpenTelemetry collector using OTLP over HTTP
+with JSON encoding. Spans are posted to Endpoint/v1/traces every
+FlushInterval, or as soon as BatchSize spans are waiting. While the collector
+is unavailable spans are kept and retried on the next flush; once MaxQueue
+spans are waiting the oldest are dropped.
+
+*/
+
+const (
+	defaultOTLPFlushInterval = 5 * time.Second
+	defaultOTLPBatchSize     = 512
+	defaultOTLPMaxQueue      = 2048
+)
+
+type OTLPExporter struct {
+	Endpoint      string
+	Headers       map[string]string
+	ServiceName   string
+	FlushInterval time.Duration
+	BatchSize     int
+	MaxQueue      int
+	Client        *http.Client
+	Logger        *Logger
+	mu            sync.Mutex
+	queue         []*Span
+	dropped       int
+	flush         chan struct{}
+	done          chan struct{}
+	wg            sync.WaitGroup
+}
+
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	return &OTLPExporter{
+		Endpoint:      endpoint,
+		ServiceName:   serviceName,
+		Headers:       map[string]string{},
+		FlushInterval: defaultOTLPFlushInterval,
+		BatchSize:     defaultOTLPBatchSize,
+		MaxQueue:      defaultOTLPMaxQueue,
+		Client:        &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Start starts the flush loop.
+func (o *OTLPExporter) Start() {
+
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = defaultOTLPFlushInterval
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaultOTLPBatchSize
+	}
+	if o.MaxQueue <= 0 {
+		o.MaxQueue = defaultOTLPMaxQueue
+	}
+	if o.Client == nil {
+		o.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	o.flush = make(chan struct{}, 1)
+	o.done = make(chan struct{})
+
+	o.wg.Add(1)
+	go o.process()
+}
+
+func (o *OTLPExporter) ExportSpan(s *Span) {
+
+	o.mu.Lock()
+	o.queue = append(o.queue, s)
+	if len(o.queue) > o.MaxQueue {
+		n := len(o.queue) - o.MaxQueue
+		o.dropped += n
+		o.queue = o.queue[n:]
+	}
+	full := len(o.queue) >= o.BatchSize
+	o.mu.Unlock()
+
+	if full && o.flush != nil {
+		select {
+		case o.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Shutdown stops the flush loop after one last attempt to send the queue.
+func (o *OTLPExporter) Shutdown() {
+
+	if o.done == nil {
+		return
+	}
+
+	close(o.done)
+	o.wg.Wait()
+	o.done = nil
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.queue) > 0 || o.dropped > 0 {
+		o.Logger.Warnf("OTLP exporter: %d spans were not exported", len(o.queue)+o.dropped)
+	}
+}
+
+func (o *OTLPExporter) process() {
+
+	defer o.wg.Done()
+
+	ticker := time.NewTicker(o.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.done:
+			o.send()
+			return
+		case <-o.flush:
+		case <-ticker.C:
+		}
+
+		if err := o.send(); err != nil {
+			o.Logger.Warnf("OTLP exporter: %s, retrying in %s", err, o.FlushInterval)
+		}
+	}
+}
+
+// send posts batches until the queue is empty. A batch that fails with a
+// retryable status goes back to the front of the queue.
+func (o *OTLPExporter) send() error {
+
+	for {
+		o.mu.Lock()
+		n := len(o.queue)
+		if n > o.BatchSize {
+			n = o.BatchSize
+		}
+		batch := o.queue[:n:n]
+		o.queue = o.queue[n:]
+		o.mu.Unlock()
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		retry, err := o.post(batch)
+		if err != nil {
+			if retry {
+				o.mu.Lock()
+				o.queue = append(batch, o.queue...)
+				o.mu.Unlock()
+			} else {
+				o.Logger.Warnf("OTLP exporter: dropped %d spans: %s", len(batch), err)
+			}
+			return err
+		}
+	}
+}
+
+// post sends one batch. It reports whether a failed batch should be retried.
+func (o *OTLPExporter) post(batch []*Span) (bool, error) {
+
+	body, err := json.Marshal(o.request(batch))
+	if err != nil {
+		return false, err
+	}
+
+	url := strings.TrimSuffix(o.Endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range o.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusServiceUnavailable, resp.StatusCode == http.StatusGatewayTimeout:
+		return true, fmt.Errorf("export failed: %s", resp.Status)
+	default:
+		return false, fmt.Errorf("export failed: %s: %s", resp.Status, msg)
+	}
+}
+
+// OTLP JSON
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 0 unset, 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func (o *OTLPExporter) request(batch []*Span) *otlpRequest {
+
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		span := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.Error != "" {
+			span.Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+		spans = append(spans, span)
+	}
+
+	return &otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: otlpAttributes(map[string]interface{}{"service.name": o.ServiceName}),
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "rpt"},
+				Spans: spans,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpKeyValue {
+
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		var v map[string]interface{}
+		switch a := attrs[k].(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": a}
+		case bool:
+			v = map[string]interface{}{"boolValue": a}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(a)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(a, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": a}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(a)}
+		}
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: v})
+	}
+
+	return kvs
+}
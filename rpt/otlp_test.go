@@ -0,0 +1,275 @@
+package rpt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector stands in for an OpenTelemetry collector receiving OTLP/HTTP
+// JSON. reply decides the status of the nth request, counting from 0; the
+// spans of requests answered with 200 are recorded.
+type collector struct {
+	*httptest.Server
+	reply func(n int) int
+
+	mu       sync.Mutex
+	requests int
+	posted   int // spans posted, whatever the reply
+	paths    []string
+	headers  []http.Header
+	service  string
+	spans    []otlpSpan
+}
+
+func newCollector(reply func(n int) int) *collector {
+
+	c := &collector{reply: reply}
+	c.Server = httptest.NewServer(http.HandlerFunc(c.handle))
+
+	return c
+}
+
+func (c *collector) handle(w http.ResponseWriter, r *http.Request) {
+
+	req := &otlpRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.requests
+	c.requests++
+	c.paths = append(c.paths, r.URL.Path)
+	c.headers = append(c.headers, r.Header)
+
+	status := http.StatusOK
+	if c.reply != nil {
+		status = c.reply(n)
+	}
+
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.posted += len(ss.Spans)
+		}
+	}
+
+	if status == http.StatusOK {
+		for _, rs := range req.ResourceSpans {
+			for _, kv := range rs.Resource.Attributes {
+				if kv.Key == "service.name" {
+					c.service, _ = kv.Value["stringValue"].(string)
+				}
+			}
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}
+
+	w.WriteHeader(status)
+}
+
+// waitSpans waits until n spans have been received.
+func (c *collector) waitSpans(t *testing.T, n int) {
+
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		got := len(c.spans)
+		c.mu.Unlock()
+		if got >= n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d spans", n)
+}
+
+func TestOTLPExporter(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		path     string
+		reply    func(n int) int
+		spans    int
+		received int
+	}{
+		{
+			name:     "appends the traces path",
+			spans:    2,
+			received: 2,
+		},
+		{
+			name:     "keeps the traces path",
+			path:     "/v1/traces",
+			spans:    1,
+			received: 1,
+		},
+		{
+			name: "retries an unavailable collector",
+			reply: func(n int) int {
+				if n == 0 {
+					return http.StatusServiceUnavailable
+				}
+				return http.StatusOK
+			},
+			spans:    3,
+			received: 3,
+		},
+		{
+			name: "drops rejected spans",
+			reply: func(n int) int {
+				return http.StatusBadRequest
+			},
+			spans:    3,
+			received: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			c := newCollector(tt.reply)
+			defer c.Close()
+
+			o := NewOTLPExporter(c.URL+tt.path, "rpt-test")
+			o.Headers["X-Api-Key"] = "secret"
+			o.FlushInterval = 10 * time.Millisecond
+			o.Start()
+
+			tracer := NewTracer(o)
+			for i := 0; i < tt.spans; i++ {
+				_, span := tracer.Start(context.Background(), "operation", SpanKindInternal)
+				span.End()
+			}
+
+			if tt.received > 0 {
+				c.waitSpans(t, tt.received)
+			}
+			tracer.Shutdown()
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			if len(c.spans) != tt.received {
+				t.Errorf("received %d spans, want %d", len(c.spans), tt.received)
+			}
+			if tt.received == 0 && c.posted != tt.spans {
+				t.Errorf("posted %d spans, want %d without retries", c.posted, tt.spans)
+			}
+			for i, path := range c.paths {
+				if path != "/v1/traces" {
+					t.Errorf("posted to %q, want /v1/traces", path)
+				}
+				if got := c.headers[i].Get("X-Api-Key"); got != "secret" {
+					t.Errorf("X-Api-Key = %q, want secret", got)
+				}
+			}
+			if tt.received > 0 && c.service != "rpt-test" {
+				t.Errorf("service.name = %q, want rpt-test", c.service)
+			}
+		})
+	}
+}
+
+func TestOTLPExporterSpans(t *testing.T) {
+
+	c := newCollector(nil)
+	defer c.Close()
+
+	o := NewOTLPExporter(c.URL, "rpt")
+	o.FlushInterval = 10 * time.Millisecond
+	o.Start()
+	tracer := NewTracer(o)
+
+	h := http.Header{}
+	h.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := tracer.Extract(context.Background(), h)
+
+	ctx, parent := StartSpan(ctx, "POST /query", SpanKindServer)
+	_, child := StartSpan(ctx, "query", SpanKindClient)
+	child.SetAttribute("rows", 3)
+	child.SetError(errors.New("timeout"))
+	child.End()
+	parent.End()
+
+	c.waitSpans(t, 2)
+	tracer.Shutdown()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	spans := map[string]otlpSpan{}
+	for _, s := range c.spans {
+		spans[s.Name] = s
+	}
+
+	tests := []struct {
+		name       string
+		parentID   string
+		kind       SpanKind
+		statusCode int
+	}{
+		{"POST /query", "00f067aa0ba902b7", SpanKindServer, 0},
+		{"query", parent.SpanID, SpanKindClient, 2},
+	}
+
+	for _, tt := range tests {
+		s, ok := spans[tt.name]
+		if !ok {
+			t.Errorf("span %q was not exported", tt.name)
+			continue
+		}
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span %q has trace ID %q, want the incoming trace", tt.name, s.TraceID)
+		}
+		if s.ParentSpanID != tt.parentID {
+			t.Errorf("span %q has parent %q, want %q", tt.name, s.ParentSpanID, tt.parentID)
+		}
+		if s.Kind != tt.kind {
+			t.Errorf("span %q has kind %d, want %d", tt.name, s.Kind, tt.kind)
+		}
+		if s.Status.Code != tt.statusCode {
+			t.Errorf("span %q has status %d, want %d", tt.name, s.Status.Code, tt.statusCode)
+		}
+	}
+
+	attrs := spans["query"].Attributes
+	if len(attrs) != 1 || attrs[0].Key != "rows" || attrs[0].Value["intValue"] != "3" {
+		t.Errorf("query span attributes = %+v, want rows = 3", attrs)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+
+	tests := []struct {
+		header string
+		ok     bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{" 00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-00 ", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if _, ok := parseTraceparent(tt.header); ok != tt.ok {
+			t.Errorf("parseTraceparent(%q) ok = %t, want %t", tt.header, ok, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package rpt
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+
+Progress passes the life of each operation set to anyone watching, such as
+the /operations/stream endpoint. Every set is queued, started, completes each
+of its steps (with the metrics that step sampled) and finishes:
+
+	queued -> started -> step_completed, metrics_sampled ... -> finished
+
+Events are published from RptClient.Process as the sets run. Subscribers that
+fall behind miss events rather than holding up the operations.
+
+*/
+
+type ProgressEventType string
+
+const (
+	ProgressQueued         ProgressEventType = "queued"
+	ProgressStarted        ProgressEventType = "started"
+	ProgressStepCompleted  ProgressEventType = "step_completed"
+	ProgressMetricsSampled ProgressEventType = "metrics_sampled"
+	ProgressFinished       ProgressEventType = "finished"
+)
+
+type ProgressEvent struct {
+	Type        ProgressEventType
+	Time        time.Time
+	SetID       string
+	Workflow    string    `json:",omitempty"`
+	OperationID string    `json:",omitempty"`
+	Operation   string    `json:",omitempty"`
+	Client      string    `json:",omitempty"`
+	Step        int       `json:",omitempty"` // 1-based
+	Steps       int       `json:",omitempty"`
+	Duration    float64   `json:",omitempty"` // seconds
+	Failed      bool      `json:",omitempty"`
+	Errors      []string  `json:",omitempty"`
+	Metrics     []*Metric `json:",omitempty"`
+}
+
+// ProgressFilter selects the events a subscriber is interested in. Empty
+// fields match everything.
+type ProgressFilter struct {
+	ID       string // an operation set or operation ID
+	Workflow string
+}
+
+func (f *ProgressFilter) Match(e *ProgressEvent) bool {
+	if f == nil {
+		return true
+	}
+	if f.ID != "" && e.SetID != f.ID && e.OperationID != f.ID {
+		return false
+	}
+	if f.Workflow != "" && e.Workflow != f.Workflow {
+		return false
+	}
+	return true
+}
+
+type Progress struct {
+	mu          sync.Mutex
+	subscribers map[chan *ProgressEvent]struct{}
+	closed      bool
+}
+
+func NewProgress() *Progress {
+	return &Progress{
+		subscribers: map[chan *ProgressEvent]struct{}{},
+	}
+}
+
+// Publish sends e to every subscriber that has room for it. It is safe to
+// call on a nil *Progress.
+func (p *Progress) Publish(e *ProgressEvent) {
+	if p == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for sub := range p.subscribers {
+		select {
+		case sub <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel that receives every event published from now
+// on, and a function that ends the subscription. The channel holds up to size
+// events. It is closed by the returned function or by Close, and is already
+// closed when Subscribe is called after Close.
+func (p *Progress) Subscribe(size int) (<-chan *ProgressEvent, func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sub := make(chan *ProgressEvent, size)
+	if p.closed {
+		close(sub)
+		return sub, func() {}
+	}
+	if p.subscribers == nil {
+		p.subscribers = map[chan *ProgressEvent]struct{}{}
+	}
+	p.subscribers[sub] = struct{}{}
+
+	return sub, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if _, ok := p.subscribers[sub]; ok {
+			delete(p.subscribers, sub)
+			close(sub)
+		}
+	}
+}
+
+// Close ends every subscription.
+func (p *Progress) Close() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	for sub := range p.subscribers {
+		close(sub)
+	}
+	p.subscribers = nil
+	p.closed = true
+	p.mu.Unlock()
+}
+
+// setEvent returns an event of type t describing dbos.
+func setEvent(t ProgressEventType, dbos *DBOperationSet) *ProgressEvent {
+	return &ProgressEvent{
+		Type:     t,
+		SetID:    dbos.ID,
+		Workflow: dbos.Workflow,
+		Steps:    len(dbos.Operations),
+	}
+}
+
+// stepEvent returns an event of type t describing the operation at index i of
+// dbos.
+func stepEvent(t ProgressEventType, dbos *DBOperationSet, i int, op *DBOperation) *ProgressEvent {
+	e := setEvent(t, dbos)
+	e.OperationID = op.ID
+	e.Operation = op.Name
+	e.Client = op.labels["client"]
+	e.Step = i + 1
+	return e
+}
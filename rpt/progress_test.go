@@ -0,0 +1,58 @@
+package rpt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgressSubscribe(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		progress func() *Progress
+		closed   bool
+		received int
+	}{
+		{"open", NewProgress, false, 2},
+		{"zero value", func() *Progress { return &Progress{} }, false, 2},
+		{"after Close", func() *Progress {
+			p := NewProgress()
+			p.Close()
+			return p
+		}, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			p := tt.progress()
+			events, cancel := p.Subscribe(4)
+			p.Publish(&ProgressEvent{Type: ProgressQueued, SetID: "set-1"})
+			p.Publish(&ProgressEvent{Type: ProgressQueued, SetID: "set-2"})
+			if !tt.closed {
+				p.Close()
+			}
+
+			received := 0
+			timeout := time.After(time.Second)
+			for done := false; !done; {
+				select {
+				case _, ok := <-events:
+					if !ok {
+						done = true
+						continue
+					}
+					received++
+				case <-timeout:
+					t.Fatal("subscription was not closed")
+				}
+			}
+			cancel()
+			cancel()
+
+			if received != tt.received {
+				t.Errorf("received %d events, want %d", received, tt.received)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package rpt
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+PrometheusOutput aggregates every MetricCollection it is given and serves the
+result in the Prometheus text exposition format. Reading does not reset
+anything, so any number of scrapers can read /metrics.
+
+The metric type comes from Metric.Kind. Untyped metrics fall back to the
+Prometheus naming conventions:
+
+	*_total             counter    values are added
+	*_duration_seconds  histogram  values are observed into defaultBuckets
+	otherwise           gauge      the last value wins
+
+Summaries report summaryQuantiles over the last summaryWindow observations of
+each series.
+
+*/
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var summaryQuantiles = []float64{0.5, 0.95, 0.99}
+
+const summaryWindow = 1024
+
+var invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type PrometheusOutput struct {
+	Description string
+	families    map[string]*promFamily
+	mu          sync.RWMutex
+}
+
+type promFamily struct {
+	name   string
+	kind   MetricKind
+	series map[string]*promSeries
+}
+
+type promSeries struct {
+	labels       map[string]string
+	value        float64 // counter and gauge value, histogram and summary sum
+	count        uint64
+	buckets      []uint64
+	observations []float64 // summary window, oldest first
+}
+
+func NewPrometheusOutput() *PrometheusOutput {
+	return &PrometheusOutput{
+		Description: "prometheus_output",
+		families:    map[string]*promFamily{},
+	}
+}
+
+func (p *PrometheusOutput) WriteLog(l *Log) {}
+
+func (p *PrometheusOutput) WriteMetric(mc *MetricCollection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, m := range mc.Metrics {
+		v, ok := metricFloat(m.Value)
+		if !ok {
+			continue
+		}
+
+		name := promName(m.Label)
+		f, ok := p.families[name]
+		if !ok {
+			kind := m.Kind
+			if kind == "" {
+				kind = promKind(name)
+			}
+			f = &promFamily{
+				name:   name,
+				kind:   kind,
+				series: map[string]*promSeries{},
+			}
+			p.families[name] = f
+		}
+
+		key := promLabels(m.Labels)
+		s, ok := f.series[key]
+		if !ok {
+			s = &promSeries{labels: m.Labels}
+			if f.kind == MetricHistogram {
+				s.buckets = make([]uint64, len(defaultBuckets))
+			}
+			f.series[key] = s
+		}
+
+		switch f.kind {
+		case MetricCounter:
+			s.value += v
+		case MetricGauge:
+			s.value = v
+		case MetricHistogram:
+			s.value += v
+			s.count++
+			for i, b := range defaultBuckets {
+				if v <= b {
+					s.buckets[i]++
+				}
+			}
+		case MetricSummary:
+			s.value += v
+			s.count++
+			s.observations = append(s.observations, v)
+			if len(s.observations) > summaryWindow {
+				s.observations = s.observations[1:]
+			}
+		}
+	}
+}
+
+func (p *PrometheusOutput) Connect() error {
+	return nil
+}
+
+func (p *PrometheusOutput) Done() {}
+
+func (p *PrometheusOutput) GetDescription() string {
+	return p.Description
+}
+
+func (p *PrometheusOutput) resetLogs() {}
+
+func (p *PrometheusOutput) resetMetrics() {
+	p.mu.Lock()
+	p.families = map[string]*promFamily{}
+	p.mu.Unlock()
+}
+
+func (p *PrometheusOutput) pullLogs() *map[string]interface{} { return nil }
+
+func (p *PrometheusOutput) pullMetrics() *map[string]interface{} { return nil }
+
+// WriteTo writes every metric family in the text exposition format.
+func (p *PrometheusOutput) WriteTo(w io.Writer) (int64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	b := &strings.Builder{}
+
+	names := make([]string, 0, len(p.families))
+	for n := range p.families {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		f := p.families[n]
+		fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			s := f.series[k]
+			switch f.kind {
+			case MetricHistogram:
+				for i, le := range defaultBuckets {
+					fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, promLabelsWith(s.labels, "le", promFloat(le)), s.buckets[i])
+				}
+				fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, promLabelsWith(s.labels, "le", "+Inf"), s.count)
+			case MetricSummary:
+				sorted := append([]float64{}, s.observations...)
+				sort.Float64s(sorted)
+				for _, q := range summaryQuantiles {
+					fmt.Fprintf(b, "%s%s %s\n", f.name, promLabelsWith(s.labels, "quantile", promFloat(q)), promFloat(quantile(sorted, q)))
+				}
+			default:
+				fmt.Fprintf(b, "%s%s %s\n", f.name, k, promFloat(s.value))
+				continue
+			}
+			fmt.Fprintf(b, "%s_sum%s %s\n", f.name, k, promFloat(s.value))
+			fmt.Fprintf(b, "%s_count%s %d\n", f.name, k, s.count)
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func promName(label string) string {
+	name := invalidMetricChars.ReplaceAllString(label, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+func promKind(name string) MetricKind {
+	switch {
+	case strings.HasSuffix(name, "_total"):
+		return MetricCounter
+	case strings.HasSuffix(name, "_duration_seconds"):
+		return MetricHistogram
+	default:
+		return MetricGauge
+	}
+}
+
+// promLabels renders a label set as {a="1",b="2"} with the keys sorted, which
+// also makes it usable as a series key.
+func promLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, promName(k), labelValueEscaper.Replace(labels[k]))
+	}
+
+	return fmt.Sprintf("{%s}", strings.Join(pairs, ","))
+}
+
+func promLabelsWith(labels map[string]string, key, value string) string {
+	return promLabels(labelsWith(labels, key, value))
+}
+
+func promFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// metricFloat converts a Metric value to a float64. Durations are converted
+// to seconds and booleans to 0 or 1.
+func metricFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case time.Duration:
+		return n.Seconds(), true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
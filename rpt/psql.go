@@ -1,11 +1,13 @@
 package rpt
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
 	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -54,6 +56,9 @@ type PostgresClient struct {
 	SSLMode  string
 	Client   *sql.DB
 	Logger   *Logger
+
+	ctx   context.Context // carries the span of the running operation
+	ctxMu sync.Mutex
 }
 
 type PostgresDatabase struct {
@@ -113,28 +118,30 @@ func (psql *PostgresClient) Reconnect() error {
 
 func (psql *PostgresClient) Seed(d DataSet) (interface{}, error) {
 
-	log.Println("Seeding...")
-
 	dsJson := ToJSON(d)
 	ds := &DBDataSet{}
 	err := json.Unmarshal(dsJson, ds)
 	if err != nil {
-
+		return nil, err
 	}
 
 	ds.Name = sanitize(ds.Name)
+	psql.Logger.Infof("Seeding %s", ds.Name)
 
 	_ = psql.createDB(ds.Name)
 	_ = psql.Disconnect()
 	psql.DBName = ds.Name
-	_ = psql.Connect()
+	err = psql.Connect()
+	if err != nil {
+		return nil, err
+	}
 	// createDB(ds.Name)
 
 	tables := ds.Tables
 	for n, t := range tables {
 		err = psql.createTable(n, &t)
 		if err != nil {
-
+			return nil, err
 		}
 	}
 
@@ -143,11 +150,11 @@ func (psql *PostgresClient) Seed(d DataSet) (interface{}, error) {
 
 func (psql *PostgresClient) Query(s string) (interface{}, error) {
 
-	log.Printf("Query: %s", s)
+	psql.Logger.Debugf("Query: %s", s)
 
 	result, err := psql.query(s)
 
-	return convertSqlRows(result), err
+	return convertSqlRows(result, psql.Logger), err
 }
 
 func (psql *PostgresClient) ListDB() (interface{}, error) {
@@ -155,6 +162,30 @@ func (psql *PostgresClient) ListDB() (interface{}, error) {
 	return psql.listDB()
 }
 
+func (psql *PostgresClient) ReplicationStatus() (*ReplicationStatus, error) {
+
+	rs := &ReplicationStatus{}
+
+	err := psql.queryRow(`SELECT pg_is_in_recovery();`, &rs.InRecovery)
+	if err != nil {
+		return nil, err
+	}
+
+	if !rs.InRecovery {
+		err = psql.queryRow(`SELECT pg_current_wal_lsn()::text;`, &rs.LSN)
+		return rs, err
+	}
+
+	var delay float64
+	err = psql.queryRow(`SELECT COALESCE(pg_last_wal_replay_lsn()::text, '0/0'), COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0);`, &rs.LSN, &delay)
+	if err != nil {
+		return nil, err
+	}
+	rs.ReplayDelay = time.Duration(delay * float64(time.Second))
+
+	return rs, nil
+}
+
 func (psql *PostgresClient) listDB() (interface{}, error) {
 
 	rows, err := psql.query(`SELECT * FROM pg_database;`)
@@ -165,7 +196,7 @@ func (psql *PostgresClient) listDB() (interface{}, error) {
 	for rows.Next() {
 		e := rows.Scan(&pdb.Datname, &pdb.Datdba, &pdb.Encoding, &pdb.Datcollate, &pdb.Datctype, &pdb.Datistemplate, &pdb.Datallowconn, &pdb.Datconnlimit, &pdb.Datlastsysoid, &pdb.Datfrozenxid, &pdb.Datminmxid, &pdb.Dattablespace, &pdb.Datacl)
 		if e != nil {
-			fmt.Println(e)
+			psql.Logger.Warnf("Unable to read pg_database row: %s", e)
 		}
 		//fmt.Println(pdb)
 		pdbs[pdb.Datname] = pdb
@@ -184,44 +215,83 @@ func (psql *PostgresClient) newDB(name string) (*sql.Rows, error) {
 
 func (psql *PostgresClient) query(q string) (*sql.Rows, error) {
 
+	span := psql.startSpan(q)
+	defer span.End()
+
 	err := psql.Client.Ping()
 	if err != nil {
+		span.SetError(err)
 		return nil, err
 	}
 
 	rows, err := psql.Client.Query(q)
 	if err != nil {
+		span.SetError(err)
 		return nil, err
 	}
 
 	return rows, nil
 }
 
+func (psql *PostgresClient) queryRow(q string, dest ...interface{}) error {
+
+	span := psql.startSpan(q)
+	defer span.End()
+
+	err := psql.Client.QueryRow(q).Scan(dest...)
+	span.SetError(err)
+
+	return err
+}
+
+func (psql *PostgresClient) setContext(ctx context.Context) {
+	psql.ctxMu.Lock()
+	psql.ctx = ctx
+	psql.ctxMu.Unlock()
+}
+
+// startSpan starts a client span for a SQL statement under the span of the
+// running operation.
+func (psql *PostgresClient) startSpan(statement string) *Span {
+
+	psql.ctxMu.Lock()
+	ctx := psql.ctx
+	psql.ctxMu.Unlock()
+
+	_, span := StartSpan(ctx, "sql", SpanKindClient)
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("db.statement", statement)
+	span.SetAttribute("db.name", psql.DBName)
+	span.SetAttribute("net.peer.name", psql.Host)
+	span.SetAttribute("net.peer.port", psql.Port)
+
+	return span
+}
+
 func (psql *PostgresClient) createDB(name string) error {
 	query := fmt.Sprintf("CREATE DATABASE %s;", sanitize(name))
-	log.Println(query)
-	result, err := psql.query(query)
-	log.Printf("DB Result: \n%s\n", string(ToJSON(result)))
-	log.Printf("DB Error: %s", err)
+	psql.Logger.Debugf("Query: %s", query)
+	_, err := psql.query(query)
+	if err != nil {
+		// The database usually exists already.
+		psql.Logger.Debugf("Unable to create database %s: %s", name, err)
+	}
 
 	return nil
 }
 
 func (psql *PostgresClient) dropDB(name string) error {
 	query := fmt.Sprintf("DROP DATABASE %s;", sanitize(name))
-	log.Println(query)
-	result, err := psql.query(query)
+	psql.Logger.Debugf("Query: %s", query)
+	_, err := psql.query(query)
 
-	log.Println(result)
 	return err
 }
 
 func (psql *PostgresClient) dropTable(name string) error {
 	query := fmt.Sprintf("DROP TABLE %s;", sanitize(name))
-	log.Println(query)
-	result, err := psql.query(query)
-	log.Printf("Drop table Result: \n%s\n", string(ToJSON(result)))
-	log.Printf("Drop table Error: %s", string(ToJSON(err)))
+	psql.Logger.Debugf("Query: %s", query)
+	_, err := psql.query(query)
 
 	return err
 }
@@ -263,12 +333,10 @@ func (psql *PostgresClient) createTable(name string, dt *DataTable) error {
 
 	query = fmt.Sprintf("%s\n);", strings.TrimRight(query, ","))
 
-	log.Println(query)
-	log.Println(rows)
-	log.Println(delim)
+	psql.Logger.Debugf("Query: %s", query)
+	psql.Logger.Debugf("Table %s has %d rows with delimiter %q", name, len(rows), delim)
 
-	result, err := psql.query(query)
-	log.Println(result)
+	_, err := psql.query(query)
 
 	return err
 }
@@ -279,7 +347,7 @@ func sanitize(s string) string {
 	return noSpace
 }
 
-func convertSqlRows(sr *sql.Rows) *SQLOutput {
+func convertSqlRows(sr *sql.Rows, logger *Logger) *SQLOutput {
 
 	output := &SQLOutput{
 		Result: []map[string]interface{}{},
@@ -299,12 +367,17 @@ func convertSqlRows(sr *sql.Rows) *SQLOutput {
 			}
 
 			if err := sr.Scan(columnPointers...); err != nil {
-				log.Println(err)
+				logger.Warnf("Unable to read row: %s", err)
 			}
 
 			m := make(map[string]interface{})
 			for i, colName := range cols {
 				val := columnPointers[i].(*interface{})
+				// text columns come back as []byte, which would marshal to base64
+				if b, ok := (*val).([]byte); ok {
+					m[colName] = string(b)
+					continue
+				}
 				m[colName] = *val
 			}
 
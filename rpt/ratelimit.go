@@ -0,0 +1,109 @@
+package rpt
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+
+RateLimiter gives each API client a token bucket holding up to Burst
+requests, refilled at Rate requests a second. Clients are told apart by their
+authenticated name, or by their IP address when the API has no
+authentication. Requests that fail authentication count against their IP
+address, so credentials can't be guessed faster than Rate. A client with an
+empty bucket gets 429 and a Retry-After header saying when the next request
+will be allowed.
+
+*/
+
+const rateLimitSweepInterval = time.Minute
+
+type RateLimiter struct {
+	Rate  float64 // requests a second
+	Burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: map[string]*rateBucket{},
+	}
+}
+
+// Allow takes a token from client's bucket. If there is none it returns false
+// and how long until there will be.
+func (rl *RateLimiter) Allow(client string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	burst := float64(rl.Burst)
+
+	// Buckets that have refilled are the same as new ones.
+	if now.Sub(rl.lastSweep) >= rateLimitSweepInterval {
+		for k, b := range rl.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rl.Rate >= burst {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	if rl.buckets == nil {
+		rl.buckets = map[string]*rateBucket{}
+	}
+	b, ok := rl.buckets[client]
+	if !ok {
+		b = &rateBucket{tokens: burst, last: now}
+		rl.buckets[client] = b
+	}
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rl.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / rl.Rate * float64(time.Second))
+}
+
+// rateLimitClient names the client of r for rate limiting.
+func rateLimitClient(r *http.Request) string {
+	if p := PrincipalFromContext(r.Context()); p != nil {
+		return "principal:" + p.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// retryAfterSeconds formats d for a Retry-After header, rounding up.
+func retryAfterSeconds(d time.Duration) string {
+	s := int(math.Ceil(d.Seconds()))
+	if s < 1 {
+		s = 1
+	}
+	return strconv.Itoa(s)
+}
@@ -0,0 +1,243 @@
+package rpt
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+
+	rl := NewRateLimiter(2, 3)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.Allow("a"); !ok {
+			t.Fatalf("request %d within the burst was limited", i)
+		}
+	}
+	ok, retryAfter := rl.Allow("a")
+	if ok {
+		t.Fatal("request beyond the burst was allowed")
+	}
+	if retryAfter <= 0 || retryAfter > 500*time.Millisecond {
+		t.Errorf("retry after %s, want at most 500ms at 2 requests a second", retryAfter)
+	}
+	if ok, _ := rl.Allow("b"); !ok {
+		t.Error("another client shares the bucket")
+	}
+
+	// A second later the bucket holds two more tokens.
+	rl.mu.Lock()
+	rl.buckets["a"].last = rl.buckets["a"].last.Add(-time.Second)
+	rl.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.Allow("a"); !ok {
+			t.Fatalf("request %d after the refill was limited", i)
+		}
+	}
+	if ok, _ := rl.Allow("a"); ok {
+		t.Error("bucket refilled beyond the rate")
+	}
+
+	if NewRateLimiter(1, 0).Burst != 1 {
+		t.Error("a burst below 1 was not raised to 1")
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "1"},
+		{time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{queueFullRetryAfter, "5"},
+	}
+
+	for _, tt := range tests {
+		if got := retryAfterSeconds(tt.d); got != tt.want {
+			t.Errorf("retryAfterSeconds(%s) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+// chunked hides the length of a body, as a request without Content-Length
+// has.
+type chunked struct{ io.Reader }
+
+func TestAPIServerLimits(t *testing.T) {
+
+	const query = `{"Name":"count","Query":"SELECT count(*) FROM users"}`
+
+	tokens := NewTokenAuthenticator()
+	tokens.AddToken("write-token", "ci", RoleWrite)
+
+	tests := []struct {
+		name   string
+		server func() *APIServer
+		// The last of requests is checked, the ones before it must succeed
+		// or fail authentication.
+		requests int
+		method   string
+		path     string
+		auth     string
+		remote   string
+		body     io.Reader
+		status   int
+		code     string
+		retry    string
+	}{
+		{
+			name: "rate limited",
+			server: func() *APIServer {
+				a := newTestAPIServer(1)
+				a.RateLimiter = NewRateLimiter(0.001, 2)
+				return a
+			},
+			requests: 3, method: http.MethodGet, path: "/api/workflow",
+			status: http.StatusTooManyRequests, code: ErrCodeRateLimited, retry: "1000",
+		},
+		{
+			name: "other address",
+			server: func() *APIServer {
+				a := newTestAPIServer(1)
+				a.RateLimiter = NewRateLimiter(0.001, 2)
+				return a
+			},
+			requests: 3, method: http.MethodGet, path: "/api/workflow", remote: "192.0.2.2:1234",
+			status: http.StatusOK,
+		},
+		{
+			name: "health is not limited",
+			server: func() *APIServer {
+				a := newTestAPIServer(1)
+				a.RateLimiter = NewRateLimiter(0.001, 1)
+				return a
+			},
+			requests: 3, method: http.MethodGet, path: "/api/health",
+			status: http.StatusOK,
+		},
+		{
+			name: "failed authentication is limited",
+			server: func() *APIServer {
+				a := newTestAPIServer(1)
+				a.Auth = NewAPIAuth(tokens)
+				a.RateLimiter = NewRateLimiter(0.001, 2)
+				return a
+			},
+			requests: 3, method: http.MethodGet, path: "/api/workflow", auth: "Bearer guess",
+			status: http.StatusTooManyRequests, code: ErrCodeRateLimited,
+		},
+		{
+			name: "authenticated callers are limited",
+			server: func() *APIServer {
+				a := newTestAPIServer(1)
+				a.Auth = NewAPIAuth(tokens)
+				a.RateLimiter = NewRateLimiter(0.001, 1)
+				return a
+			},
+			requests: 2, method: http.MethodGet, path: "/api/workflow", auth: "Bearer write-token",
+			status: http.StatusTooManyRequests, code: ErrCodeRateLimited,
+		},
+		{
+			name: "body too large",
+			server: func() *APIServer {
+				a := newTestAPIServer(1)
+				a.MaxBodyBytes = 16
+				return a
+			},
+			requests: 1, method: http.MethodPost, path: "/api/query", body: strings.NewReader(query),
+			status: http.StatusRequestEntityTooLarge, code: ErrCodeBodyTooLarge,
+		},
+		{
+			name: "body too large without a length",
+			server: func() *APIServer {
+				a := newTestAPIServer(1)
+				a.MaxBodyBytes = 16
+				return a
+			},
+			requests: 1, method: http.MethodPost, path: "/api/query", body: chunked{strings.NewReader(query)},
+			status: http.StatusRequestEntityTooLarge, code: ErrCodeBodyTooLarge,
+		},
+		{
+			name: "body within the limit",
+			server: func() *APIServer {
+				a := newTestAPIServer(1)
+				a.MaxBodyBytes = int64(len(query))
+				return a
+			},
+			requests: 1, method: http.MethodPost, path: "/api/query", body: strings.NewReader(query),
+			status: http.StatusAccepted,
+		},
+		{
+			name:     "queue full",
+			server:   func() *APIServer { return newTestAPIServer(2) },
+			requests: 3, method: http.MethodPost, path: "/api/query",
+			status: http.StatusServiceUnavailable, code: ErrCodeQueueFull, retry: "5",
+		},
+		{
+			name: "shutting down",
+			server: func() *APIServer {
+				a := newTestAPIServer(2)
+				a.stopped = true
+				return a
+			},
+			requests: 1, method: http.MethodPost, path: "/api/query",
+			status: http.StatusServiceUnavailable, code: ErrCodeShuttingDown,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			a := tt.server()
+			h := a.Handler()
+
+			var w *httptest.ResponseRecorder
+			for i := 0; i < tt.requests; i++ {
+				body := tt.body
+				if body == nil && tt.method == http.MethodPost {
+					body = strings.NewReader(query)
+				}
+				req := httptest.NewRequest(tt.method, tt.path, body)
+				req.Header.Set("Content-Type", "application/json")
+				if tt.auth != "" {
+					req.Header.Set("Authorization", tt.auth)
+				}
+				if tt.remote != "" && i == tt.requests-1 {
+					req.RemoteAddr = tt.remote
+				}
+
+				w = httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+
+				if i < tt.requests-1 && w.Code >= 300 && w.Code != http.StatusUnauthorized {
+					t.Fatalf("request %d: status = %d: %s", i, w.Code, w.Body)
+				}
+			}
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.retry != "" && w.Header().Get("Retry-After") != tt.retry {
+				t.Errorf("Retry-After = %q, want %q", w.Header().Get("Retry-After"), tt.retry)
+			}
+			if tt.code != "" {
+				e := &APIError{}
+				if err := json.Unmarshal(w.Body.Bytes(), e); err != nil {
+					t.Fatalf("error response %q is not JSON: %s", w.Body, err)
+				}
+				if e.Code != tt.code {
+					t.Errorf("error code = %q, want %q", e.Code, tt.code)
+				}
+			}
+		})
+	}
+}
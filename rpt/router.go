@@ -0,0 +1,167 @@
+package rpt
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/*
+
+Router matches requests by method and path. Path segments in braces are
+parameters, read by handlers with PathParam:
+
+	rt := NewRouter()
+	rt.HandleFunc(http.MethodGet, "/api/operation/{id}", handler)
+
+	id := PathParam(r, "id")
+
+Where more than one route matches, the one with the fewest parameters wins.
+A path that matches with the wrong method gets 405 and an Allow header;
+OPTIONS requests are answered with the Allow header alone. GET routes also
+answer HEAD.
+
+*/
+
+type Router struct {
+	NotFound         http.Handler
+	MethodNotAllowed http.Handler // called after the Allow header is set
+
+	routes []*route
+}
+
+type route struct {
+	pattern  string
+	segments []string
+	handlers map[string]http.Handler
+}
+
+type pathParamsKey struct{}
+
+func NewRouter() *Router {
+	return &Router{
+		NotFound: http.NotFoundHandler(),
+		MethodNotAllowed: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}),
+	}
+}
+
+// Handle registers h for method and pattern. Like http.ServeMux it panics if
+// the pair is already registered.
+func (rt *Router) Handle(method, pattern string, h http.Handler) {
+
+	segments := splitPath(pattern)
+
+	for _, r := range rt.routes {
+		if strings.Join(r.segments, "/") != strings.Join(segments, "/") {
+			continue
+		}
+		if _, ok := r.handlers[method]; ok {
+			panic(fmt.Sprintf("rpt: route %s %s is already registered", method, pattern))
+		}
+		r.handlers[method] = h
+		return
+	}
+
+	rt.routes = append(rt.routes, &route{
+		pattern:  pattern,
+		segments: segments,
+		handlers: map[string]http.Handler{method: h},
+	})
+}
+
+func (rt *Router) HandleFunc(method, pattern string, f func(http.ResponseWriter, *http.Request)) {
+	rt.Handle(method, pattern, http.HandlerFunc(f))
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	var match *route
+	var params map[string]string
+
+	segments := splitPath(r.URL.Path)
+	for _, route := range rt.routes {
+		p, ok := route.match(segments)
+		if ok && (match == nil || len(p) < len(params)) {
+			match, params = route, p
+		}
+	}
+
+	if match == nil {
+		rt.NotFound.ServeHTTP(w, r)
+		return
+	}
+
+	h, ok := match.handlers[r.Method]
+	if !ok && r.Method == http.MethodHead {
+		h, ok = match.handlers[http.MethodGet]
+	}
+	if !ok {
+		w.Header().Set("Allow", match.allow())
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		rt.MethodNotAllowed.ServeHTTP(w, r)
+		return
+	}
+
+	if len(params) > 0 {
+		r = r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params))
+	}
+
+	h.ServeHTTP(w, r)
+}
+
+// PathParam returns the value of the named path parameter of the route that
+// matched r.
+func PathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
+
+func (rt *route) match(segments []string) (map[string]string, bool) {
+
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for i, s := range rt.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[s[1:len(s)-1]] = segments[i]
+			continue
+		}
+		if s != segments[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+func (rt *route) allow() string {
+
+	methods := []string{http.MethodOptions}
+	for m := range rt.handlers {
+		methods = append(methods, m)
+	}
+	if _, ok := rt.handlers[http.MethodGet]; ok {
+		if _, ok := rt.handlers[http.MethodHead]; !ok {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+	sort.Strings(methods)
+
+	return strings.Join(methods, ", ")
+}
+
+func splitPath(p string) []string {
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
@@ -0,0 +1,142 @@
+package rpt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+
+	rt := NewRouter()
+	for _, r := range []struct{ method, pattern string }{
+		{http.MethodGet, "/api/operation/{id}"},
+		{http.MethodGet, "/api/operation/latest"},
+		{http.MethodGet, "/api/client/{action}/{target}"},
+		{http.MethodPost, "/api/client/{action}/{target}"},
+		{http.MethodPost, "/api/query"},
+	} {
+		r := r
+		rt.HandleFunc(r.method, r.pattern, func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, "%s %s id=%s action=%s target=%s", r.method, r.pattern,
+				PathParam(req, "id"), PathParam(req, "action"), PathParam(req, "target"))
+		})
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		allow  string
+		body   string
+	}{
+		{http.MethodGet, "/api/operation/abc", http.StatusOK, "", "GET /api/operation/{id} id=abc action= target="},
+		{http.MethodGet, "/api/operation/latest", http.StatusOK, "", "GET /api/operation/latest id= action= target="},
+		{http.MethodGet, "/api/operation/abc/", http.StatusOK, "", "GET /api/operation/{id} id=abc action= target="},
+		{http.MethodPost, "/api/client/connect/primary", http.StatusOK, "", "POST /api/client/{action}/{target} id= action=connect target=primary"},
+		{http.MethodHead, "/api/operation/abc", http.StatusOK, "", ""},
+		{http.MethodDelete, "/api/operation/abc", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS", ""},
+		{http.MethodGet, "/api/query", http.StatusMethodNotAllowed, "OPTIONS, POST", ""},
+		{http.MethodOptions, "/api/client/connect/primary", http.StatusNoContent, "GET, HEAD, OPTIONS, POST", ""},
+		{http.MethodGet, "/api/operation", http.StatusNotFound, "", ""},
+		{http.MethodGet, "/api/operation//", http.StatusNotFound, "", ""},
+		{http.MethodGet, "/api/unknown", http.StatusNotFound, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Allow"); got != tt.allow {
+				t.Errorf("Allow = %q, want %q", got, tt.allow)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func TestRouterDuplicateRoute(t *testing.T) {
+
+	rt := NewRouter()
+	rt.HandleFunc(http.MethodGet, "/api/{id}", func(http.ResponseWriter, *http.Request) {})
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering GET /api/{id} twice did not panic")
+		}
+	}()
+	rt.HandleFunc(http.MethodGet, "/api/{id}/", func(http.ResponseWriter, *http.Request) {})
+}
+
+func TestAPIServerRoutes(t *testing.T) {
+
+	a := &APIServer{BasePath: "/api"}
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		allow  string
+		code   string // of the JSON error, if any
+		body   string
+	}{
+		{http.MethodGet, "/api/health", http.StatusOK, "", "", "ok."},
+		{http.MethodHead, "/api/health", http.StatusOK, "", "", ""},
+		{http.MethodPost, "/api/health", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS", ErrCodeMethodNotAllowed, ""},
+		{http.MethodOptions, "/api/health", http.StatusNoContent, "GET, HEAD, OPTIONS", "", ""},
+		{http.MethodGet, "/api/query", http.StatusMethodNotAllowed, "OPTIONS, POST", ErrCodeMethodNotAllowed, ""},
+		{http.MethodGet, "/api/client/connect/primary", http.StatusMethodNotAllowed, "OPTIONS, POST", ErrCodeMethodNotAllowed, ""},
+		{http.MethodPost, "/api/client/connect/tertiary", http.StatusNotFound, "", ErrCodeNotFound, ""},
+		{http.MethodGet, "/api/unknown", http.StatusNotFound, "", ErrCodeNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Allow"); got != tt.allow {
+				t.Errorf("Allow = %q, want %q", got, tt.allow)
+			}
+			if tt.method == http.MethodHead && len(body) > 0 {
+				t.Errorf("HEAD response has a body: %q", body)
+			}
+			if tt.body != "" && string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+			if tt.code != "" {
+				e := &APIError{}
+				if err := json.Unmarshal(body, e); err != nil {
+					t.Fatalf("error response %q is not JSON: %s", body, err)
+				}
+				if e.Code != tt.code {
+					t.Errorf("error code = %q, want %q", e.Code, tt.code)
+				}
+			}
+		})
+	}
+}
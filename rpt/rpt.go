@@ -1,11 +1,13 @@
 package rpt
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type RptClient struct {
@@ -14,128 +16,180 @@ type RptClient struct {
 	Operations  chan *DBOperationSet
 	API         APIServer
 	Logger      *Logger
-
-	currentLog *Log
-	loglvl     string
-	keepAlive  bool
-	state      chan *InternalStateChange
+	Lifecycle   *StateMachine
+	Tracer      *Tracer
+	Progress    *Progress
+
+	continuous      bool
+	summaryFile     string
+	shutdownTimeout time.Duration
+	state           chan *InternalStateChange
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	mu        sync.Mutex
+	drain     bool
+	processed chan struct{}
+	closeOps  sync.Once
+	shutdown  sync.Once
 }
 
 func NewRpt(primary, secondary DBClient, loglvl string) (*RptClient, error) {
 	c := make(chan *DBOperationSet, 50)
 	s := make(chan *InternalStateChange, 3)
-	return &RptClient{
-		DBPrimary:   primary,
-		DBSecondary: secondary,
-		Operations:  c,
-		state:       s,
-		keepAlive:   false,
-		loglvl:      loglvl,
-	}, nil
-}
-
-// func NewRptFromConfig(configPath string) (*RptClient, error) {
-// 	return NewRpt()
-// }
-
-func NewRptFromEnvironment() (*RptClient, error) {
-
-	// Gather env vars
-
-	primaryHost := strings.SplitN(os.Getenv("RPT_PRIMARY_HOST"), ":", 2)[1]     //required
-	primaryHostType := strings.SplitN(os.Getenv("RPT_PRIMARY_HOST"), ":", 2)[0] //required
-	primaryPort := os.Getenv("RPT_PRIMARY_PORT")                                //defaults to 5432
-	primaryUser := os.Getenv("RPT_PRIMARY_USER")                                //required
-	primaryPass := os.Getenv("RPT_PRIMARY_PASS")                                //required
-	primarySSLMode := os.Getenv("RPT_PRIMARY_SSLMODE")                          //defaults to disable
-
-	secondaryHost := strings.SplitN(os.Getenv("RPT_SECONDARY_HOST"), ":", 2)[1]     //required
-	secondaryHostType := strings.SplitN(os.Getenv("RPT_SECONDARY_HOST"), ":", 2)[0] //required
-	secondaryPort := os.Getenv("RPT_SECONDARY_PORT")                                //defaults to 5432
-	secondaryUser := os.Getenv("RPT_SECONDARY_USER")                                //required
-	secondaryPass := os.Getenv("RPT_SECONDARY_PASS")                                //required
-	secondarySSLMode := os.Getenv("RPT_SECONDARY_SSLMODE")                          //defaults to disable
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &RptClient{
+		DBPrimary:       primary,
+		DBSecondary:     secondary,
+		Operations:      c,
+		state:           s,
+		continuous:      true,
+		shutdownTimeout: 30 * time.Second,
+		ctx:             ctx,
+		cancel:          cancel,
+		drain:           true,
+		processed:       make(chan struct{}),
+		Logger:          NewLogger(loglvl),
+		Lifecycle:       NewStateMachine(),
+		Progress:        NewProgress(),
+	}
 
-	seedFile := os.Getenv("RPT_SEED_FILE") //optional
+	return r, nil
+}
 
-	useAPI := os.Getenv("RPT_API")                       //defaults to false
-	apiBasePath := os.Getenv("RPT_API_BASEPATH")         //defaults to api
-	apiListenAddress := os.Getenv("RPT_API_LISTEN_ADDR") //defaults to localhost:5000
+// NewRptFromConfig builds an RptClient from a YAML or JSON config file.
+// RPT_* environment variables override the values in the file.
+func NewRptFromConfig(configPath string) (*RptClient, error) {
 
-	rptLogLvl := os.Getenv("RPT_LOG_LVL") //defaults to INFO
+	c, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
 
-	log.Println(primaryHost)
-	log.Println(primaryHostType)
+	return NewRptWithConfig(c)
+}
 
-	// populate defaults
+// NewRptFromEnvironment builds an RptClient from the RPT_* environment
+// variables, starting from the config file in RPT_CONFIG_FILE if it is set.
+func NewRptFromEnvironment() (*RptClient, error) {
+	return NewRptFromConfig(os.Getenv("RPT_CONFIG_FILE"))
+}
 
-	l := &Logger{}
+// NewRptWithConfig connects both clients, creates the configured outputs and
+// queues the seed files and workflows from c.
+func NewRptWithConfig(c *Config) (*RptClient, error) {
 
-	if primaryPort == "" {
-		primaryPort = "5432"
+	err := c.Validate()
+	if err != nil {
+		return nil, err
 	}
 
-	if secondaryPort == "" {
-		secondaryPort = "5432"
-	}
+	l := NewLogger(c.LogLevel)
 
-	if rptLogLvl == "" {
-		rptLogLvl = "INFO"
+	for _, oc := range c.Outputs {
+		o := oc.newOutput()
+		err = o.Connect()
+		if err != nil {
+			return nil, err
+		}
+		if oc.wantsLogs() {
+			l.AddLogOutput(o)
+		}
+		if oc.wantsMetrics() {
+			l.AddMetricOutput(o)
+		}
 	}
 
-	// validate
+	// create objects
 
-	primaryPortInt, err := strconv.Atoi(primaryPort)
-	if err != nil {
-		return nil, err
-	}
+	db1 := getDBClient(c.Primary.Type, c.Primary.Host, c.Primary.User, c.Primary.Password, c.Primary.SSLMode, c.Primary.Port, l.With(Fields{FieldClient: "primary"}))
+	db2 := getDBClient(c.Secondary.Type, c.Secondary.Host, c.Secondary.User, c.Secondary.Password, c.Secondary.SSLMode, c.Secondary.Port, l.With(Fields{FieldClient: "secondary"}))
 
-	primarySSLMode, err = validateSSL(primarySSLMode)
+	err = db1.Connect()
 	if err != nil {
 		return nil, err
 	}
-
-	secondaryPortInt, err := strconv.Atoi(secondaryPort)
+	err = db2.Connect()
 	if err != nil {
 		return nil, err
 	}
 
-	secondarySSLMode, err = validateSSL(secondarySSLMode)
+	r, err := NewRpt(db1, db2, c.LogLevel)
 	if err != nil {
 		return nil, err
 	}
 
-	// create objects
-
-	db1 := getDBClient(primaryHostType, primaryHost, primaryUser, primaryPass, primarySSLMode, primaryPortInt, l)
-	db2 := getDBClient(secondaryHostType, secondaryHost, secondaryUser, secondaryPass, secondarySSLMode, secondaryPortInt, l)
+	// Nothing reads the queue until Init or RunOnce, so it needs room for the
+	// seed set and every workflow queued below, on top of the usual room for
+	// work from the API.
+	r.Operations = make(chan *DBOperationSet, cap(r.Operations)+1+len(c.Workflows))
 
-	err = db1.Connect()
-	if err != nil {
-		return nil, err
+	r.Logger = l
+	r.continuous = c.Continuous
+	r.summaryFile = c.SummaryFile
+	r.shutdownTimeout, _ = time.ParseDuration(c.ShutdownTimeout)
+
+	if c.Tracing.Enabled {
+		exp := c.Tracing.newExporter(l)
+		exp.Start()
+		r.Tracer = NewTracer(exp)
 	}
-	err = db2.Connect()
-	if err != nil {
-		return nil, err
+
+	if c.API.Enabled {
+		r.API = APIServer{
+			BasePath:     c.API.BasePath,
+			ListenAddr:   c.API.ListenAddr,
+			MaxBodyBytes: c.API.MaxBodyBytes,
+			DataDir:      c.API.DataDir,
+		}
+		if c.API.Auth.Enabled {
+			r.API.Auth = c.API.Auth.newAuth()
+		}
+		if d, _ := time.ParseDuration(c.API.IdempotencyWindow); d > 0 {
+			r.API.Idempotency = NewIdempotency(d)
+		}
+		if c.API.RateLimit > 0 {
+			r.API.RateLimiter = NewRateLimiter(c.API.RateLimit, c.API.RateBurst)
+		}
+		if c.API.GRPCListenAddr != "" {
+			r.API.GRPC = NewGRPCServer(c.API.GRPCListenAddr)
+		}
+		if c.API.TLS.CertFile != "" {
+			r.API.TLS, err = NewAPITLS(c.API.TLS.CertFile, c.API.TLS.KeyFile, c.API.TLS.ClientCAFile, ClientAuthMode(c.API.TLS.ClientAuth))
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	dbo := newDBOperationSet(nil)
-	r, err := NewRpt(db1, db2, rptLogLvl)
-	r.Logger = l
-	r.newLog()
+	if len(c.SeedFiles) > 0 {
+		dbo := newDBOperationSet(nil)
+		for _, f := range c.SeedFiles {
+			ds, errs := ImportDBDataSet(f)
+			if len(errs) > 0 {
+				return nil, errs[0]
+			}
+			dbo.AddOperation(SeedData(db1, ds))
+		}
+		r.queue(dbo)
+	}
 
-	if seedFile != "" {
-		ds, errs := ImportDBDataSet(seedFile)
+	for _, f := range c.Workflows {
+		w, errs := ImportWorkflow(f)
 		if len(errs) > 0 {
 			return nil, errs[0]
 		}
 
-		seed := SeedData(db1, ds)
-		dbo.Operations = append(dbo.Operations, seed)
-		r.Operations <- dbo
-	}
+		dbo, err := w.Build(db1, db2)
+		if err != nil {
+			return nil, err
+		}
+		r.queue(dbo)
 
-	r.API = *validateAPI(useAPI, apiBasePath, apiListenAddress)
+		if c.API.Enabled {
+			r.API.Workflows = append(r.API.Workflows, w)
+		}
+	}
 
 	return r, nil
 }
@@ -143,16 +197,8 @@ func NewRptFromEnvironment() (*RptClient, error) {
 func validateSSL(s string) (string, error) {
 
 	switch s {
-	case "disable":
-		log.Println("SSL Mode: disable")
-	case "require":
-		log.Println("SSL Mode: require")
-	case "verify-ca":
-		log.Println("SSL Mode: verify-ca")
-	case "verify-full":
-		log.Println("SSL Mode: verify-full")
+	case "disable", "require", "verify-ca", "verify-full":
 	case "":
-		log.Println("SSL Mode: not set. Defaulting to disable")
 		s = "disable"
 	default:
 		return "", fmt.Errorf("rpt: invalid SSL mode")
@@ -161,116 +207,359 @@ func validateSSL(s string) (string, error) {
 	return s, nil
 }
 
-func validateAPI(api, base, addr string) *APIServer {
+// Init starts the API (if configured), the state change listener and
+// operation processing, then blocks until the client is asked to stop. That
+// happens on SIGINT/SIGTERM, a POST to /close, or - when there is no API to
+// accept more work - once the queued operations have been processed. See
+// state.go for the state machine. SIGHUP reloads the API certificates.
+func (r *RptClient) Init() {
+
+	r.Logger.Debugf("RPT client initialized")
 
-	a := &APIServer{}
-	if api != "TRUE" {
-		return nil
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	if !r.Logger.HasLogOutputs() {
+		oot := NewConsoleOutput()
+		oot.Connect()
+		r.Logger.AddLogOutput(oot)
+		r.Logger.Debugf("Created console output")
 	}
 
-	if base == "" {
-		base = "/api"
+	go r.ListenForStateChange()
+	go r.Process()
+
+	// processed is only set without an API. Nothing else can queue work then,
+	// so the queue is processed in full, without the shutdown deadline,
+	// before draining.
+	var processed <-chan struct{}
+
+	if r.API.ListenAddr != "" {
+		r.Logger.Debugf("Initializing API")
+		go r.API.Init(r.Operations, r.state, r.Lifecycle, r.DBPrimary, r.DBSecondary, r.Logger, r.Tracer, r.Progress)
+		r.sendState(EventStarted)
+	} else {
+		r.Logger.Debugf("No API configured, stopping once queued operations are processed")
+		r.sendState(EventStarted)
+		r.closeOperations()
+		processed = r.processed
 	}
 
-	if addr == "" {
-		addr = ":5000"
+	for r.ctx.Err() == nil {
+		select {
+		case <-processed:
+			processed = nil
+			r.sendState(EventProcessThenStop)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				r.reloadTLS()
+				continue
+			}
+			r.Logger.Infof("Received %s, shutting down", sig)
+			r.sendState(EventProcessThenStop)
+		case <-r.ctx.Done():
+		}
 	}
 
-	a.BasePath = base
-	a.ListenAddr = addr
+	r.Shutdown()
+}
 
-	return a
+func (r *RptClient) reloadTLS() {
+	if r.API.TLS == nil {
+		return
+	}
+	err := r.API.ReloadTLS()
+	if err != nil {
+		r.Logger.Errorf("Unable to reload API certificates, keeping the previous ones: %s", err)
+		return
+	}
+	r.Logger.Infof("Reloaded API certificates")
 }
 
-func (r *RptClient) Init() {
+// Shutdown stops the API, drains the operation queue until the shutdown
+// timeout expires, flushes the logger outputs and closes both clients. It is
+// safe to call more than once.
+func (r *RptClient) Shutdown() {
+	r.shutdown.Do(func() {
 
-	r.currentLog.Debugf("RPT client initialized")
+		drain := r.drainOnStop()
+		r.cancel()
 
-	r.keepAlive = false
-	r.currentLog.Debugf("keepAlive set to false")
+		timeout := r.shutdownTimeout
+		if !drain {
+			timeout = 0
+		}
 
-	if r.API.ListenAddr != "" {
-		r.currentLog.Debugf("Initializing API")
-		go r.API.Init(r.Operations, r.state, r.DBPrimary, r.DBSecondary, r.Logger, r.loglvl)
-		r.keepAlive = true
-		r.currentLog.Debugf("keepAlive set to true")
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if r.API.ListenAddr != "" {
+			r.Logger.Debugf("Shutting down API")
+			err := r.API.Shutdown(ctx)
+			if err != nil {
+				r.Logger.Warnf("API shutdown: %s", err)
+			}
+		}
+
+		// API.Shutdown has stopped the API queueing more work, even if
+		// handlers are still running, so the queue can be closed.
+		r.closeOperations()
+
+		select {
+		case <-r.processed:
+			r.Logger.Debugf("Operation queue drained")
+		case <-ctx.Done():
+			r.Logger.Warnf("Shutdown deadline reached with %d operation sets still queued", len(r.Operations))
+		}
+
+		r.sendState(EventStop)
+		r.close()
+	})
+}
+
+// stop cancels the client context. drain decides whether Shutdown waits for
+// queued operations.
+func (r *RptClient) stop(drain bool) {
+	r.mu.Lock()
+	if r.ctx.Err() == nil {
+		r.drain = drain
+	}
+	r.mu.Unlock()
+	r.cancel()
+}
+
+func (r *RptClient) drainOnStop() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.drain
+}
+
+// sendState queues a state change for ListenForStateChange without blocking
+// once the client has stopped.
+func (r *RptClient) sendState(e StateEvent) {
+	select {
+	case r.state <- newInternalState(e):
+	case <-r.Lifecycle.Stopped():
 	}
+}
 
-	go r.ListenForStateChange()
-	go r.Process()
+// queue queues an operation set for Process.
+func (r *RptClient) queue(dbos *DBOperationSet) {
+	r.Progress.Publish(setEvent(ProgressQueued, dbos))
+	r.Operations <- dbos
+}
 
-	r.currentLog.Debugf("Creating console output")
-	oot := NewConsoleOutput()
-	oot.Connect()
-	r.Logger.AddLogOutput(oot)
+// Queue adds dbos to the operation sets run by Init or RunOnce, such as a
+// single command from the command line. It must be called before either
+// starts, and blocks while the queue is full.
+func (r *RptClient) Queue(dbos *DBOperationSet) {
+	r.queue(dbos)
+}
 
-	r.currentLog.Debugf("Entering keepAlive loop")
-	r.state <- newInternalState("cycle_log")
-	for r.keepAlive == true {
-		// Hold your horses.
+func (r *RptClient) closeOperations() {
+	r.closeOps.Do(func() {
+		close(r.Operations)
+	})
+}
+
+// Close flushes the logs and outputs and disconnects both clients, for a
+// client that fails before it is run. Init and RunOnce close the client
+// themselves.
+func (r *RptClient) Close() {
+	r.close()
+}
+
+// close flushes the logs and outputs and disconnects both clients.
+func (r *RptClient) close() {
+
+	r.Logger.Debugf("Closing clients and flushing outputs")
+
+	for _, c := range []DBClient{r.DBPrimary, r.DBSecondary} {
+		err := c.Disconnect()
+		if err != nil {
+			r.Logger.Errorf("Unable to disconnect %s client: %s", r.clientName(c), err)
+		}
 	}
-	r.currentLog.Debugf("Leaving keepAlive loop and exiting application")
-	r.state <- newInternalState("cycle_log")
+
+	r.Progress.Close()
+	r.Tracer.Shutdown()
+	r.Logger.Done()
 }
 
-func (r *RptClient) Process() {
-	r.currentLog.Debugf("Initializing RPT client operation processing")
-	for opSet := range r.Operations {
+// Run starts the client the way it was configured: continuous clients hand
+// over to Init, one-shot clients call RunOnce. The returned value is the
+// process exit status.
+func (r *RptClient) Run() int {
+
+	if r.continuous {
+		r.Init()
+		return 0
+	}
 
-		for _, op := range opSet.Operations {
+	summary := r.RunOnce()
 
-			op.Start()
+	os.Stdout.WriteString(summary.String())
 
+	if r.summaryFile != "" {
+		err := summary.WriteFile(r.summaryFile)
+		if err != nil {
+			r.Logger.Errorf("Unable to write summary: %s", err)
+			return 1
 		}
+	}
 
-		log.Println(string(ToJSON(opSet)))
+	if !summary.OK() {
+		return 1
 	}
-	r.currentLog.Debugf("RPT client operation processing exited")
+
+	return 0
 }
 
-func (r *RptClient) ListenForStateChange() {
-	r.currentLog.Debugf("Initializing internal state change listener")
-	waitingForShutdown := false
+// RunOnce processes the operation sets that are already queued, such as the
+// seed files and workflows from the config, and returns once they are all
+// complete. The API is not started and no further operations are accepted.
+func (r *RptClient) RunOnce() *RunSummary {
 
-	for sc := range r.state {
+	r.Logger.Debugf("Running queued operations once")
 
-		if sc.NewState == "stop" {
-			log.Println("Received STOP")
-			break
-		}
+	if !r.Logger.HasLogOutputs() {
+		oot := NewConsoleOutput()
+		oot.Connect()
+		r.Logger.AddLogOutput(oot)
+	}
 
-		if sc.NewState == "process_then_stop" {
-			log.Println("Received PROCESS THEN STOP")
-			waitingForShutdown = true
-		}
+	summary := newRunSummary()
+
+	r.handleStateChange(newInternalState(EventStarted))
+	r.handleStateChange(newInternalState(EventProcessThenStop))
+
+	r.closeOperations()
+	for opSet := range r.Operations {
+		r.start(opSet)
+		summary.add(opSet)
+	}
+
+	r.handleStateChange(newInternalState(EventProcessingComplete))
+
+	summary.complete()
+	r.Logger.Debugf("Processed %d operation sets, %d failed operations", summary.OperationSets, summary.Failures)
+	r.close()
+
+	return summary
+}
 
-		if sc.NewState == "processing_complete" && waitingForShutdown {
-			log.Println("Received PROCESSING COMPLETE - SHUTTING DOWN")
-			break
+// Process runs queued operation sets until the queue is closed and drained,
+// then sends processing_complete.
+func (r *RptClient) Process() {
+	r.Logger.Debugf("Initializing RPT client operation processing")
+	for opSet := range r.Operations {
+		r.start(opSet)
+	}
+	r.Logger.Debugf("RPT client operation processing exited")
+	r.sendState(EventProcessingComplete)
+	close(r.processed)
+}
+
+func (r *RptClient) ListenForStateChange() {
+	r.Logger.Debugf("Initializing internal state change listener")
+
+	for {
+		select {
+		case <-r.Lifecycle.Stopped():
+			r.Logger.Debugf("Exiting state change listener")
+			return
+		case sc := <-r.state:
+			r.handleStateChange(sc)
 		}
+	}
+}
 
-		if sc.NewState == "processing_complete" && !waitingForShutdown {
-			log.Println("Received PROCESSING COMPLETE")
+func (r *RptClient) handleStateChange(sc *InternalStateChange) {
+
+	t, ok := r.Lifecycle.Apply(sc)
+	if !ok {
+		r.Logger.Debugf("Ignoring %s in state %s", sc.Event, r.Lifecycle.Current())
+		return
+	}
+
+	r.Logger.Infof("State %s -> %s (%s)", t.From, t.To, t.Event)
+
+	switch t.To {
+	case StateDraining:
+		r.stop(true)
+	case StateStopped:
+		r.stop(false)
+	}
+}
+
+// start runs an operation set, labelling and logging each operation with the
+// client it uses, and writes the recorded metrics to the metric outputs.
+// Progress events are published as the set starts, completes each step and
+// finishes.
+func (r *RptClient) start(dbos *DBOperationSet) {
+
+	started := time.Now()
+	r.Progress.Publish(setEvent(ProgressStarted, dbos))
+
+	l := r.Logger.With(Fields{
+		FieldOperationSetID: dbos.ID,
+		FieldWorkflow:       dbos.Workflow,
+	})
+
+	for _, op := range dbos.Operations {
+		client := r.clientName(op.client)
+		op.SetLabel("client", client)
+		op.SetLogger(l.With(Fields{FieldClient: client}))
+	}
+
+	l.Debugf("Starting %d operations", len(dbos.Operations))
+
+	// Only the span is taken from the set's context; the request that queued
+	// the set has usually finished by now.
+	ctx := ContextWithTracer(context.Background(), r.Tracer)
+	ctx = ContextWithSpan(ctx, SpanFromContext(dbos.Context()))
+
+	dbos.onStep = func(i int, op *DBOperation) {
+		e := stepEvent(ProgressStepCompleted, dbos, i, op)
+		e.Duration = op.Duration().Seconds()
+		e.Failed = op.Failed()
+		for _, err := range op.Errors() {
+			e.Errors = append(e.Errors, err.Error())
 		}
+		r.Progress.Publish(e)
 
-		if sc.NewState == "cycle_log" {
-			r.currentLog.Debugf("State change cycle_log received")
-			r.newLog()
+		if mc := op.Metrics(); mc != nil && len(mc.Metrics) > 0 {
+			m := stepEvent(ProgressMetricsSampled, dbos, i, op)
+			m.Metrics = mc.Metrics
+			r.Progress.Publish(m)
 		}
+	}
 
+	dbos.StartContext(ctx)
+
+	if dbos.Failed() {
+		l.Warnf("Operation set completed with failures")
+	} else {
+		l.Infof("Operation set completed")
 	}
 
-	r.currentLog.Debugf("Exiting state change listener and setting keepAlive to false")
-	r.keepAlive = false
+	r.Logger.WriteMetric(dbos.Metrics())
+
+	e := setEvent(ProgressFinished, dbos)
+	e.Duration = time.Since(started).Seconds()
+	e.Failed = dbos.Failed()
+	r.Progress.Publish(e)
 }
 
-func (r *RptClient) newLog() {
-	if r.currentLog != nil {
-		r.currentLog.Debugf("Writing log to outputs")
-		r.Logger.WriteLog(r.currentLog)
+func (r *RptClient) clientName(c DBClient) string {
+	switch c {
+	case r.DBPrimary:
+		return "primary"
+	case r.DBSecondary:
+		return "secondary"
 	}
-	r.currentLog = NewLog(r.loglvl, "api_log")
-	r.currentLog.Debugf("New log created")
+	return ""
 }
 
 func getDBClient(clientType, host, user, password, ssl string, port int, logger *Logger) DBClient {
@@ -1,11 +1,147 @@
 package rpt
 
+import (
+	"sync"
+	"time"
+)
+
+/*
+
+The RptClient moves through four states. Events arrive on the internal state
+channel and anything not listed below is ignored.
+
+	starting --started--------------> ready
+	starting --process_then_stop----> draining
+	ready    --process_then_stop----> draining
+	draining --processing_complete--> stopped
+	starting,
+	ready,
+	draining --stop-----------------> stopped
+
+process_then_stop is sent by POST /close, SIGINT/SIGTERM and, when there is
+no API to accept more work, by Init once the queued operations have run.
+processing_complete is sent by Process once the operation queue has been
+closed and drained. stop skips draining.
+
+*/
+
+type ClientState string
+
+const (
+	StateStarting ClientState = "starting"
+	StateReady    ClientState = "ready"
+	StateDraining ClientState = "draining"
+	StateStopped  ClientState = "stopped"
+)
+
+type StateEvent string
+
+const (
+	EventStarted            StateEvent = "started"
+	EventStop               StateEvent = "stop"
+	EventProcessThenStop    StateEvent = "process_then_stop"
+	EventProcessingComplete StateEvent = "processing_complete"
+)
+
+var stateTransitions = map[ClientState]map[StateEvent]ClientState{
+	StateStarting: {
+		EventStarted:         StateReady,
+		EventProcessThenStop: StateDraining,
+		EventStop:            StateStopped,
+	},
+	StateReady: {
+		EventProcessThenStop: StateDraining,
+		EventStop:            StateStopped,
+	},
+	StateDraining: {
+		EventProcessingComplete: StateStopped,
+		EventStop:               StateStopped,
+	},
+	StateStopped: {},
+}
+
+// maxStateHistory bounds the transitions kept for GET /state.
+const maxStateHistory = 100
+
 type InternalStateChange struct {
-	NewState string
+	Event StateEvent
+	Time  time.Time
 }
 
-func newInternalState(state string) *InternalStateChange {
+func newInternalState(e StateEvent) *InternalStateChange {
 	return &InternalStateChange{
-		NewState: state,
+		Event: e,
+		Time:  time.Now(),
 	}
 }
+
+type StateTransition struct {
+	From  ClientState
+	To    ClientState
+	Event StateEvent
+	Time  time.Time
+}
+
+// StateMachine tracks the RptClient state. It is safe for concurrent use.
+type StateMachine struct {
+	mu      sync.RWMutex
+	current ClientState
+	history []StateTransition
+	stopped chan struct{}
+}
+
+func NewStateMachine() *StateMachine {
+	return &StateMachine{
+		current: StateStarting,
+		history: []StateTransition{},
+		stopped: make(chan struct{}),
+	}
+}
+
+// Apply moves to the next state for sc. It returns false if the event is not
+// valid in the current state.
+func (sm *StateMachine) Apply(sc *InternalStateChange) (StateTransition, bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	to, ok := stateTransitions[sm.current][sc.Event]
+	if !ok {
+		return StateTransition{}, false
+	}
+
+	t := StateTransition{
+		From:  sm.current,
+		To:    to,
+		Event: sc.Event,
+		Time:  sc.Time,
+	}
+
+	sm.current = to
+	sm.history = append(sm.history, t)
+	if len(sm.history) > maxStateHistory {
+		sm.history = sm.history[len(sm.history)-maxStateHistory:]
+	}
+
+	if to == StateStopped {
+		close(sm.stopped)
+	}
+
+	return t, true
+}
+
+func (sm *StateMachine) Current() ClientState {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.current
+}
+
+func (sm *StateMachine) History() []StateTransition {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return append([]StateTransition{}, sm.history...)
+}
+
+// Stopped is closed when the state machine reaches StateStopped.
+func (sm *StateMachine) Stopped() <-chan struct{} {
+	return sm.stopped
+}
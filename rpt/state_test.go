@@ -0,0 +1,100 @@
+package rpt
+
+import (
+	"testing"
+)
+
+func TestStateMachine(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		events  []StateEvent
+		applied []bool
+		want    ClientState
+	}{
+		{"new", nil, nil, StateStarting},
+		{"started", []StateEvent{EventStarted}, []bool{true}, StateReady},
+		{
+			"close then drain",
+			[]StateEvent{EventStarted, EventProcessThenStop, EventProcessingComplete},
+			[]bool{true, true, true},
+			StateStopped,
+		},
+		{"drain before ready", []StateEvent{EventProcessThenStop}, []bool{true}, StateDraining},
+		{"stop while starting", []StateEvent{EventStop}, []bool{true}, StateStopped},
+		{"stop while draining", []StateEvent{EventStarted, EventProcessThenStop, EventStop}, []bool{true, true, true}, StateStopped},
+		{"complete before draining", []StateEvent{EventStarted, EventProcessingComplete}, []bool{true, false}, StateReady},
+		{"started twice", []StateEvent{EventStarted, EventStarted}, []bool{true, false}, StateReady},
+		{"started while draining", []StateEvent{EventProcessThenStop, EventStarted}, []bool{true, false}, StateDraining},
+		{"close twice", []StateEvent{EventProcessThenStop, EventProcessThenStop}, []bool{true, false}, StateDraining},
+		{"stopped is final", []StateEvent{EventStop, EventStarted, EventStop}, []bool{true, false, false}, StateStopped},
+		{"unknown event", []StateEvent{"pause"}, []bool{false}, StateStarting},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			sm := NewStateMachine()
+			from := sm.Current()
+			applied := 0
+
+			for i, e := range tt.events {
+				tr, ok := sm.Apply(newInternalState(e))
+				if ok != tt.applied[i] {
+					t.Fatalf("Apply(%s) in %s = %t, want %t", e, from, ok, tt.applied[i])
+				}
+				if !ok {
+					continue
+				}
+				applied++
+				if tr.From != from || tr.To != sm.Current() || tr.Event != e {
+					t.Errorf("Apply(%s) returned %+v, want %s to %s", e, tr, from, sm.Current())
+				}
+				from = sm.Current()
+			}
+
+			if got := sm.Current(); got != tt.want {
+				t.Errorf("state = %s, want %s", got, tt.want)
+			}
+			if got := len(sm.History()); got != applied {
+				t.Errorf("history has %d transitions, want %d", got, applied)
+			}
+
+			select {
+			case <-sm.Stopped():
+				if tt.want != StateStopped {
+					t.Errorf("Stopped is closed in %s", tt.want)
+				}
+			default:
+				if tt.want == StateStopped {
+					t.Error("Stopped is not closed")
+				}
+			}
+		})
+	}
+}
+
+func TestStateMachineHistory(t *testing.T) {
+
+	sm := NewStateMachine()
+
+	// Only three transitions can happen, so start from a full history.
+	for i := 0; i < maxStateHistory; i++ {
+		sm.history = append(sm.history, StateTransition{From: StateStarting, To: StateStarting})
+	}
+	sm.Apply(newInternalState(EventStarted))
+
+	history := sm.History()
+	if len(history) != maxStateHistory {
+		t.Fatalf("history has %d transitions, want %d", len(history), maxStateHistory)
+	}
+	if last := history[len(history)-1]; last.To != StateReady {
+		t.Errorf("newest transition = %+v, want to ready", last)
+	}
+
+	// History returns a copy.
+	history[len(history)-1].To = StateDraining
+	if h := sm.History(); h[len(h)-1].To != StateReady {
+		t.Error("changing the returned history changed the state machine")
+	}
+}
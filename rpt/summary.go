@@ -0,0 +1,138 @@
+package rpt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RunSummary describes everything processed by a one-shot run.
+type RunSummary struct {
+	Started       time.Time
+	Completed     time.Time
+	Duration      string
+	OperationSets int
+	Operations    int
+	Failures      int
+	Results       []*OperationSummary
+	Latency       map[string]*Percentiles // by operation name, in seconds
+
+	metrics *MetricCollection
+}
+
+type OperationSummary struct {
+	OperationSetID string
+	Workflow       string
+	ID             string
+	Name           string
+	Duration       string
+	Failed         bool
+	Errors         []string
+}
+
+func newRunSummary() *RunSummary {
+	mc, _ := NewMetricCollection()
+	return &RunSummary{
+		Started: time.Now(),
+		Results: []*OperationSummary{},
+		Latency: map[string]*Percentiles{},
+		metrics: mc,
+	}
+}
+
+func (s *RunSummary) add(dbos *DBOperationSet) {
+
+	s.OperationSets++
+	s.metrics.AddMetrics(dbos.Metrics())
+
+	for _, op := range dbos.Operations {
+
+		opSum := &OperationSummary{
+			OperationSetID: dbos.ID,
+			Workflow:       dbos.Workflow,
+			ID:             op.ID,
+			Name:           op.Name,
+			Duration:       op.Duration().String(),
+			Failed:         op.Failed(),
+			Errors:         []string{},
+		}
+
+		for _, err := range op.Errors() {
+			opSum.Errors = append(opSum.Errors, err.Error())
+		}
+
+		s.Operations++
+		if opSum.Failed {
+			s.Failures++
+		}
+
+		s.Results = append(s.Results, opSum)
+	}
+}
+
+func (s *RunSummary) complete() {
+	s.Completed = time.Now()
+	s.Duration = s.Completed.Sub(s.Started).String()
+
+	for _, r := range s.Results {
+		if _, ok := s.Latency[r.Name]; !ok {
+			s.Latency[r.Name] = s.metrics.Percentiles("rpt_operation_duration_seconds", map[string]string{"operation": r.Name})
+		}
+	}
+}
+
+// OK reports whether every operation in the run succeeded.
+func (s *RunSummary) OK() bool {
+	return s.Failures == 0
+}
+
+func (s *RunSummary) String() string {
+
+	b := &strings.Builder{}
+
+	for _, r := range s.Results {
+		status := "ok"
+		if r.Failed {
+			status = "FAILED"
+		}
+
+		name := r.Name
+		if r.Workflow != "" {
+			name = fmt.Sprintf("%s/%s", r.Workflow, r.Name)
+		}
+
+		fmt.Fprintf(b, "%-6s %s (%s)\n", status, name, r.Duration)
+		for _, e := range r.Errors {
+			fmt.Fprintf(b, "       error: %s\n", e)
+		}
+	}
+
+	if len(s.Latency) > 0 {
+		names := make([]string, 0, len(s.Latency))
+		for n := range s.Latency {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(b, "\n%-20s %6s %10s %10s %10s\n", "operation", "count", "p50", "p95", "p99")
+		for _, n := range names {
+			p := s.Latency[n]
+			fmt.Fprintf(b, "%-20s %6d %10s %10s %10s\n", n, p.Count, seconds(p.P50), seconds(p.P95), seconds(p.P99))
+		}
+	}
+
+	fmt.Fprintf(b, "\n%d operation sets, %d operations, %d failed in %s\n", s.OperationSets, s.Operations, s.Failures, s.Duration)
+
+	return b.String()
+}
+
+func seconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(time.Microsecond).String()
+}
+
+// WriteFile writes the summary as JSON to filePath.
+func (s *RunSummary) WriteFile(filePath string) error {
+	return ioutil.WriteFile(filePath, ToJSON(s), 0644)
+}
@@ -0,0 +1,172 @@
+package rpt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+
+APITLS serves the API over HTTPS from a certificate and key on disk. The files
+are checked for changes at most every tlsReloadInterval during handshakes, and
+Reload reads them again straight away (RptClient calls it on SIGHUP), so
+certificates can be renewed without a restart.
+
+With ClientCAFile set, client certificates are verified against it according
+to ClientAuth:
+
+	none       client certificates are not requested
+	optional   verified if presented
+	require    every client must present a valid certificate
+
+*/
+
+const tlsReloadInterval = 10 * time.Second
+
+type ClientAuthMode string
+
+const (
+	ClientAuthNone     ClientAuthMode = "none"
+	ClientAuthOptional ClientAuthMode = "optional"
+	ClientAuthRequire  ClientAuthMode = "require"
+)
+
+var clientAuthTypes = map[ClientAuthMode]tls.ClientAuthType{
+	ClientAuthNone:     tls.NoClientCert,
+	ClientAuthOptional: tls.VerifyClientCertIfGiven,
+	ClientAuthRequire:  tls.RequireAndVerifyClientCert,
+}
+
+type APITLS struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	ClientAuth   ClientAuthMode
+	Logger       *Logger
+
+	mu        sync.Mutex
+	config    *tls.Config
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+// NewAPITLS loads the certificate, key and client CAs, so a bad file is
+// reported before the server starts.
+func NewAPITLS(certFile, keyFile, clientCAFile string, clientAuth ClientAuthMode) (*APITLS, error) {
+
+	t := &APITLS{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: clientCAFile,
+		ClientAuth:   clientAuth,
+	}
+
+	err := t.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Config returns the tls.Config for the API server. Each handshake gets the
+// most recently loaded certificate and client CAs.
+func (t *APITLS) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.current(), nil
+		},
+	}
+}
+
+// Reload reads the certificate, key and client CAs again. On failure the
+// previous ones stay in use.
+func (t *APITLS) Reload() error {
+
+	files := []string{t.CertFile, t.KeyFile}
+	if t.ClientCAFile != "" {
+		files = append(files, t.ClientCAFile)
+	}
+
+	modTimes := map[string]time.Time{}
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[f] = fi.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return fmt.Errorf("rpt: unable to load API certificate: %s", err)
+	}
+
+	c := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if t.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("rpt: no certificates found in %s", t.ClientCAFile)
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = clientAuthTypes[t.ClientAuth]
+	}
+
+	t.mu.Lock()
+	t.config = c
+	t.modTimes = modTimes
+	t.lastCheck = time.Now()
+	t.mu.Unlock()
+
+	return nil
+}
+
+// current returns the loaded config, reloading it first if any of the files
+// have changed since the last check.
+func (t *APITLS) current() *tls.Config {
+
+	t.mu.Lock()
+	check := time.Since(t.lastCheck) >= tlsReloadInterval
+	if check {
+		t.lastCheck = time.Now()
+	}
+	modTimes := t.modTimes
+	t.mu.Unlock()
+
+	if check && t.changed(modTimes) {
+		if err := t.Reload(); err != nil {
+			t.Logger.Errorf("Unable to reload API certificates, keeping the previous ones: %s", err)
+		} else {
+			t.Logger.Infof("Reloaded API certificates")
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.config
+}
+
+func (t *APITLS) changed(modTimes map[string]time.Time) bool {
+	for f, mt := range modTimes {
+		fi, err := os.Stat(f)
+		if err != nil || !fi.ModTime().Equal(mt) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,299 @@
+package rpt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rpt test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns a PEM certificate and key for cn, valid for localhost if
+// server is set and for client auth otherwise.
+func (ca *testCA) issue(t *testing.T, cn string, server bool) ([]byte, []byte) {
+
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.DNSNames = []string{"localhost"}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes b to name in dir and returns its path.
+func writeFile(t *testing.T, dir, name string, b []byte) string {
+
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// serveTLS starts a server with t's config that responds with the common name
+// of the verified client certificate, if any.
+func serveTLS(t *APITLS) *httptest.Server {
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+		}
+	}))
+	srv.TLS = t.Config()
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // rejected handshakes
+	srv.StartTLS()
+
+	return srv
+}
+
+// get requests srv as localhost, trusting ca and presenting cert if set. It
+// returns the server's certificate and the response body.
+func get(srv *httptest.Server, ca *testCA, cert *tls.Certificate) (*x509.Certificate, string, error) {
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	tc := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+	if cert != nil {
+		tc.Certificates = []tls.Certificate{*cert}
+	}
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+
+	resp, err := c.Get(srv.URL)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	return resp.TLS.PeerCertificates[0], string(body), nil
+}
+
+func TestAPITLSClientAuth(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rpt-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "localhost", true)
+	certFile := writeFile(t, dir, "server.crt", certPEM)
+	keyFile := writeFile(t, dir, "server.key", keyPEM)
+	caFile := writeFile(t, dir, "ca.crt", ca.pem)
+
+	clientPEM, clientKeyPEM := ca.issue(t, "ci", false)
+	client, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := newTestCA(t)
+	otherPEM, otherKeyPEM := other.issue(t, "stranger", false)
+	stranger, err := tls.X509KeyPair(otherPEM, otherKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		caFile  string
+		mode    ClientAuthMode
+		cert    *tls.Certificate
+		subject string
+		wantErr bool
+	}{
+		{"no client CA", "", ClientAuthRequire, &client, "", false},
+		{"none ignores certificates", caFile, ClientAuthNone, &client, "", false},
+		{"optional without a certificate", caFile, ClientAuthOptional, nil, "", false},
+		{"optional verifies a certificate", caFile, ClientAuthOptional, &client, "ci", false},
+		{"optional rejects an unknown CA", caFile, ClientAuthOptional, &stranger, "", true},
+		{"require without a certificate", caFile, ClientAuthRequire, nil, "", true},
+		{"require verifies a certificate", caFile, ClientAuthRequire, &client, "ci", false},
+		{"require rejects an unknown CA", caFile, ClientAuthRequire, &stranger, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			at, err := NewAPITLS(certFile, keyFile, tt.caFile, tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := serveTLS(at)
+			defer srv.Close()
+
+			_, subject, err := get(srv, ca, tt.cert)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %t", err, tt.wantErr)
+			}
+			if subject != tt.subject {
+				t.Errorf("client certificate subject = %q, want %q", subject, tt.subject)
+			}
+		})
+	}
+}
+
+func TestAPITLSReload(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rpt-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "localhost", true)
+	certFile := writeFile(t, dir, "server.crt", certPEM)
+	keyFile := writeFile(t, dir, "server.key", keyPEM)
+
+	if _, err := NewAPITLS(filepath.Join(dir, "missing.crt"), keyFile, "", ClientAuthNone); err == nil {
+		t.Error("NewAPITLS with a missing certificate did not fail")
+	}
+	if _, err := NewAPITLS(certFile, keyFile, writeFile(t, dir, "empty.crt", nil), ClientAuthRequire); err == nil {
+		t.Error("NewAPITLS with an empty client CA file did not fail")
+	}
+
+	at, err := NewAPITLS(certFile, keyFile, "", ClientAuthNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serveTLS(at)
+	defer srv.Close()
+
+	serial := func() *big.Int {
+		t.Helper()
+		cert, _, err := get(srv, ca, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.SerialNumber
+	}
+	first := serial()
+
+	// A renewed certificate is picked up by Reload.
+	renewedPEM, renewedKeyPEM := ca.issue(t, "localhost", true)
+	writeFile(t, dir, "server.crt", renewedPEM)
+	writeFile(t, dir, "server.key", renewedKeyPEM)
+	if err := at.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	second := serial()
+	if second.Cmp(first) == 0 {
+		t.Error("Reload kept serving the old certificate")
+	}
+
+	// A broken key fails to load and the previous certificate stays in use,
+	// both through Reload and the check during handshakes.
+	writeFile(t, dir, "server.key", []byte("not a key"))
+	if err := at.Reload(); err == nil {
+		t.Error("Reload of a broken key did not fail")
+	}
+	at.mu.Lock()
+	at.lastCheck = time.Time{}
+	at.mu.Unlock()
+	if got := serial(); got.Cmp(second) != 0 {
+		t.Error("a failed reload replaced the certificate")
+	}
+
+	// Changed files are picked up during handshakes once tlsReloadInterval
+	// has passed since the last check.
+	renewedPEM, renewedKeyPEM = ca.issue(t, "localhost", true)
+	writeFile(t, dir, "server.crt", renewedPEM)
+	writeFile(t, dir, "server.key", renewedKeyPEM)
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := serial(); got.Cmp(second) != 0 {
+		t.Error("certificate was reloaded before tlsReloadInterval passed")
+	}
+	at.mu.Lock()
+	at.lastCheck = time.Now().Add(-tlsReloadInterval)
+	at.mu.Unlock()
+	if got := serial(); got.Cmp(second) == 0 {
+		t.Error("changed certificate was not reloaded during the handshake")
+	}
+}
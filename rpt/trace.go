@@ -0,0 +1,262 @@
+package rpt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+Tracing records a span for each API request, DBOperationSet, DBOperation and
+SQL statement, and hands finished spans to a SpanExporter such as
+OTLPExporter.
+
+The Tracer travels in the context. StartSpan starts a child of the span in
+the context, or a new trace if there is none; without a Tracer it returns a
+nil *Span, and every *Span method is safe to call on nil.
+
+	ctx, span := StartSpan(ctx, "operation_set", SpanKindInternal)
+	defer span.End()
+
+Incoming requests continue the trace in their W3C traceparent header:
+
+	traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+
+*/
+
+type SpanKind int
+
+// Values match the OTLP span kinds.
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+type traceContextKey int
+
+const (
+	tracerKey traceContextKey = iota
+	spanKey
+	remoteSpanKey
+)
+
+// SpanExporter receives every span when it ends.
+type SpanExporter interface {
+	ExportSpan(*Span)
+	Shutdown()
+}
+
+type Tracer struct {
+	exporter SpanExporter
+}
+
+func NewTracer(e SpanExporter) *Tracer {
+	return &Tracer{
+		exporter: e,
+	}
+}
+
+// Shutdown exports any buffered spans.
+func (t *Tracer) Shutdown() {
+	if t == nil || t.exporter == nil {
+		return
+	}
+	t.exporter.Shutdown()
+}
+
+// Start starts a span that is a child of the span in ctx.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &Span{
+		Name:       name,
+		Kind:       kind,
+		StartTime:  time.Now(),
+		Attributes: map[string]interface{}{},
+		tracer:     t,
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentSpanID = parent.SpanID
+	} else if remote, ok := ctx.Value(remoteSpanKey).(*spanContext); ok {
+		s.TraceID = remote.traceID
+		s.ParentSpanID = remote.spanID
+	} else {
+		s.TraceID = randomHex(16)
+	}
+	s.SpanID = randomHex(8)
+
+	ctx = context.WithValue(ctx, tracerKey, t)
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// Extract continues the trace in the traceparent header, if there is one.
+func (t *Tracer) Extract(ctx context.Context, h http.Header) context.Context {
+
+	ctx = ContextWithTracer(ctx, t)
+
+	sc, ok := parseTraceparent(h.Get("traceparent"))
+	if !ok {
+		return ctx
+	}
+
+	return context.WithValue(ctx, remoteSpanKey, sc)
+}
+
+func ContextWithTracer(ctx context.Context, t *Tracer) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tracerKey, t)
+}
+
+// StartSpan starts a span with the Tracer in ctx.
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	t, _ := ctx.Value(tracerKey).(*Tracer)
+	return t.Start(ctx, name, kind)
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey).(*Span)
+	return s
+}
+
+// ContextWithSpan returns ctx carrying s and its Tracer. It is used to carry
+// a span across the operation queue.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, tracerKey, s.tracer)
+	return context.WithValue(ctx, spanKey, s)
+}
+
+// InjectTraceparent sets the traceparent header for the span in ctx.
+func InjectTraceparent(ctx context.Context, h http.Header) {
+	if s := SpanFromContext(ctx); s != nil {
+		h.Set("traceparent", s.Traceparent())
+	}
+}
+
+// SPAN
+
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Kind         SpanKind
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   map[string]interface{}
+	Error        string
+
+	tracer *Tracer
+	mu     sync.Mutex
+	ended  bool
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Attributes[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed. A nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Error = err.Error()
+	s.mu.Unlock()
+}
+
+// End records the end time and exports the span. Only the first call has any
+// effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+
+	if s.tracer.exporter != nil {
+		s.tracer.exporter.ExportSpan(s)
+	}
+}
+
+// Traceparent returns the W3C traceparent header value for the span.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+// TRACE CONTEXT
+
+type spanContext struct {
+	traceID string
+	spanID  string
+}
+
+// parseTraceparent reads a version 00 traceparent header.
+func parseTraceparent(h string) (*spanContext, bool) {
+
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return nil, false
+	}
+
+	traceID, spanID := strings.ToLower(parts[1]), strings.ToLower(parts[2])
+	if !isHex(traceID, 32) || !isHex(spanID, 16) || !isHex(parts[3], 2) {
+		return nil, false
+	}
+	if traceID == strings.Repeat("0", 32) || spanID == strings.Repeat("0", 16) {
+		return nil, false
+	}
+
+	return &spanContext{traceID: traceID, spanID: spanID}, true
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
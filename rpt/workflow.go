@@ -1,7 +1,11 @@
 package rpt
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -9,8 +13,18 @@ import (
 type Workflow struct {
 	operations DBOperationSet
 	Name       string
+	Steps      []*WorkflowStep
 	started    time.Time
 	completed  time.Time
+	logger     *Logger
+}
+
+type WorkflowStep struct {
+	Name      string
+	Operation string // seed, query, lag, compare
+	Target    string // primary, secondary
+	DataFile  string
+	Query     string
 }
 
 // FUNCTIONS
@@ -25,7 +39,7 @@ func (w *Workflow) Start() {
 	// }
 
 	d := w.Complete()
-	fmt.Printf("\nCompleted in %s\n", d)
+	w.logger.Infof("Workflow completed in %s", d)
 }
 
 func (w *Workflow) Started() time.Time {
@@ -45,13 +59,102 @@ func (w *Workflow) Duration() time.Duration {
 	return w.completed.Sub(w.started)
 }
 
+// Build turns the workflow steps into a DBOperationSet that can be queued on
+// RptClient.Operations.
+func (w *Workflow) Build(primary, secondary DBClient) (*DBOperationSet, error) {
+
+	ops := newDBOperationSet(nil)
+	ops.Workflow = w.Name
+
+	for i, s := range w.Steps {
+
+		var client DBClient
+		switch s.Target {
+		case "primary", "":
+			client = primary
+		case "secondary":
+			client = secondary
+		default:
+			return nil, fmt.Errorf("rpt: workflow %s step %d: invalid target %q", w.Name, i, s.Target)
+		}
+
+		op, err := s.newOperation(client, primary, secondary)
+		if err != nil {
+			return nil, fmt.Errorf("rpt: workflow %s step %d: %s", w.Name, i, err)
+		}
+
+		ops.AddOperation(op)
+	}
+
+	return ops, nil
+}
+
+func (s *WorkflowStep) newOperation(client, primary, secondary DBClient) (*DBOperation, error) {
+
+	switch s.Operation {
+	case "seed":
+		ds, errs := ImportDBDataSet(s.DataFile)
+		if len(errs) > 0 {
+			return nil, errs[0]
+		}
+		return SeedData(client, ds), nil
+	case "read", "write", "delete":
+		// ReadData, WriteData and DeleteData only seed for now.
+		return nil, fmt.Errorf("operation %q is not supported yet", s.Operation)
+	case "query":
+		return Query(client, &DBQueryDataSet{Name: s.Name, Query: s.Query}), nil
+	case "lag":
+		return ReplicationLag(primary, secondary), nil
+	case "compare":
+		return Compare(primary, secondary, &DBQueryDataSet{Name: s.Name, Query: s.Query}), nil
+	}
+
+	return nil, fmt.Errorf("invalid operation %q", s.Operation)
+}
+
 // IMPLEMENTATIONS
 
-func NewWorkflow(w string, r RptClient) *Workflow {
+func NewWorkflow(w string, r *RptClient) *Workflow {
 
 	//Do stuff
 
-	return &Workflow{}
+	return &Workflow{
+		Name:   w,
+		logger: r.Logger.With(Fields{FieldWorkflow: w}),
+	}
+}
+
+func ImportWorkflow(filePath string) (*Workflow, []error) {
+
+	errs := []error{}
+	w := &Workflow{}
+
+	jsonFile, err := os.Open(filePath)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	defer jsonFile.Close()
+
+	content, err := ioutil.ReadAll(jsonFile)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	err = json.Unmarshal(content, w)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	// Data files are relative to the workflow file.
+	for _, s := range w.Steps {
+		s.DataFile = relativeTo(filepath.Dir(filePath), s.DataFile)
+	}
+
+	if w.Name == "" {
+		w.Name = filepath.Base(filePath)
+	}
+
+	return w, errs
 }
 
 func startupWorkflow(p DBClient, s DBClient) *Workflow {